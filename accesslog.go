@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+type requestInfoKey struct{}
+
+// requestInfo travels in the request context. Inner handlers fill in what the
+// access log can not see by itself, e.g. the authenticated user.
+type requestInfo struct {
+	id         string
+	clientIP   string
+	user       string
+	hmcAddress string // the HMC address that served the request, if any
+}
+
+func withRequestInfo(ctx context.Context, info *requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// ctxLogger returns a logger carrying the request ID of ctx, if any.
+func ctxLogger(ctx context.Context) *log.Entry {
+	if info := requestInfoFrom(ctx); info != nil {
+		return log.WithField("request_id", info.id)
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// statusRecorder captures the response status and size for the access log.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// AccessLog assigns every request an X-Request-ID, propagating a valid one sent
+// by the client, and logs one line per request once it has been served.
+type AccessLog struct {
+	logRequests bool
+	ips         *ClientIPResolver
+}
+
+func NewAccessLog(config *viper.Viper, ips *ClientIPResolver) *AccessLog {
+	return &AccessLog{
+		logRequests: strings.ToLower(config.GetString("srv_access_log")) != "no",
+		ips:         ips,
+	}
+}
+
+// Middleware returns the access log handler
+func (a *AccessLog) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		info := &requestInfo{id: id, clientIP: a.ips.ClientIP(r)}
+		w.Header().Set("X-Request-ID", id)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(withRequestInfo(r.Context(), info)))
+
+		if !a.logRequests {
+			return
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		tlsVersion := ""
+		if r.TLS != nil {
+			tlsVersion = tlsVersionToString(r.TLS.Version)
+		}
+		log.WithFields(log.Fields{
+			"request_id": id,
+			"remote":     info.clientIP,
+			"method":     r.Method,
+			"path":       r.URL.Path,
+			"status":     rec.status,
+			"bytes":      rec.bytes,
+			"latency_ms": time.Since(start).Milliseconds(),
+			"user":       info.user,
+			"hmc":        info.hmcAddress,
+			"tls":        tlsVersion,
+		}).Info("access")
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID accepts client supplied IDs of sane length made of safe characters,
+// so they can not forge log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
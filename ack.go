@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// ackSystemExpiry forgets a system no collection reported for this long, unless it is
+// acknowledged. Observe also sees the few systems of a re-check, so one missing from a
+// single call is still there.
+const ackSystemExpiry = 15 * time.Minute
+
+// errLEDNotLit is returned when acknowledging a system whose attention LED is off.
+var errLEDNotLit = errors.New("attention LED is not lit")
+
+// Acknowledgement marks the lit LED of a frame as known, until the LED turns off or the
+// reference code changes.
+type Acknowledgement struct {
+	Frame      string    `json:"frame" yaml:"frame" xml:"frame"` // MTMS, or HMC/UUID without one
+	HMC        string    `json:"hmc" yaml:"hmc" xml:"hmc"`
+	SystemName string    `json:"systemname" yaml:"systemname" xml:"systemname"`
+	UUID       string    `json:"uuid" yaml:"uuid" xml:"uuid"`
+	RefCode    string    `json:"rfc" yaml:"rfc" xml:"rfc"` // acknowledged reference code
+	User       string    `json:"user" yaml:"user" xml:"user"`
+	Comment    string    `json:"comment,omitempty" yaml:"comment,omitempty" xml:"comment,omitempty"`
+	Ticket     string    `json:"ticket,omitempty" yaml:"ticket,omitempty" xml:"ticket,omitempty"`
+	Time       time.Time `json:"time" yaml:"time" xml:"time"`
+}
+
+// AcksResponse is the GET /acks response.
+type AcksResponse struct {
+	XMLName xml.Name           `json:"-" yaml:"-" xml:"acks"`
+	Acks    []*Acknowledgement `json:"acks" yaml:"acks" xml:"ack"`
+}
+
+// ackRequest is the POST /systems/{uuid}/ack body.
+type ackRequest struct {
+	User    string `json:"user"`
+	Comment string `json:"comment"`
+	Ticket  string `json:"ticket"`
+}
+
+// AckStore keeps the acknowledgements, saved to acknowledgements.json in state_dir on every change.
+type AckStore struct {
+	file string
+
+	mu      sync.Mutex
+	acks    map[string]*Acknowledgement // by frameKey
+	systems map[string]*QuickMgms       // last observation, by frameKey
+	seen    map[string]time.Time        // time of the last observation, by frameKey
+}
+
+func NewAckStore(config *viper.Viper) (*AckStore, error) {
+
+	store := &AckStore{
+		file:    filepath.Join(stateDir(config), "acknowledgements.json"),
+		acks:    map[string]*Acknowledgement{},
+		systems: map[string]*QuickMgms{},
+		seen:    map[string]time.Time{},
+	}
+	data, err := os.ReadFile(store.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var acks []*Acknowledgement
+	if err := json.Unmarshal(data, &acks); err != nil {
+		return nil, fmt.Errorf("%s %w", store.file, err)
+	}
+	for _, ack := range acks {
+		store.acks[ack.Frame] = ack
+	}
+	log.Infof("%d acknowledgements loaded from %s", len(store.acks), store.file)
+	return store, nil
+}
+
+// save writes the acknowledgements, the caller holds mu.
+func (store *AckStore) save() error {
+	list := make([]*Acknowledgement, 0, len(store.acks))
+	for _, ack := range store.acks {
+		list = append(list, ack)
+	}
+	if err := saveState(store.file, list); err != nil {
+		return fmt.Errorf("saving acknowledgements %w", err)
+	}
+	return nil
+}
+
+// Observe records the collected systems and clears the acknowledgements of systems whose
+// LED is off or whose reference code changed, it is a SystemTracker systems subscriber.
+// Systems not reported for ackSystemExpiry are forgotten unless acknowledged.
+func (store *AckStore) Observe(systems []*QuickMgms) {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	cleared := false
+	for _, s := range systems {
+		key := frameKey(s)
+		store.systems[key] = s
+		store.seen[key] = now
+		ack, exists := store.acks[key]
+		if !exists {
+			continue
+		}
+		switch {
+		case !s.LED:
+			log.Infof("Acknowledgement of %s by %s cleared, attention LED off", s.SysName, ack.User)
+		case s.RefCode != ack.RefCode:
+			log.Infof("Acknowledgement of %s by %s cleared, reference code %s -> %s", s.SysName, ack.User, ack.RefCode, s.RefCode)
+		default:
+			continue
+		}
+		delete(store.acks, key)
+		cleared = true
+	}
+	for key, seen := range store.seen {
+		if _, acked := store.acks[key]; !acked && now.Sub(seen) >= ackSystemExpiry {
+			delete(store.systems, key)
+			delete(store.seen, key)
+		}
+	}
+	if cleared {
+		if err := store.save(); err != nil {
+			log.Errorf("%s", err)
+		}
+	}
+}
+
+// find returns the frameKey of the last observed system with the UUID or MTMS id, the caller holds mu.
+func (store *AckStore) find(id string) (string, *QuickMgms) {
+	for key, s := range store.systems {
+		if s.UUID == id || s.MTMS == id {
+			return key, s
+		}
+	}
+	return "", nil
+}
+
+// Acknowledge acknowledges the lit LED of the system with the UUID or MTMS id.
+func (store *AckStore) Acknowledge(id string, req *ackRequest) (*Acknowledgement, error) {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	key, s := store.find(id)
+	if s == nil {
+		return nil, errSystemNotFound
+	}
+	if !s.LED {
+		return nil, errLEDNotLit
+	}
+	ack := &Acknowledgement{
+		Frame:      key,
+		HMC:        s.HMC,
+		SystemName: s.SysName,
+		UUID:       s.UUID,
+		RefCode:    s.RefCode,
+		User:       req.User,
+		Comment:    req.Comment,
+		Ticket:     req.Ticket,
+		Time:       time.Now(),
+	}
+	prev := store.acks[key]
+	store.acks[key] = ack
+	if err := store.save(); err != nil {
+		if prev != nil {
+			store.acks[key] = prev
+		} else {
+			delete(store.acks, key)
+		}
+		return nil, err
+	}
+	c := *ack
+	return &c, nil
+}
+
+// Delete removes the acknowledgement of the system with the UUID or MTMS id, false when there is none.
+func (store *AckStore) Delete(id string) (bool, error) {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	key := ""
+	for k, a := range store.acks {
+		if a.UUID == id || a.Frame == id {
+			key = k
+		}
+	}
+	if key == "" {
+		key, _ = store.find(id)
+	}
+	ack, exists := store.acks[key]
+	if !exists {
+		return false, nil
+	}
+	delete(store.acks, key)
+	if err := store.save(); err != nil {
+		store.acks[key] = ack
+		return true, err
+	}
+	return true, nil
+}
+
+// List returns the acknowledgements, oldest first.
+func (store *AckStore) List() []*Acknowledgement {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	list := []*Acknowledgement{}
+	for _, ack := range store.acks {
+		c := *ack
+		list = append(list, &c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Time.Before(list[j].Time) })
+	return list
+}
+
+// Mark sets Ack of the acknowledged systems. The systems may carry values the tracker
+// still holds back, so the acknowledgements are not compared with them: Observe clears
+// them by the recorded values. A nil *AckStore marks nothing.
+func (store *AckStore) Mark(systems []*QuickMgms) {
+	if store == nil {
+		return
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, s := range systems {
+		if ack, exists := store.acks[frameKey(s)]; exists {
+			c := *ack
+			s.Ack = &c
+		}
+	}
+}
+
+// MarshalCSV renders one row per acknowledgement.
+func (resp *AcksResponse) MarshalCSV() [][]string {
+	records := [][]string{
+		{"frame", "hmc", "systemname", "uuid", "rfc", "user", "ticket", "time", "comment"},
+	}
+	for _, ack := range resp.Acks {
+		records = append(records, []string{
+			ack.Frame, ack.HMC, ack.SystemName, ack.UUID, ack.RefCode, ack.User, ack.Ticket,
+			ack.Time.Format(time.RFC3339), ack.Comment,
+		})
+	}
+	return records
+}
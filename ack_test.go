@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestAckStoreForgetsSystems(t *testing.T) {
+
+	config := viper.New()
+	config.Set("state_dir", t.TempDir())
+	store, err := NewAckStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lit := &QuickMgms{HMC: "HMC1", UUID: "uuid-1", MTMS: "9080-HEX-1", SysName: "P10-a", LED: true, RefCode: "B7001234"}
+	gone := &QuickMgms{HMC: "HMC1", UUID: "uuid-2", MTMS: "9080-HEX-2", SysName: "P10-b"}
+	store.Observe([]*QuickMgms{lit, gone})
+	if _, err := store.Acknowledge("uuid-1", &ackRequest{User: "jdoe"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a re-check reports a few systems only, the others are kept
+	store.Observe([]*QuickMgms{{HMC: "HMC1", UUID: "uuid-3", MTMS: "9080-HEX-3", SysName: "P10-c"}})
+	if _, s := store.find("uuid-2"); s == nil {
+		t.Fatal("system forgotten before it expired")
+	}
+
+	store.mu.Lock()
+	for key := range store.seen {
+		store.seen[key] = store.seen[key].Add(-ackSystemExpiry)
+	}
+	store.mu.Unlock()
+	store.Observe([]*QuickMgms{{HMC: "HMC1", UUID: "uuid-3", MTMS: "9080-HEX-3", SysName: "P10-c"}})
+
+	if _, err := store.Acknowledge("uuid-2", &ackRequest{User: "jdoe"}); !errors.Is(err, errSystemNotFound) {
+		t.Errorf("expired system: %v, want %v", err, errSystemNotFound)
+	}
+	if _, s := store.find("uuid-1"); s == nil {
+		t.Error("acknowledged system forgotten")
+	}
+	if len(store.systems) != 2 || len(store.seen) != 2 {
+		t.Errorf("%d systems, %d seen, want the acknowledged and the reported one", len(store.systems), len(store.seen))
+	}
+	if acks := store.List(); len(acks) != 1 || acks[0].UUID != "uuid-1" || time.Since(acks[0].Time) > time.Minute {
+		t.Errorf("acks %+v", acks)
+	}
+}
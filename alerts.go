@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Alert states
+const (
+	alertPending = "pending"
+	alertFiring  = "firing"
+)
+
+var alertSeverities = []string{"critical", "warning", "info"}
+
+// labels with these names would clash in the Prometheus rendering of /alerts
+var alertReservedLabels = map[string]bool{
+	"rule": true, "severity": true, "state": true, "hmc": true, "systemname": true, "mtms": true, "uuid": true,
+}
+
+var alertLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// alertEvaluateInterval re-evaluates the last collected systems, so "for" durations and
+// since_change pass without a new collection.
+const alertEvaluateInterval = 15 * time.Second
+
+// alertSystemExpiry drops a system no collection reported for this long, e.g. one removed
+// from the HMC, and resolves its alerts. A shorter HMC outage keeps them.
+const alertSystemExpiry = 15 * time.Minute
+
+// AlertRule fires for every system for which Expr holds, once it held For.
+type AlertRule struct {
+	Name     string            `mapstructure:"name"`
+	Expr     string            `mapstructure:"expr"`
+	For      string            `mapstructure:"for"`
+	Severity string            `mapstructure:"severity"`
+	Labels   map[string]string `mapstructure:"labels"`
+	Summary  string            `mapstructure:"summary"`
+
+	condition *exprNode
+	duration  time.Duration
+	summary   *texttemplate.Template
+}
+
+// Alert is one rule holding for one system.
+type Alert struct {
+	Rule       string      `json:"rule" yaml:"rule" xml:"rule"`
+	State      string      `json:"state" yaml:"state" xml:"state"`
+	Severity   string      `json:"severity" yaml:"severity" xml:"severity"`
+	Labels     AlertLabels `json:"labels,omitempty" yaml:"labels,omitempty" xml:"labels,omitempty"`
+	Summary    string      `json:"summary" yaml:"summary" xml:"summary"`
+	HMC        string      `json:"hmc" yaml:"hmc" xml:"hmc"`
+	SystemName string      `json:"systemname" yaml:"systemname" xml:"systemname"`
+	MTMS       string      `json:"mtms" yaml:"mtms" xml:"mtms"`
+	UUID       string      `json:"uuid" yaml:"uuid" xml:"uuid"`
+	ActiveAt   time.Time   `json:"active_at" yaml:"active_at" xml:"active_at"`
+	FiredAt    *time.Time  `json:"fired_at,omitempty" yaml:"fired_at,omitempty" xml:"fired_at,omitempty"`
+	Silenced   bool        `json:"silenced" yaml:"silenced" xml:"silenced"`
+	System     *QuickMgms  `json:"system" yaml:"system" xml:"system"`
+}
+
+// AlertLabels are rendered as <label name="...">value</label> in XML.
+type AlertLabels map[string]string
+
+func (labels AlertLabels) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, name := range labels.names() {
+		label := xml.StartElement{Name: xml.Name{Local: "label"}, Attr: []xml.Attr{{Name: xml.Name{Local: "name"}, Value: name}}}
+		if err := e.EncodeElement(labels[name], label); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+func (labels AlertLabels) names() []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AlertsResponse is the /alerts response.
+type AlertsResponse struct {
+	XMLName xml.Name `json:"-" yaml:"-" xml:"alerts"`
+	Alerts  []*Alert `json:"alerts" yaml:"alerts" xml:"alert"`
+}
+
+// AlertEngine evaluates the alert rules against the collected systems and notifies
+// when an alert starts or stops firing.
+type AlertEngine struct {
+	rules  []*AlertRule
+	notify *Notifications
+
+	mu      sync.Mutex
+	systems map[string]*QuickMgms // last observation, by frameKey
+	seen    map[string]time.Time  // time of the last observation, by frameKey
+	alerts  map[string]*Alert     // by rule name and frameKey
+}
+
+// NewAlertEngine returns nil without alert_rules.
+func NewAlertEngine(config *viper.Viper, notify *Notifications) (*AlertEngine, error) {
+
+	var rules []*AlertRule
+	if err := config.UnmarshalKey("alert_rules", &rules); err != nil {
+		return nil, fmt.Errorf("alert_rules %w", err)
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	names := map[string]bool{}
+	for i, rule := range rules {
+		if rule.Name == "" || rule.Expr == "" {
+			return nil, fmt.Errorf("alert_rules[%d]: name and expr are required", i)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("alert rule name %s is not unique", rule.Name)
+		}
+		names[rule.Name] = true
+
+		var err error
+		if rule.condition, err = compileExpr(rule.Expr); err != nil {
+			return nil, fmt.Errorf("alert rule %s: expr %w", rule.Name, err)
+		}
+		if rule.For != "" {
+			if rule.duration, err = time.ParseDuration(rule.For); err != nil {
+				return nil, fmt.Errorf("alert rule %s: for %w", rule.Name, err)
+			}
+		}
+		rule.Severity = strings.ToLower(rule.Severity)
+		if rule.Severity == "" {
+			rule.Severity = "warning"
+		}
+		known := false
+		for _, severity := range alertSeverities {
+			known = known || severity == rule.Severity
+		}
+		if !known {
+			return nil, fmt.Errorf("alert rule %s: severity must be one of %s", rule.Name, strings.Join(alertSeverities, ", "))
+		}
+		for name := range rule.Labels {
+			if !alertLabelName.MatchString(name) || alertReservedLabels[name] {
+				return nil, fmt.Errorf("alert rule %s: label name %s is not allowed", rule.Name, name)
+			}
+		}
+		summary := rule.Summary
+		if summary == "" {
+			summary = "System {{.SystemName}}: " + rule.Name
+		}
+		if rule.summary, err = texttemplate.New(rule.Name).Parse(summary); err != nil {
+			return nil, fmt.Errorf("alert rule %s: summary %w", rule.Name, err)
+		}
+	}
+	log.Infof("%d alert rules", len(rules))
+
+	return &AlertEngine{
+		rules:   rules,
+		notify:  notify,
+		systems: map[string]*QuickMgms{},
+		seen:    map[string]time.Time{},
+		alerts:  map[string]*Alert{},
+	}, nil
+}
+
+// Update records the collected systems and evaluates the rules, it is a SystemTracker
+// systems subscriber. Systems missing from a collection keep their alerts for alertSystemExpiry.
+func (engine *AlertEngine) Update(systems []*QuickMgms) {
+
+	now := time.Now()
+	engine.mu.Lock()
+	for _, s := range systems {
+		key := frameKey(s)
+		engine.systems[key] = s
+		engine.seen[key] = now
+	}
+	engine.mu.Unlock()
+
+	engine.evaluate(time.Now())
+}
+
+// Run re-evaluates the rules until ctx is done.
+func (engine *AlertEngine) Run(ctx context.Context, wg *sync.WaitGroup) {
+
+	defer wg.Done()
+
+	ticker := time.NewTicker(alertEvaluateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			engine.evaluate(now)
+		}
+	}
+}
+
+func (engine *AlertEngine) evaluate(now time.Time) {
+
+	notifications := []*Notification{}
+
+	engine.mu.Lock()
+	for key, seen := range engine.seen {
+		if now.Sub(seen) < alertSystemExpiry {
+			continue
+		}
+		log.Infof("System %s not reported since %s, its alerts are resolved", engine.systems[key].SysName, seen.Format(time.RFC3339))
+		for _, rule := range engine.rules {
+			id := rule.Name + "\x00" + key
+			if alert := engine.alerts[id]; alert != nil {
+				delete(engine.alerts, id)
+				if alert.State == alertFiring {
+					notifications = append(notifications, alert.notification(notifyAlertResolve))
+				}
+			}
+		}
+		delete(engine.systems, key)
+		delete(engine.seen, key)
+	}
+	for key, system := range engine.systems {
+		env := &exprEnv{system: system, now: now}
+		for _, rule := range engine.rules {
+			id := rule.Name + "\x00" + key
+			alert := engine.alerts[id]
+			if !rule.condition.eval(env).(bool) {
+				if alert != nil {
+					delete(engine.alerts, id)
+					if alert.State == alertFiring {
+						notifications = append(notifications, alert.notification(notifyAlertResolve))
+					}
+				}
+				continue
+			}
+			if alert == nil {
+				alert = &Alert{
+					Rule:     rule.Name,
+					State:    alertPending,
+					Severity: rule.Severity,
+					Labels:   AlertLabels(rule.Labels),
+					ActiveAt: now,
+				}
+				engine.alerts[id] = alert
+			}
+			alert.HMC, alert.SystemName, alert.MTMS, alert.UUID = system.HMC, system.SysName, system.MTMS, system.UUID
+			alert.System = system
+			alert.Summary = rule.render(alert)
+			if alert.State == alertPending && now.Sub(alert.ActiveAt) >= rule.duration {
+				firedAt := now
+				alert.State, alert.FiredAt = alertFiring, &firedAt
+				notifications = append(notifications, alert.notification(notifyAlertFiring))
+			}
+		}
+	}
+	engine.mu.Unlock()
+
+	for _, ev := range notifications {
+		engine.notify.Notify(ev)
+	}
+}
+
+func (rule *AlertRule) render(alert *Alert) string {
+	var b bytes.Buffer
+	if err := rule.summary.Execute(&b, alert); err != nil {
+		log.Warnf("Alert rule %s: summary %s", rule.Name, err)
+		return rule.Name
+	}
+	return b.String()
+}
+
+func (alert *Alert) notification(kind string) *Notification {
+
+	message := alert.Summary
+	if kind == notifyAlertResolve {
+		message = "Resolved: " + message
+	}
+	return &Notification{
+		Kind:     kind,
+		Message:  message,
+		HMC:      alert.HMC,
+		System:   alert.SystemName,
+		UUID:     alert.UUID,
+		MTMS:     alert.MTMS,
+		RefCode:  alert.System.RefCode,
+		Location: alert.System.Location,
+		Mgms:     alert.System,
+		Rule:     alert.Rule,
+		Severity: alert.Severity,
+		Labels:   alert.Labels,
+	}
+}
+
+// Alerts are the pending and firing alerts, firing first, then by rule and system.
+func (engine *AlertEngine) Alerts() []*Alert {
+
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	alerts := []*Alert{}
+	for _, alert := range engine.alerts {
+		a := *alert
+		alerts = append(alerts, &a)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].State != alerts[j].State {
+			return alerts[i].State == alertFiring
+		}
+		if alerts[i].Rule != alerts[j].Rule {
+			return alerts[i].Rule < alerts[j].Rule
+		}
+		return alerts[i].SystemName < alerts[j].SystemName
+	})
+	return alerts
+}
+
+// MarshalCSV renders one row per alert, labels as name=value separated by ";".
+func (resp *AlertsResponse) MarshalCSV() [][]string {
+	records := [][]string{
+		{"rule", "state", "severity", "hmc", "systemname", "mtms", "active_at", "fired_at", "silenced", "labels", "summary"},
+	}
+	for _, alert := range resp.Alerts {
+		firedAt := ""
+		if alert.FiredAt != nil {
+			firedAt = alert.FiredAt.Format(time.RFC3339)
+		}
+		labels := []string{}
+		for _, name := range alert.Labels.names() {
+			labels = append(labels, name+"="+alert.Labels[name])
+		}
+		records = append(records, []string{
+			alert.Rule, alert.State, alert.Severity, alert.HMC, alert.SystemName, alert.MTMS,
+			alert.ActiveAt.Format(time.RFC3339), firedAt, strconv.FormatBool(alert.Silenced), strings.Join(labels, ";"), alert.Summary,
+		})
+	}
+	return records
+}
+
+// WritePrometheus renders the alerts like the Prometheus ALERTS series.
+func (resp *AlertsResponse) WritePrometheus(w io.Writer) {
+	fmt.Fprintln(w, "# HELP hmc_led_alert Pending or firing alert of a managed system.")
+	fmt.Fprintln(w, "# TYPE hmc_led_alert gauge")
+	for _, alert := range resp.Alerts {
+		fmt.Fprintf(w, "hmc_led_alert{rule=%s,state=%s,severity=%s,hmc=%s,systemname=%s,mtms=%s",
+			promQuote(alert.Rule), promQuote(alert.State), promQuote(alert.Severity),
+			promQuote(alert.HMC), promQuote(alert.SystemName), promQuote(alert.MTMS))
+		for _, name := range alert.Labels.names() {
+			fmt.Fprintf(w, ",%s=%s", name, promQuote(alert.Labels[name]))
+		}
+		fmt.Fprintln(w, "} 1")
+	}
+}
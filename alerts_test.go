@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestAlertEngineExpiresSystems(t *testing.T) {
+
+	config := viper.New()
+	config.Set("alert_rules", []map[string]interface{}{{"name": "attention", "expr": "LED"}})
+	notify := NewNotifications()
+	notified := []*Notification{}
+	notify.Subscribe(func(ev *Notification) { notified = append(notified, ev) })
+	engine, err := NewAlertEngine(config, notify)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine.Update([]*QuickMgms{{HMC: "HMC1", MTMS: "9080-HEX-1", SysName: "P10", LED: true}})
+	if alerts := engine.Alerts(); len(alerts) != 1 || alerts[0].State != alertFiring {
+		t.Fatalf("alerts %+v, want one firing", alerts)
+	}
+
+	// missing from the collections for a while, the alert stays
+	engine.evaluate(time.Now().Add(alertSystemExpiry / 2))
+	if len(engine.Alerts()) != 1 {
+		t.Fatal("alert resolved before the system expired")
+	}
+
+	engine.evaluate(time.Now().Add(alertSystemExpiry))
+	if alerts := engine.Alerts(); len(alerts) != 0 {
+		t.Fatalf("alerts %+v of an expired system", alerts)
+	}
+	if len(notified) != 2 || notified[0].Kind != notifyAlertFiring || notified[1].Kind != notifyAlertResolve {
+		t.Errorf("notified %+v, want firing and resolved", notified)
+	}
+}
@@ -16,6 +16,7 @@ type AuthMiddleware struct {
 	username string
 	password string
 	realm    string
+	notify   *Notifications
 	mu       sync.RWMutex
 }
 
@@ -45,37 +46,55 @@ func (a *AuthMiddleware) Middleware(next http.Handler) http.Handler {
 			next.ServeHTTP(w, r)
 			return
 		}
-		if !a.authenticate(r) {
-			log.Warnf("Srv Unauthorized request from %s", r.RemoteAddr)
+		info := requestInfoFrom(r.Context())
+		user, ok := a.authenticate(r)
+		if !ok {
+			clientIP := r.RemoteAddr
+			if info != nil {
+				clientIP = info.clientIP
+			}
+			ctxLogger(r.Context()).Warnf("Srv Unauthorized request from %s", clientIP)
+			// a browser asks without credentials first, only wrong ones are a failure
+			if r.Header.Get("Authorization") != "" {
+				a.notify.Notify(&Notification{
+					Kind:    notifyAuthFailure,
+					Client:  clientIP,
+					User:    user,
+					Message: fmt.Sprintf("Authentication failure for user %q from %s, %s %s", user, clientIP, r.Method, r.URL.Path),
+				})
+			}
 			a.askForCredentials(w)
 			return
 		}
+		if info != nil {
+			info.user = user
+		}
 		next.ServeHTTP(w, r)
 	})
 }
 
-// authenticate checks the credentials
-func (a *AuthMiddleware) authenticate(r *http.Request) bool {
+// authenticate checks the credentials and returns the authenticated user
+func (a *AuthMiddleware) authenticate(r *http.Request) (string, bool) {
 	a.mu.RLock()
 	defer a.mu.RUnlock()
 
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
-		return false
+		return "", false
 	}
 	authParts := strings.SplitN(authHeader, " ", 2)
 	if len(authParts) != 2 || authParts[0] != "Basic" {
-		return false
+		return "", false
 	}
 	payload, err := base64.StdEncoding.DecodeString(authParts[1])
 	if err != nil {
-		return false
+		return "", false
 	}
 	credentials := strings.SplitN(string(payload), ":", 2)
 	if len(credentials) != 2 {
-		return false
+		return "", false
 	}
-	return credentials[0] == a.username && credentials[1] == a.password
+	return credentials[0], credentials[0] == a.username && credentials[1] == a.password
 }
 
 // askForCredentials prompts for authentication
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// ClientIPResolver finds the address of the client. Forwarding headers are believed
+// only when the connection comes from a trusted proxy.
+type ClientIPResolver struct {
+	trusted []*net.IPNet
+}
+
+func NewClientIPResolver(config *viper.Viper) *ClientIPResolver {
+
+	trusted, err := parseCIDRs(config.GetStringSlice("srv_trusted_proxies"))
+	if err != nil {
+		log.Errorf("srv_trusted_proxies: %s. Forwarding headers are ignored.", err)
+		trusted = nil
+	}
+	if len(trusted) > 0 {
+		log.Infof("Srv trusted proxies: %v", trusted)
+	}
+	return &ClientIPResolver{trusted: trusted}
+}
+
+// parseCIDRs accepts networks in CIDR notation as well as single addresses.
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ClientIPResolver) isTrusted(ip net.IP) bool {
+	return ip != nil && containsIP(c.trusted, ip)
+}
+
+// ClientIP returns the client address of r.
+// The hops of Forwarded (RFC 7239) or X-Forwarded-For are walked right to left, skipping
+// trusted proxies; the first untrusted hop is the client.
+func (c *ClientIPResolver) ClientIP(r *http.Request) string {
+
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	if !c.isTrusted(net.ParseIP(remote)) {
+		return remote
+	}
+
+	hops := forwardedHops(r.Header.Values("Forwarded"))
+	if len(hops) == 0 {
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(value, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+	}
+	if len(hops) > 0 {
+		client := remote
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := parseHopIP(hops[i])
+			if ip == nil {
+				// obfuscated or garbage hop, the last trusted address is as far as we can get
+				break
+			}
+			client = ip.String()
+			if !c.isTrusted(ip) {
+				break
+			}
+		}
+		return client
+	}
+
+	for _, header := range []string{"X-Real-Ip", "X-Client-Ip", "CF-Connecting-IP"} {
+		if ip := parseHopIP(r.Header.Get(header)); ip != nil {
+			return ip.String()
+		}
+	}
+	return remote
+}
+
+// forwardedHops returns the "for" parameters of Forwarded header values, in order.
+func forwardedHops(values []string) []string {
+	hops := []string{}
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(key, "for") {
+					hops = append(hops, strings.Trim(val, `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parseHopIP parses a forwarded address, with optional port and IPv6 brackets.
+func parseHopIP(hop string) net.IP {
+	hop = strings.TrimSpace(hop)
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		return net.ParseIP(host)
+	}
+	return net.ParseIP(strings.Trim(hop, "[]"))
+}
+
+// IPACLRule allows or denies client addresses for the routes matching Path.
+// Path is a path.Match pattern, "*" or empty matches every route.
+type IPACLRule struct {
+	Path  string   `mapstructure:"path"`
+	Allow []string `mapstructure:"allow"`
+	Deny  []string `mapstructure:"deny"`
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// IPACL applies the first rule matching the request path. Deny entries win over allow
+// entries; a non empty allow list denies everybody else.
+type IPACL struct {
+	rules []*IPACLRule
+}
+
+func NewIPACL(config *viper.Viper) *IPACL {
+
+	rules := []*IPACLRule{}
+	if err := config.UnmarshalKey("srv_ip_acl", &rules); err != nil {
+		log.Fatalf("srv_ip_acl: %s", err)
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	for _, rule := range rules {
+		var err error
+		if rule.allow, err = parseCIDRs(rule.Allow); err != nil {
+			log.Fatalf("srv_ip_acl %s allow: %s", rule.Path, err)
+		}
+		if rule.deny, err = parseCIDRs(rule.Deny); err != nil {
+			log.Fatalf("srv_ip_acl %s deny: %s", rule.Path, err)
+		}
+		log.Infof("Srv IP ACL %q allow: %v deny: %v", rule.Path, rule.Allow, rule.Deny)
+	}
+	return &IPACL{rules: rules}
+}
+
+func (a *IPACL) allowed(urlPath string, ip net.IP) bool {
+	for _, rule := range a.rules {
+		if rule.Path != "" && rule.Path != "*" {
+			if matched, _ := path.Match(rule.Path, urlPath); !matched {
+				continue
+			}
+		}
+		if ip == nil {
+			return false
+		}
+		if containsIP(rule.deny, ip) {
+			return false
+		}
+		return len(rule.allow) == 0 || containsIP(rule.allow, ip)
+	}
+	return true
+}
+
+// Middleware rejects requests from client addresses not allowed for the route
+func (a *IPACL) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientIP := ""
+		if info := requestInfoFrom(r.Context()); info != nil {
+			clientIP = info.clientIP
+		}
+		if !a.allowed(r.URL.Path, net.ParseIP(clientIP)) {
+			ctxLogger(r.Context()).Warnf("Srv %s denied by IP ACL for %s", clientIP, r.URL.Path)
+			respondError(w, r, http.StatusForbidden, "forbidden")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
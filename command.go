@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// commandQueueSize notifications wait for a free command slot, more are dropped.
+const commandQueueSize = 256
+
+// commandOutputLimit bytes of stdout and of stderr are logged, the rest is discarded.
+const commandOutputLimit = 64 * 1024
+
+func init() {
+	RegisterNotifier("command", func(config *viper.Viper, deps *NotifierDeps) (Notifier, error) {
+		if c, err := NewCommandNotifier(config); c != nil || err != nil {
+			return c, err
+		}
+		return nil, nil
+	})
+}
+
+// CommandNotifier runs a local program for every LED, state and reference code change.
+// The program is executed directly, not by a shell, with the notification in HMC_LED_*
+// environment variables and as JSON on stdin. Its output is logged.
+type CommandNotifier struct {
+	path        string
+	args        []string
+	timeout     time.Duration
+	concurrency int
+	queue       chan *Notification
+
+	mu    sync.Mutex
+	stats CommandStats
+}
+
+// CommandStats is the command part of /status.
+type CommandStats struct {
+	Command   string `json:"command" yaml:"command" xml:"command"`
+	Running   int    `json:"running" yaml:"running" xml:"running"`
+	Runs      int64  `json:"runs" yaml:"runs" xml:"runs"`
+	Failures  int64  `json:"failures" yaml:"failures" xml:"failures"`
+	TimedOut  int64  `json:"timed_out" yaml:"timed_out" xml:"timed_out"`
+	Dropped   int64  `json:"dropped" yaml:"dropped" xml:"dropped"`
+	LastError string `json:"last_error,omitempty" yaml:"last_error,omitempty" xml:"last_error,omitempty"`
+}
+
+// NewCommandNotifier returns nil without command, the program and its arguments. At most
+// command_concurrency programs run at the same time, each is killed after command_timeout.
+func NewCommandNotifier(config *viper.Viper) (*CommandNotifier, error) {
+
+	command := config.GetStringSlice("command")
+	if len(command) == 0 {
+		return nil, nil
+	}
+	path, err := exec.LookPath(command[0])
+	if err != nil {
+		return nil, fmt.Errorf("command %w", err)
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return nil, fmt.Errorf("command %w", err)
+	}
+	c := &CommandNotifier{
+		path:        path,
+		args:        command[1:],
+		timeout:     configDuration(config, "command_timeout", 30*time.Second),
+		concurrency: 4,
+		queue:       make(chan *Notification, commandQueueSize),
+	}
+	if config.IsSet("command_concurrency") {
+		c.concurrency = config.GetInt("command_concurrency")
+		if c.concurrency < 1 {
+			return nil, fmt.Errorf("command_concurrency must be at least 1")
+		}
+	}
+	c.stats.Command = path
+	return c, nil
+}
+
+// Notify queues the LED, state and reference code notifications.
+func (c *CommandNotifier) Notify(ev *Notification) {
+	switch ev.Kind {
+	case notifyLEDOn, notifyLEDOff, notifyState, notifyRefCode:
+	default:
+		return
+	}
+	select {
+	case c.queue <- ev:
+	default:
+		c.mu.Lock()
+		c.stats.Dropped++
+		c.mu.Unlock()
+		log.Warnf("Command queue full, %s of %s dropped", ev.Kind, ev.System)
+	}
+}
+
+func (c *CommandNotifier) Stats() interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	return &stats
+}
+
+// Run starts the program for the queued notifications until ctx is done, which kills
+// the running ones.
+func (c *CommandNotifier) Run(ctx context.Context, wg *sync.WaitGroup) {
+
+	defer wg.Done()
+
+	log.Infof("Command %s on system changes, at most %d at a time", c.path, c.concurrency)
+
+	var running sync.WaitGroup
+	defer running.Wait()
+	slots := make(chan struct{}, c.concurrency)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-c.queue:
+			select {
+			case <-ctx.Done():
+				return
+			case slots <- struct{}{}:
+			}
+			running.Add(1)
+			go func() {
+				defer running.Done()
+				defer func() { <-slots }()
+				c.run(ctx, ev)
+			}()
+		}
+	}
+}
+
+// run executes the program for ev and logs its output.
+func (c *CommandNotifier) run(ctx context.Context, ev *Notification) {
+
+	input, err := json.Marshal(ev)
+	if err != nil {
+		c.failed(fmt.Errorf("%s %w", ev.Kind, err), false)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, c.path, c.args...)
+	cmd.Env = commandEnv(ev)
+	cmd.Dir = "/"
+	cmd.Stdin = bytes.NewReader(input)
+	stdout := &limitedBuffer{limit: commandOutputLimit}
+	stderr := &limitedBuffer{limit: commandOutputLimit}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	// a child left holding stdout must not hold up the notifier
+	cmd.WaitDelay = 5 * time.Second
+
+	c.mu.Lock()
+	c.stats.Running++
+	c.stats.Runs++
+	c.mu.Unlock()
+
+	start := time.Now()
+	err = cmd.Run()
+
+	c.mu.Lock()
+	c.stats.Running--
+	c.mu.Unlock()
+
+	fields := log.Fields{"command": c.path, "event": ev.Kind, "system": ev.System, "duration_ms": time.Since(start).Milliseconds()}
+	logOutput(fields, "stdout", stdout, log.InfoLevel)
+	logOutput(fields, "stderr", stderr, log.WarnLevel)
+
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		c.failed(fmt.Errorf("%s of %s timed out after %s", ev.Kind, ev.System, c.timeout), true)
+	case err != nil:
+		c.failed(fmt.Errorf("%s of %s %w", ev.Kind, ev.System, err), false)
+	default:
+		log.WithFields(fields).Debugf("Command finished")
+	}
+}
+
+func (c *CommandNotifier) failed(err error, timedOut bool) {
+	log.Errorf("Command %s: %s", c.path, err)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Failures++
+	if timedOut {
+		c.stats.TimedOut++
+	}
+	c.stats.LastError = err.Error()
+}
+
+// commandEnv is the environment of the program: PATH and the notification. The values
+// are passed as they are, NUL bytes removed, the program must quote them itself.
+func commandEnv(ev *Notification) []string {
+
+	vars := [][2]string{
+		{"PATH", os.Getenv("PATH")},
+		{"HMC_LED_EVENT", ev.Kind},
+		{"HMC_LED_TIME", ev.Time.Format(time.RFC3339)},
+		{"HMC_LED_MESSAGE", ev.Message},
+		{"HMC_LED_HMC", ev.HMC},
+		{"HMC_LED_SYSTEM", ev.System},
+		{"HMC_LED_UUID", ev.UUID},
+		{"HMC_LED_MTMS", ev.MTMS},
+		{"HMC_LED_REFCODE", ev.RefCode},
+		{"HMC_LED_LOCATION", ev.Location},
+		{"HMC_LED_OLD", ev.Old},
+		{"HMC_LED_NEW", ev.New},
+	}
+	if ev.Mgms != nil {
+		vars = append(vars,
+			[2]string{"HMC_LED_LED", strconv.FormatBool(ev.Mgms.LED)},
+			[2]string{"HMC_LED_STATE", ev.Mgms.State},
+		)
+	}
+	env := make([]string, 0, len(vars))
+	for _, v := range vars {
+		env = append(env, v[0]+"="+strings.ReplaceAll(v[1], "\x00", ""))
+	}
+	return env
+}
+
+// logOutput logs the lines the program wrote to one of its outputs.
+func logOutput(fields log.Fields, name string, out *limitedBuffer, level log.Level) {
+
+	scanner := bufio.NewScanner(bytes.NewReader(out.buf.Bytes()))
+	scanner.Buffer(make([]byte, 0, 4096), commandOutputLimit)
+	for scanner.Scan() {
+		log.WithFields(fields).Logf(level, "Command %s: %s", name, scanner.Text())
+	}
+	if out.truncated {
+		log.WithFields(fields).Logf(level, "Command %s: output truncated at %d bytes", name, out.limit)
+	}
+}
+
+// limitedBuffer keeps the first limit bytes written to it.
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); len(p) > room {
+		b.buf.Write(p[:max(room, 0)])
+		b.truncated = true
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
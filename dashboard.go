@@ -0,0 +1,22 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Dashboard static files, served at /ui/. No external resources are referenced.
+//
+//go:embed ui
+var uiFiles embed.FS
+
+func uiHandler() http.Handler {
+	sub, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		log.Fatalf("Dashboard files: %s", err)
+	}
+	return http.StripPrefix("/ui/", http.FileServer(http.FS(sub)))
+}
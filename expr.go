@@ -0,0 +1,479 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The alert rule expressions: comparisons (==, !=, <, <=, >, >=, =~ and !~ for regular
+// expressions) of system fields, string, number and boolean literals, combined with
+// &&, ||, ! (or and, or, not) and parentheses. Numbers may carry a duration unit s, m, h
+// or d and are seconds then. Field and function names ignore case and underscores.
+// Expressions are type checked when they are compiled, so a rule which compiles can not
+// fail on a system.
+
+type exprType int
+
+const (
+	exprString exprType = iota
+	exprNumber
+	exprBool
+)
+
+func (t exprType) String() string {
+	return [...]string{"string", "number", "bool"}[t]
+}
+
+// exprEnv is what an expression is evaluated against.
+type exprEnv struct {
+	system *QuickMgms
+	now    time.Time
+}
+
+type exprNode struct {
+	typ  exprType
+	eval func(env *exprEnv) interface{}
+}
+
+type exprField struct {
+	typ   exprType
+	value func(env *exprEnv) interface{}
+}
+
+// exprFields are the QuickMgms fields and the derived ones, by normalized name.
+var exprFields = map[string]exprField{
+	"uuid":          {exprString, func(env *exprEnv) interface{} { return env.system.UUID }},
+	"hmc":           {exprString, func(env *exprEnv) interface{} { return env.system.HMC }},
+	"mtms":          {exprString, func(env *exprEnv) interface{} { return env.system.MTMS }},
+	"sysname":       {exprString, func(env *exprEnv) interface{} { return env.system.SysName }},
+	"systemname":    {exprString, func(env *exprEnv) interface{} { return env.system.SysName }},
+	"name":          {exprString, func(env *exprEnv) interface{} { return env.system.SysName }},
+	"state":         {exprString, func(env *exprEnv) interface{} { return env.system.State }},
+	"led":           {exprBool, func(env *exprEnv) interface{} { return env.system.LED }},
+	"refcode":       {exprString, func(env *exprEnv) interface{} { return env.system.RefCode }},
+	"rfc":           {exprString, func(env *exprEnv) interface{} { return env.system.RefCode }},
+	"mergedrefcode": {exprString, func(env *exprEnv) interface{} { return env.system.MergedRefCode }},
+	"mrfc":          {exprString, func(env *exprEnv) interface{} { return env.system.MergedRefCode }},
+	"location":      {exprString, func(env *exprEnv) interface{} { return env.system.Location }},
+	"elapsed":       {exprNumber, func(env *exprEnv) interface{} { return float64(env.system.Elapsed) }},
+	"openevents":    {exprNumber, func(env *exprEnv) interface{} { return float64(env.system.OpenEvents) }},
+	// derived
+	"machinetype": {exprString, func(env *exprEnv) interface{} { t, _, _ := splitMTMS(env.system.MTMS); return t }},
+	"model":       {exprString, func(env *exprEnv) interface{} { _, m, _ := splitMTMS(env.system.MTMS); return m }},
+	"serial":      {exprString, func(env *exprEnv) interface{} { _, _, s := splitMTMS(env.system.MTMS); return s }},
+	"flapping":    {exprBool, func(env *exprEnv) interface{} { return env.system.Flapping }},
+	"managedby":   {exprNumber, func(env *exprEnv) interface{} { return float64(len(env.system.ManagedBy)) }},
+	"sincechange": {exprNumber, func(env *exprEnv) interface{} {
+		if env.system.LastChange.IsZero() {
+			return float64(0)
+		}
+		return env.now.Sub(env.system.LastChange).Seconds()
+	}},
+}
+
+// splitMTMS splits TTTT-MMM-SSSSSSS, as parseQuickMgms stores it, into machine type, model
+// and serial number. The HMC form TTTT-MMM*SSSSSSS is split too.
+func splitMTMS(mtms string) (string, string, string) {
+	parts := strings.SplitN(mtms, "-", 3)
+	if len(parts) == 3 {
+		return parts[0], parts[1], parts[2]
+	}
+	typ, ms, _ := strings.Cut(mtms, "-")
+	model, serial, _ := strings.Cut(ms, "*")
+	return typ, model, serial
+}
+
+type exprFunc struct {
+	args []exprType
+	typ  exprType
+	call func(args []interface{}) interface{}
+}
+
+var exprFuncs = map[string]exprFunc{
+	"startswith": {[]exprType{exprString, exprString}, exprBool, func(a []interface{}) interface{} {
+		return strings.HasPrefix(a[0].(string), a[1].(string))
+	}},
+	"endswith": {[]exprType{exprString, exprString}, exprBool, func(a []interface{}) interface{} {
+		return strings.HasSuffix(a[0].(string), a[1].(string))
+	}},
+	"contains": {[]exprType{exprString, exprString}, exprBool, func(a []interface{}) interface{} {
+		return strings.Contains(a[0].(string), a[1].(string))
+	}},
+	"lower": {[]exprType{exprString}, exprString, func(a []interface{}) interface{} {
+		return strings.ToLower(a[0].(string))
+	}},
+	"upper": {[]exprType{exprString}, exprString, func(a []interface{}) interface{} {
+		return strings.ToUpper(a[0].(string))
+	}},
+	"len": {[]exprType{exprString}, exprNumber, func(a []interface{}) interface{} {
+		return float64(len(a[0].(string)))
+	}},
+}
+
+func exprName(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, "_", ""))
+}
+
+// compileExpr parses and type checks a boolean expression.
+func compileExpr(src string) (*exprNode, error) {
+
+	p := &exprParser{src: src}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %q", p.tok.text)
+	}
+	if node.typ != exprBool {
+		return nil, fmt.Errorf("expression is a %s, not a condition", node.typ)
+	}
+	return node, nil
+}
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokKind
+	text string
+	num  float64
+	pos  int
+}
+
+type exprParser struct {
+	src string
+	pos int
+	tok token
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("at %d: %s", p.tok.pos+1, fmt.Sprintf(format, args...))
+}
+
+var exprOps = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!~", "<", ">", "!", "(", ")", ","}
+
+var durationUnits = map[byte]float64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400}
+
+// next reads the next token.
+func (p *exprParser) next() error {
+
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+	start := p.pos
+	p.tok = token{pos: start}
+	if p.pos >= len(p.src) {
+		p.tok.kind = tokEOF
+		return nil
+	}
+	c := p.src[p.pos]
+	switch {
+	case c == '"' || c == '\'':
+		var b strings.Builder
+		for p.pos++; p.pos < len(p.src) && p.src[p.pos] != c; p.pos++ {
+			if p.src[p.pos] == '\\' && p.pos+1 < len(p.src) {
+				p.pos++
+			}
+			b.WriteByte(p.src[p.pos])
+		}
+		if p.pos >= len(p.src) {
+			return p.errorf("unterminated string")
+		}
+		p.pos++
+		p.tok.kind, p.tok.text = tokString, b.String()
+	case c >= '0' && c <= '9' || c == '.':
+		for p.pos < len(p.src) && (p.src[p.pos] >= '0' && p.src[p.pos] <= '9' || p.src[p.pos] == '.') {
+			p.pos++
+		}
+		num, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return p.errorf("bad number %q", p.src[start:p.pos])
+		}
+		if p.pos < len(p.src) {
+			if unit, exists := durationUnits[p.src[p.pos]]; exists {
+				num *= unit
+				p.pos++
+			}
+		}
+		p.tok.kind, p.tok.text, p.tok.num = tokNumber, p.src[start:p.pos], num
+	case c == '_' || unicode.IsLetter(rune(c)):
+		for p.pos < len(p.src) && (p.src[p.pos] == '_' || unicode.IsLetter(rune(p.src[p.pos])) || unicode.IsDigit(rune(p.src[p.pos]))) {
+			p.pos++
+		}
+		p.tok.kind, p.tok.text = tokIdent, p.src[start:p.pos]
+	default:
+		for _, op := range exprOps {
+			if strings.HasPrefix(p.src[p.pos:], op) {
+				p.pos += len(op)
+				p.tok.kind, p.tok.text = tokOp, op
+				return nil
+			}
+		}
+		return p.errorf("unexpected character %q", c)
+	}
+	return nil
+}
+
+// isOp is true when the current token is one of ops, the keywords and, or and not included.
+func (p *exprParser) isOp(ops ...string) bool {
+	for _, op := range ops {
+		if p.tok.kind == tokOp && p.tok.text == op {
+			return true
+		}
+		if p.tok.kind == tokIdent && strings.ToLower(p.tok.text) == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *exprParser) parseOr() (*exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||", "or") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if left.typ != exprBool || right.typ != exprBool {
+			return nil, p.errorf("|| needs conditions")
+		}
+		l, r := left.eval, right.eval
+		left = &exprNode{exprBool, func(env *exprEnv) interface{} { return l(env).(bool) || r(env).(bool) }}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (*exprNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&", "and") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		if left.typ != exprBool || right.typ != exprBool {
+			return nil, p.errorf("&& needs conditions")
+		}
+		l, r := left.eval, right.eval
+		left = &exprNode{exprBool, func(env *exprEnv) interface{} { return l(env).(bool) && r(env).(bool) }}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseNot() (*exprNode, error) {
+	if !p.isOp("!", "not") {
+		return p.parseComparison()
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	operand, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	if operand.typ != exprBool {
+		return nil, p.errorf("! needs a condition")
+	}
+	e := operand.eval
+	return &exprNode{exprBool, func(env *exprEnv) interface{} { return !e(env).(bool) }}, nil
+}
+
+func (p *exprParser) parseComparison() (*exprNode, error) {
+
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if !p.isOp("==", "!=", "<", "<=", ">", ">=", "=~", "!~") {
+		return left, nil
+	}
+	op := p.tok.text
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	if op == "=~" || op == "!~" {
+		if left.typ != exprString || p.tok.kind != tokString {
+			return nil, p.errorf("%s needs a string and a regular expression in quotes", op)
+		}
+		re, err := regexp.Compile(p.tok.text)
+		if err != nil {
+			return nil, p.errorf("%s", err)
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		l, negate := left.eval, op == "!~"
+		return &exprNode{exprBool, func(env *exprEnv) interface{} { return re.MatchString(l(env).(string)) != negate }}, nil
+	}
+
+	right, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if left.typ != right.typ {
+		return nil, p.errorf("can not compare %s with %s", left.typ, right.typ)
+	}
+	if left.typ == exprBool && op != "==" && op != "!=" {
+		return nil, p.errorf("conditions are only compared with == and !=")
+	}
+	l, r := left.eval, right.eval
+	return &exprNode{exprBool, func(env *exprEnv) interface{} {
+		a, b := l(env), r(env)
+		switch op {
+		case "==":
+			return a == b
+		case "!=":
+			return a != b
+		}
+		var c int
+		if left.typ == exprNumber {
+			c = compareNumbers(a.(float64), b.(float64))
+		} else {
+			c = strings.Compare(a.(string), b.(string))
+		}
+		switch op {
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		default:
+			return c >= 0
+		}
+	}}, nil
+}
+
+func compareNumbers(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func (p *exprParser) parsePrimary() (*exprNode, error) {
+
+	tok := p.tok
+	switch tok.kind {
+	case tokString:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		return &exprNode{exprString, func(*exprEnv) interface{} { return tok.text }}, nil
+	case tokNumber:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		return &exprNode{exprNumber, func(*exprEnv) interface{} { return tok.num }}, nil
+	case tokOp:
+		if tok.text != "(" {
+			return nil, p.errorf("unexpected %q", tok.text)
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.isOp(")") {
+			return nil, p.errorf("missing )")
+		}
+		return node, p.next()
+	case tokIdent:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		name := exprName(tok.text)
+		switch name {
+		case "true", "false":
+			value := name == "true"
+			return &exprNode{exprBool, func(*exprEnv) interface{} { return value }}, nil
+		}
+		if p.isOp("(") {
+			return p.parseCall(tok, name)
+		}
+		field, exists := exprFields[name]
+		if !exists {
+			return nil, fmt.Errorf("at %d: unknown field %s", tok.pos+1, tok.text)
+		}
+		return &exprNode{field.typ, field.value}, nil
+	default:
+		return nil, p.errorf("unexpected end of expression")
+	}
+}
+
+func (p *exprParser) parseCall(tok token, name string) (*exprNode, error) {
+
+	fn, exists := exprFuncs[name]
+	if !exists {
+		return nil, fmt.Errorf("at %d: unknown function %s", tok.pos+1, tok.text)
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	args := []*exprNode{}
+	for !p.isOp(")") {
+		if len(args) > 0 {
+			if !p.isOp(",") {
+				return nil, p.errorf("missing , or )")
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if len(args) != len(fn.args) {
+		return nil, fmt.Errorf("at %d: %s takes %d arguments", tok.pos+1, tok.text, len(fn.args))
+	}
+	for i, arg := range args {
+		if arg.typ != fn.args[i] {
+			return nil, fmt.Errorf("at %d: argument %d of %s is a %s, not a %s", tok.pos+1, i+1, tok.text, arg.typ, fn.args[i])
+		}
+	}
+	return &exprNode{fn.typ, func(env *exprEnv) interface{} {
+		values := make([]interface{}, len(args))
+		for i, arg := range args {
+			values[i] = arg.eval(env)
+		}
+		return fn.call(values)
+	}}, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompileExpr(t *testing.T) {
+
+	now := time.Now()
+	system := &QuickMgms{
+		UUID:       "uuid-1",
+		HMC:        "HMC1",
+		MTMS:       "9080-HEX-7812345",
+		SysName:    "P10-prod",
+		State:      "operating",
+		LED:        true,
+		RefCode:    "B7001234",
+		Location:   "DC1",
+		OpenEvents: 2,
+		LastChange: now.Add(-15 * time.Minute),
+	}
+	env := &exprEnv{system: system, now: now}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		// fields, literals and comparisons
+		{`LED`, true},
+		{`led == true`, true},
+		{`State == "operating"`, true},
+		{`state != 'operating'`, false},
+		{`open_events >= 2`, true},
+		{`OpenEvents > 2`, false},
+		{`refcode < "B8"`, true},
+		{`machine_type == "9080" && model == "HEX" && serial == "7812345"`, true},
+		// precedence: ! binds tighter than &&, && tighter than ||
+		{`false && false || true`, true},
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		{`!LED || State == "operating"`, true},
+		{`!(LED && State == "operating")`, false},
+		{`!!LED`, true},
+		// keywords, any case
+		{`LED and state == "operating"`, true},
+		{`not LED or false`, false},
+		{`NOT led OR State == "operating"`, true},
+		{`LED AND NOT false`, true},
+		// durations are seconds
+		{`since_change >= 10m`, true},
+		{`since_change >= 1h`, false},
+		{`since_change < 1d`, true},
+		{`900s == 15m`, true},
+		{`2h == 7200`, true},
+		// regular expressions
+		{`SysName =~ "^P10-"`, true},
+		{`SysName =~ "(?i)^p10"`, true},
+		{`SysName !~ "test"`, true},
+		{`RefCode =~ "^B1"`, false},
+		// functions
+		{`startsWith(RefCode, "B7")`, true},
+		{`endsWith(name, "prod") && contains(hmc, "MC")`, true},
+		{`lower(State) == "operating" && upper(location) == "DC1"`, true},
+		{`len(RefCode) == 8`, true},
+	}
+	for _, test := range tests {
+		node, err := compileExpr(test.expr)
+		if err != nil {
+			t.Errorf("%s: %s", test.expr, err)
+			continue
+		}
+		if got := node.eval(env).(bool); got != test.want {
+			t.Errorf("%s = %t, want %t", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestCompileExprErrors(t *testing.T) {
+
+	tests := []struct {
+		expr string
+		want string // part of the error
+	}{
+		{`State`, "is a string, not a condition"},
+		{`open_events + 1`, "unexpected character"},
+		{`State == 1`, "can not compare string with number"},
+		{`LED == "on"`, "can not compare bool with string"},
+		{`LED < true`, "only compared with == and !="},
+		{`State && LED`, "&& needs conditions"},
+		{`LED || RefCode`, "|| needs conditions"},
+		{`!State`, "! needs a condition"},
+		{`open_events =~ "1"`, "needs a string and a regular expression in quotes"},
+		{`State =~ Location`, "needs a string and a regular expression in quotes"},
+		{`State =~ "("`, "error parsing regexp"},
+		{`nosuchfield == 1`, "unknown field nosuchfield"},
+		{`nosuch(State)`, "unknown function nosuch"},
+		{`startsWith(State)`, "takes 2 arguments"},
+		{`len(open_events) > 1`, "argument 1 of len is a number, not a string"},
+		{`(LED`, "missing )"},
+		{`LED)`, `unexpected ")"`},
+		{`State == "operating`, "unterminated string"},
+		{`LED &&`, "unexpected end of expression"},
+		{`1.2.3 == 1`, "bad number"},
+	}
+	for _, test := range tests {
+		_, err := compileExpr(test.expr)
+		if err == nil {
+			t.Errorf("%s: no error, want %q", test.expr, test.want)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error %q, want %q", test.expr, err, test.want)
+		}
+	}
+}
+
+func TestSplitMTMS(t *testing.T) {
+	for _, mtms := range []string{"9080-HEX-7812345", "9080-HEX*7812345"} {
+		typ, model, serial := splitMTMS(mtms)
+		if typ != "9080" || model != "HEX" || serial != "7812345" {
+			t.Errorf("%s: %q %q %q", mtms, typ, model, serial)
+		}
+	}
+}
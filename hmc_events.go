@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// HMCEvent is one entry of the /rest/api/uom/Event feed.
+type HMCEvent struct {
+	ID     string `xml:"content>Event>EventID"`
+	Type   string `xml:"content>Event>EventType"`
+	Data   string `xml:"content>Event>EventData"`
+	Detail string `xml:"content>Event>EventDetail"`
+}
+
+type hmcEventFeed struct {
+	Entries []HMCEvent `xml:"entry"`
+}
+
+var managedSystemURI = regexp.MustCompile(`/ManagedSystem/([^/?]+)/?$`)
+
+// EventListener keeps the managed system cache current. It long-polls the HMC event feed
+// and refreshes only the systems reported as changed. When the feed is unavailable it polls
+// all systems periodically and tries the feed again later.
+type EventListener struct {
+	hmc          *HMC
+	useFeed      bool
+	pollInterval time.Duration
+	retryFeed    time.Duration
+}
+
+func NewEventListener(config *viper.Viper, hmc *HMC) *EventListener {
+	return &EventListener{
+		hmc:          hmc,
+		useFeed:      strings.ToLower(config.GetString("hmc_event_feed")) != "no",
+		pollInterval: configDuration(config, "hmc_poll_interval", time.Minute),
+		retryFeed:    configDuration(config, "hmc_event_retry_interval", 5*time.Minute),
+	}
+}
+
+// Run listens until ctx is cancelled.
+func (l *EventListener) Run(ctx context.Context, wg *sync.WaitGroup) {
+
+	defer wg.Done()
+
+	hmc := l.hmc
+	log.Infof("HMC %s event listener started", hmc.hmcName)
+
+	for ctx.Err() == nil {
+		if l.useFeed {
+			err := l.listenFeed(ctx)
+			if ctx.Err() != nil {
+				break
+			}
+			log.Warnf("HMC %s event feed unavailable, polling every %s. %s", hmc.hmcName, l.pollInterval, err)
+		}
+		l.poll(ctx)
+	}
+	hmc.setFeedActive(false)
+	log.Infof("HMC %s event listener stopped", hmc.hmcName)
+}
+
+// poll refreshes all systems every pollInterval, until it is time to retry the event feed.
+func (l *EventListener) poll(ctx context.Context) {
+
+	retry := time.NewTimer(l.retryFeed)
+	defer retry.Stop()
+	ticker := time.NewTicker(l.pollInterval)
+	defer ticker.Stop()
+
+	l.refreshAll(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-retry.C:
+			if l.useFeed {
+				return
+			}
+		case <-ticker.C:
+			l.refreshAll(ctx)
+		}
+	}
+}
+
+// listenFeed returns when the event feed fails.
+func (l *EventListener) listenFeed(ctx context.Context) error {
+
+	hmc := l.hmc
+	lastToken := ""
+
+	for ctx.Err() == nil {
+		// Events are queued per session. After a re-logon whatever happened in between is
+		// lost, so everything is refreshed, same as for a CACHE_CLEARED event.
+		if token := hmc.sessionToken(); token != lastToken {
+			if lastToken != "" {
+				log.Infof("HMC %s session changed, event feed reset", hmc.hmcName)
+			}
+			l.refreshAll(ctx)
+			lastToken = hmc.sessionToken()
+		}
+
+		start := time.Now()
+		events, err := hmc.GetEvents(ctx)
+		if err != nil {
+			hmc.setFeedActive(false)
+			return err
+		}
+		hmc.setFeedActive(true)
+		l.handleEvents(ctx, events)
+
+		if len(events) == 0 && time.Since(start) < time.Second {
+			// the HMC did not hold the request, do not spin
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+func (l *EventListener) handleEvents(ctx context.Context, events []HMCEvent) {
+
+	hmc := l.hmc
+	refresh := map[string]bool{}
+
+	for _, ev := range events {
+		log.Debugf("HMC %s event %s %s %s", hmc.hmcName, ev.ID, ev.Type, ev.Data)
+
+		switch ev.Type {
+		case "CACHE_CLEARED":
+			l.refreshAll(ctx)
+			return
+		case "ADD_URI", "DELETE_URI", "MODIFY_URI", "INVALID_URI":
+			for _, uri := range strings.Split(ev.Data, ",") {
+				if strings.Contains(uri, "/ServiceableEvent") {
+					hmc.InvalidateServiceableEvents()
+					continue
+				}
+				m := managedSystemURI.FindStringSubmatch(strings.TrimSpace(uri))
+				if m == nil {
+					continue
+				}
+				if ev.Type == "MODIFY_URI" {
+					refresh[m[1]] = true
+				} else {
+					// system added or removed
+					hmc.InvalidateManagementConsole()
+					hmc.InvalidateMgmsQuick(m[1])
+					refresh[""] = true
+				}
+			}
+		}
+	}
+	if len(refresh) == 0 {
+		return
+	}
+	if refresh[""] {
+		l.refreshAll(ctx)
+		return
+	}
+	for uuid := range refresh {
+		if _, err := hmc.RefreshMgmsQuick(ctx, uuid); err != nil {
+			log.Errorf("HMC %s event refresh %s: %s", hmc.hmcName, uuid, err)
+			hmc.InvalidateMgmsQuick(uuid)
+		}
+	}
+	hmc.notifyUpdate()
+}
+
+// refreshAll retrieves the quick data of every managed system.
+func (l *EventListener) refreshAll(ctx context.Context) {
+
+	hmc := l.hmc
+
+	mgmConsole, err := hmc.GetManagementConsoleData(ctx)
+	if err != nil {
+		log.Errorf("HMC %s refresh: %s", hmc.hmcName, err)
+		return
+	}
+	for _, elem := range mgmConsole.Links {
+		a := strings.Split(elem.Href, "/")
+		uuid := a[len(a)-1]
+		if _, err := hmc.RefreshMgmsQuick(ctx, uuid); err != nil {
+			log.Errorf("HMC %s refresh %s: %s", hmc.hmcName, uuid, err)
+			hmc.InvalidateMgmsQuick(uuid)
+		}
+	}
+	hmc.notifyUpdate()
+}
+
+// GetEvents long-polls the HMC event feed. No events within the HMC wait time is not an error.
+func (hmc *HMC) GetEvents(ctx context.Context) ([]HMCEvent, error) {
+
+	hmc.stats.event_requests.Add(1)
+
+	eventURL := hmc.apiURL("/rest/api/uom/Event")
+	data, err := hmc.GetInfoByUrl(ctx, eventURL, map[string]string{})
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return []HMCEvent{}, nil
+	}
+	feed := &hmcEventFeed{}
+	if err := xml.Unmarshal(data, feed); err != nil {
+		return nil, fmt.Errorf("GetEvents %w", err)
+	}
+	return feed.Entries, nil
+}
+
+func (hmc *HMC) sessionToken() string {
+	hmc.logon.mu.Lock()
+	defer hmc.logon.mu.Unlock()
+	return hmc.logon.token
+}
+
+func (hmc *HMC) setFeedActive(active bool) {
+	hmc.quick.mu.Lock()
+	hmc.quick.feedActive = active
+	hmc.quick.mu.Unlock()
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// errHMCUnavailable marks connection and logon failures, the ones another address of the HMC may not have.
+var errHMCUnavailable = errors.New("HMC unavailable")
+
+// hmcEndpoint is one address of the logical HMC, e.g. one HMC of a redundant pair managing the same frames.
+type hmcEndpoint struct {
+	address   string
+	baseURL   *url.URL
+	healthy   bool
+	since     time.Time // healthy or not since
+	lastCheck time.Time
+	lastErr   string
+}
+
+// HMC_endpoints are the ordered HMC addresses, the first healthy one is preferred.
+type HMC_endpoints struct {
+	mu            sync.Mutex
+	list          []*hmcEndpoint
+	active        int
+	failovers     int64
+	checkInterval time.Duration
+	failback      bool
+	failbackAfter time.Duration
+}
+
+// EndpointStatus is an HMC address in /status.
+type EndpointStatus struct {
+	Address   string `json:"address" yaml:"address" xml:"address"`
+	Active    bool   `json:"active" yaml:"active" xml:"active"`
+	Healthy   bool   `json:"healthy" yaml:"healthy" xml:"healthy"`
+	LastCheck string `json:"last_check,omitempty" yaml:"last_check,omitempty" xml:"last_check,omitempty"`
+	LastError string `json:"last_error,omitempty" yaml:"last_error,omitempty" xml:"last_error,omitempty"`
+}
+
+type EndpointStats struct {
+	Active    string            `json:"active" yaml:"active" xml:"active"`
+	Failovers int64             `json:"failovers" yaml:"failovers" xml:"failovers"`
+	Endpoints []*EndpointStatus `json:"endpoints" yaml:"endpoints" xml:"endpoint"`
+}
+
+// hmcAddresses returns hmc_addresses, in order of preference, or hmc_hostname.
+func hmcAddresses(config *viper.Viper) []string {
+	addresses := []string{}
+	for _, a := range config.GetStringSlice("hmc_addresses") {
+		if a = strings.TrimSpace(a); a != "" {
+			addresses = append(addresses, a)
+		}
+	}
+	if len(addresses) == 0 {
+		addresses = append(addresses, config.GetString("hmc_hostname"))
+	}
+	return addresses
+}
+
+func newHMCEndpoints(config *viper.Viper) (*HMC_endpoints, error) {
+
+	e := &HMC_endpoints{
+		checkInterval: configDuration(config, "hmc_health_interval", 30*time.Second),
+		failback:      strings.ToLower(config.GetString("hmc_failback")) != "no",
+		failbackAfter: configDuration(config, "hmc_failback_after", 2*time.Minute),
+	}
+	for _, address := range hmcAddresses(config) {
+		baseURL, err := hmcBaseURL(config, address)
+		if err != nil {
+			return nil, err
+		}
+		// healthy until proven otherwise
+		e.list = append(e.list, &hmcEndpoint{address: address, baseURL: baseURL, healthy: true, since: time.Now()})
+	}
+	if len(e.list) > 1 {
+		log.Infof("HMC addresses in order of preference: %s", strings.Join(hmcAddresses(config), ", "))
+	}
+	return e, nil
+}
+
+func (e *HMC_endpoints) current() *hmcEndpoint {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.list[e.active]
+}
+
+// rebase moves a URL built for any of the HMC addresses to ep.
+func (e *HMC_endpoints) rebase(url string, ep *hmcEndpoint) string {
+	for _, other := range e.list {
+		base := other.baseURL.String()
+		if other != ep && strings.HasPrefix(url, base) {
+			return ep.baseURL.String() + strings.TrimPrefix(url, base)
+		}
+	}
+	return url
+}
+
+// ActiveAddress is the address of the HMC serving requests now.
+func (hmc *HMC) ActiveAddress() string {
+	return hmc.endpoints.current().address
+}
+
+// SendByUrl is GetInfoByUrl for any method, with an optional request payload.
+// When the HMC is not reachable or refuses the logon, the request is repeated at the
+// next HMC address, which then serves all further requests.
+func (hmc *HMC) SendByUrl(ctx context.Context, method string, url string, payload []byte, headers map[string]string) ([]byte, error) {
+
+	ep := hmc.endpoints.current()
+	url = hmc.endpoints.rebase(url, ep)
+	tried := map[*hmcEndpoint]bool{}
+	for {
+		data, err := hmc.sendByUrl(ctx, method, url, payload, headers)
+		if err == nil {
+			if info := requestInfoFrom(ctx); info != nil {
+				info.hmcAddress = ep.address
+			}
+			return data, nil
+		}
+		if !errors.Is(err, errHMCUnavailable) || ctx.Err() != nil {
+			return data, err
+		}
+		tried[ep] = true
+		next := hmc.failover(ctx, ep, tried, err)
+		if next == nil {
+			return data, err
+		}
+		// the same request at the other address
+		url = hmc.endpoints.rebase(url, next)
+		ep = next
+	}
+}
+
+// failover switches from the failed endpoint to the first healthy untried one, or any untried
+// one if none is known healthy. It returns nil when there is nothing left to try.
+func (hmc *HMC) failover(ctx context.Context, failed *hmcEndpoint, tried map[*hmcEndpoint]bool, cause error) *hmcEndpoint {
+
+	e := hmc.endpoints
+	e.mu.Lock()
+
+	if failed.healthy {
+		failed.healthy = false
+		failed.since = time.Now()
+	}
+	failed.lastErr = cause.Error()
+
+	if cur := e.list[e.active]; cur != failed && !tried[cur] {
+		// somebody else failed over meanwhile
+		e.mu.Unlock()
+		return cur
+	}
+	next := -1
+	for i, ep := range e.list {
+		if tried[ep] {
+			continue
+		}
+		if ep.healthy {
+			next = i
+			break
+		}
+		if next < 0 {
+			next = i
+		}
+	}
+	if next < 0 {
+		e.mu.Unlock()
+		return nil
+	}
+	e.active = next
+	e.failovers++
+	ep := e.list[next]
+	e.mu.Unlock()
+
+	ctxLogger(ctx).Warnf("HMC %s failover from %s to %s: %s", hmc.hmcName, failed.address, ep.address, cause)
+	hmc.switchedEndpoint()
+	return ep
+}
+
+// switchedEndpoint forgets what belongs to the previous HMC, its session and console data.
+// Managed system UUIDs are the same on every HMC managing the frame.
+func (hmc *HMC) switchedEndpoint() {
+	hmc.logon.mu.Lock()
+	hmc.logon.connected = false
+	hmc.logon.token = ""
+	hmc.logon.mu.Unlock()
+	hmc.CloseIdleConnections()
+	hmc.InvalidateManagementConsole()
+	hmc.InvalidateServiceableEvents()
+}
+
+// WatchEndpoints checks every hmc_health_interval whether the HMC addresses answer, and
+// fails back to a preferred address healthy for hmc_failback_after.
+func (hmc *HMC) WatchEndpoints(ctx context.Context, wg *sync.WaitGroup) {
+
+	defer wg.Done()
+
+	e := hmc.endpoints
+	if len(e.list) < 2 {
+		return
+	}
+	ticker := time.NewTicker(e.checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, ep := range e.list {
+				hmc.checkEndpoint(ctx, ep)
+			}
+			hmc.failback(ctx)
+		}
+	}
+}
+
+// checkEndpoint asks for the logon resource without a session. Any HTTP answer means the HMC is up.
+func (hmc *HMC) checkEndpoint(ctx context.Context, ep *hmcEndpoint) {
+
+	reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	errText := ""
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, ep.baseURL.String()+"/rest/api/web/Logon", nil)
+	if err == nil {
+		var resp *http.Response
+		resp, err = hmc.client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 500 {
+				errText = "health check status: " + resp.Status
+			}
+		}
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		errText = err.Error()
+	}
+
+	e := hmc.endpoints
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ep.lastCheck = time.Now()
+	healthy := errText == ""
+	if healthy != ep.healthy {
+		ep.healthy = healthy
+		ep.since = time.Now()
+		if healthy {
+			log.Infof("HMC %s address %s is healthy again", hmc.hmcName, ep.address)
+		} else {
+			log.Warnf("HMC %s address %s health check: %s", hmc.hmcName, ep.address, errText)
+		}
+	}
+	ep.lastErr = errText
+}
+
+func (hmc *HMC) failback(ctx context.Context) {
+
+	e := hmc.endpoints
+	if !e.failback {
+		return
+	}
+	e.mu.Lock()
+	preferred := -1
+	for i := 0; i < e.active; i++ {
+		if ep := e.list[i]; ep.healthy && time.Since(ep.since) >= e.failbackAfter {
+			preferred = i
+			break
+		}
+	}
+	if preferred < 0 {
+		e.mu.Unlock()
+		return
+	}
+	from, to := e.list[e.active], e.list[preferred]
+	e.mu.Unlock()
+
+	log.Infof("HMC %s failback from %s to %s", hmc.hmcName, from.address, to.address)
+	reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := hmc.Logoff(reqCtx, true); err != nil {
+		log.Warnf("HMC Logoff: %s", err)
+	}
+
+	e.mu.Lock()
+	e.active = preferred
+	e.mu.Unlock()
+	hmc.switchedEndpoint()
+}
+
+// EndpointStats returns the HMC addresses and their health.
+func (hmc *HMC) EndpointStats() *EndpointStats {
+
+	e := hmc.endpoints
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	stats := &EndpointStats{
+		Active:    e.list[e.active].address,
+		Failovers: e.failovers,
+		Endpoints: []*EndpointStatus{},
+	}
+	for i, ep := range e.list {
+		status := &EndpointStatus{
+			Address:   ep.address,
+			Active:    i == e.active,
+			Healthy:   ep.healthy,
+			LastError: ep.lastErr,
+		}
+		if !ep.lastCheck.IsZero() {
+			status.LastCheck = ep.lastCheck.UTC().Format(time.RFC3339)
+		}
+		stats.Endpoints = append(stats.Endpoints, status)
+	}
+	return stats
+}
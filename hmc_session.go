@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SessionStats is the HMC session part of /status.
+type SessionStats struct {
+	Connected       bool   `json:"connected" yaml:"connected" xml:"connected"`
+	TokenAge        int64  `json:"token_age_seconds" yaml:"token_age_seconds" xml:"token_age_seconds"`
+	Idle            int64  `json:"idle_seconds" yaml:"idle_seconds" xml:"idle_seconds"`
+	Logons          int64  `json:"logons" yaml:"logons" xml:"logons"`
+	ForcedRelogons  int64  `json:"forced_relogons" yaml:"forced_relogons" xml:"forced_relogons"`
+	Renewals        int64  `json:"renewals" yaml:"renewals" xml:"renewals"`
+	Keepalives      int64  `json:"keepalives" yaml:"keepalives" xml:"keepalives"`
+	IdleLogoffs     int64  `json:"idle_logoffs" yaml:"idle_logoffs" xml:"idle_logoffs"`
+	KeepaliveAfter  string `json:"keepalive_after" yaml:"keepalive_after" xml:"keepalive_after"`
+	MaxAge          string `json:"max_age" yaml:"max_age" xml:"max_age"`
+	IdleLogoffAfter string `json:"idle_logoff_after" yaml:"idle_logoff_after" xml:"idle_logoff_after"`
+}
+
+// KeepSession looks after the HMC session in the background, so a stale token is not
+// discovered by a client request:
+//   - a session unused for hmc_session_keepalive is pinged, an expired one is renewed on the way,
+//   - a token older than hmc_session_max_age is replaced by a new logon,
+//   - a session unused for hmc_session_idle_logoff is logged off, the next request logs on again.
+//
+// A zero duration disables the respective action.
+func (hmc *HMC) KeepSession(ctx context.Context, wg *sync.WaitGroup) {
+
+	defer wg.Done()
+
+	l := hmc.logon
+	check := time.Minute
+	for _, d := range []time.Duration{l.keepalive, l.maxAge, l.idleLogoff} {
+		if d > 0 && d/2 < check {
+			check = d / 2
+		}
+	}
+	if check < time.Second {
+		check = time.Second
+	}
+	log.Infof("HMC session keepalive %s, max age %s, idle logoff %s", l.keepalive, l.maxAge, l.idleLogoff)
+
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			hmc.checkSession(ctx)
+		}
+	}
+}
+
+func (hmc *HMC) checkSession(ctx context.Context) {
+
+	myname := "checkSession"
+	l := hmc.logon
+
+	l.mu.Lock()
+	connected, token := l.connected, l.token
+	age, idle := time.Since(l.issued), time.Since(l.lastUsed)
+	l.mu.Unlock()
+	if !connected {
+		return
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	switch {
+	case l.idleLogoff > 0 && idle >= l.idleLogoff:
+		log.Infof("%s. HMC session idle for %s, logging off", myname, idle.Round(time.Second))
+		hmc.stats.idle_logoffs.Add(1)
+		if err := hmc.Logoff(reqCtx, true); err != nil {
+			log.Warnf("%s. %s", myname, err)
+		}
+	case l.maxAge > 0 && age >= l.maxAge:
+		log.Infof("%s. HMC session token is %s old, renewing", myname, age.Round(time.Second))
+		hmc.stats.session_renewals.Add(1)
+		if err := hmc.renewSession(reqCtx, token); err != nil {
+			log.Warnf("%s. %s", myname, err)
+		}
+	case l.keepalive > 0 && idle >= l.keepalive:
+		log.Debugf("%s. HMC session idle for %s, keepalive", myname, idle.Round(time.Second))
+		hmc.stats.keepalives.Add(1)
+		// any authenticated request will do, an expired session is logged on again by SendByUrl
+		if _, err := hmc.GetInfoByUrl(reqCtx, hmc.apiURL("/rest/api/uom/ManagementConsole"), map[string]string{}); err != nil {
+			log.Warnf("%s. keepalive %s", myname, err)
+		}
+	}
+}
+
+// renewSession replaces the session token, unless somebody already did.
+func (hmc *HMC) renewSession(ctx context.Context, token string) error {
+
+	hmc.logon.mu.Lock()
+	defer hmc.logon.mu.Unlock()
+
+	if hmc.logon.token != token {
+		return nil
+	}
+	_ = hmc.Logoff(ctx, false)
+	return hmc.Logon(ctx, false)
+}
+
+// SessionStats returns the HMC session state and counters.
+func (hmc *HMC) SessionStats() *SessionStats {
+
+	l := hmc.logon
+	stats := &SessionStats{
+		Logons:          hmc.stats.logons.Load(),
+		ForcedRelogons:  hmc.stats.forced_relogons.Load(),
+		Renewals:        hmc.stats.session_renewals.Load(),
+		Keepalives:      hmc.stats.keepalives.Load(),
+		IdleLogoffs:     hmc.stats.idle_logoffs.Load(),
+		KeepaliveAfter:  l.keepalive.String(),
+		MaxAge:          l.maxAge.String(),
+		IdleLogoffAfter: l.idleLogoff.String(),
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.connected {
+		stats.Connected = true
+		stats.TokenAge = int64(time.Since(l.issued).Seconds())
+		stats.Idle = int64(time.Since(l.lastUsed).Seconds())
+	}
+	return stats
+}
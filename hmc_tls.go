@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// newHMCTLSConfig builds the TLS client configuration of the HMC connection.
+//
+//   - hmc_ca_file: PEM bundle of CAs (or the self-signed HMC certificate) trusted instead of the system roots.
+//   - hmc_server_name: name the certificate is verified against and sent as SNI, for HMCs addressed by IP.
+//   - hmc_pin_sha256: SHA-256 fingerprints of a certificate or its public key (SPKI). With hmc_ca_file
+//     one of the verified chain must match, without it the HMC certificate itself must match and
+//     replaces chain verification.
+//   - tls_skip_verify: no verification at all, pins are still checked against the HMC certificate.
+func newHMCTLSConfig(config *viper.Viper) (*tls.Config, error) {
+
+	tlsConfig := &tls.Config{
+		ServerName: config.GetString("hmc_server_name"),
+	}
+
+	caFile := config.GetString("hmc_ca_file")
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("hmc_ca_file %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("hmc_ca_file %s: no PEM certificates found", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	pins := [][]byte{}
+	for _, s := range config.GetStringSlice("hmc_pin_sha256") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		pin, err := parsePin(s)
+		if err != nil {
+			return nil, fmt.Errorf("hmc_pin_sha256 %w", err)
+		}
+		pins = append(pins, pin)
+	}
+
+	switch {
+	case config.GetString("tls_skip_verify") == "yes":
+		if caFile != "" {
+			log.Warnf("tls_skip_verify is yes, hmc_ca_file %s is not used", caFile)
+		}
+		tlsConfig.InsecureSkipVerify = true // HMC appears not to have a genuine recognised CA certficate
+	case len(pins) > 0 && caFile == "":
+		// the pin is the trust anchor, typical for the self-signed HMC certificate
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	if len(pins) > 0 {
+		skipVerify := tlsConfig.InsecureSkipVerify
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if skipVerify {
+				// the rest of an unverified chain is whatever the peer sent, only the leaf
+				// proved to hold its key in the handshake
+				if len(cs.PeerCertificates) > 0 && matchPin(cs.PeerCertificates[0], pins) {
+					return nil
+				}
+				return fmt.Errorf("HMC certificate does not match hmc_pin_sha256")
+			}
+			for _, chain := range cs.VerifiedChains {
+				for _, cert := range chain {
+					if matchPin(cert, pins) {
+						return nil
+					}
+				}
+			}
+			return fmt.Errorf("HMC certificate chain does not match hmc_pin_sha256")
+		}
+	}
+	return tlsConfig, nil
+}
+
+// parsePin accepts a SHA-256 fingerprint as hex, with or without colons, or base64 (the HPKP notation).
+func parsePin(s string) ([]byte, error) {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "sha256/"), "sha256:")
+	if pin, err := hex.DecodeString(strings.ReplaceAll(s, ":", "")); err == nil && len(pin) == sha256.Size {
+		return pin, nil
+	}
+	if pin, err := base64.StdEncoding.DecodeString(s); err == nil && len(pin) == sha256.Size {
+		return pin, nil
+	}
+	return nil, fmt.Errorf("%q is not a SHA-256 fingerprint", s)
+}
+
+func matchPin(cert *x509.Certificate, pins [][]byte) bool {
+	certSum := sha256.Sum256(cert.Raw)
+	spkiSum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if string(pin) == string(certSum[:]) || string(pin) == string(spkiSum[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// fingerprint formats a SHA-256 sum the way hmc_pin_sha256 accepts it.
+func fingerprint(data []byte) string {
+	sum := sha256.Sum256(data)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// fetchCert connects to the HMC addresses without verification and writes their certificate chains
+// with fingerprints and PEM, so they can be reviewed and used for hmc_ca_file or hmc_pin_sha256.
+// The connection is direct, hmc_proxy is not used.
+func fetchCert(ctx context.Context, config *viper.Viper, w io.Writer) error {
+
+	myname := "fetchCert"
+	for _, address := range hmcAddresses(config) {
+		baseURL, err := hmcBaseURL(config, address)
+		if err != nil {
+			return fmt.Errorf("%s %w", myname, err)
+		}
+		if err := writeCertChain(ctx, baseURL.Host, config.GetString("hmc_server_name"), w); err != nil {
+			return fmt.Errorf("%s %w", myname, err)
+		}
+	}
+	return nil
+}
+
+func writeCertChain(ctx context.Context, addr string, serverName string, w io.Writer) error {
+
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: 10 * time.Second},
+		Config: &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true, // we are here to look at the certificate
+		},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	state := conn.(*tls.Conn).ConnectionState()
+	fmt.Fprintf(w, "# %s, %s\n", addr, tls.VersionName(state.Version))
+	for i, cert := range state.PeerCertificates {
+		fmt.Fprintf(w, "#\n# [%d] subject:   %s\n", i, cert.Subject)
+		fmt.Fprintf(w, "#     issuer:    %s\n", cert.Issuer)
+		fmt.Fprintf(w, "#     valid:     %s - %s\n", cert.NotBefore.UTC().Format(time.RFC3339), cert.NotAfter.UTC().Format(time.RFC3339))
+		if len(cert.DNSNames) > 0 || len(cert.IPAddresses) > 0 {
+			fmt.Fprintf(w, "#     names:     %s %v\n", strings.Join(cert.DNSNames, " "), cert.IPAddresses)
+		}
+		fmt.Fprintf(w, "#     cert sha256:   %s\n", fingerprint(cert.Raw))
+		fmt.Fprintf(w, "#     pubkey sha256: %s\n", fingerprint(cert.RawSubjectPublicKeyInfo))
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return nil
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"crypto/tls"
 	"encoding/xml"
 	"fmt"
 	"io"
@@ -10,8 +10,11 @@ import (
 	"time"
 
 	//"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"sync"
+	"sync/atomic"
 
 	//"os"
 	//"os/signal"
@@ -29,79 +32,131 @@ type HMC struct {
 	hmcName     string
 	hmcHostname string
 	hmcUuid     string
-	baseURL     string
+	endpoints   *HMC_endpoints
 	user        string
 	passwd      string
 	logon       *HMC_logon
 	stats       *HMC_stats
 	mgmc        *HMC_mgmc
+	quick       *HMC_quick
+	sevents     *HMC_sevents
+	pcm         *HMC_pcm
+	flight      *flightGroup
+	updates     chan struct{}
+	notify      *Notifications
+	// cached data failing to refresh is served up to staleMaxAge, with revalidate
+	// expired data is served at once and refreshed in the background
+	staleMaxAge time.Duration
+	revalidate  bool
 }
 type HMC_stats struct {
-	logon_requests      int64
-	url_requests        int64
-	mgmconsole_requests int64
-	quick_mgms_requests int64
+	logon_requests      atomic.Int64
+	url_requests        atomic.Int64
+	mgmconsole_requests atomic.Int64
+	quick_mgms_requests atomic.Int64
+	partition_requests  atomic.Int64
+	event_requests      atomic.Int64
+	sevent_requests     atomic.Int64
+	pcm_requests        atomic.Int64
+	coalesced_requests  atomic.Int64
+	stale_responses     atomic.Int64
+	logons              atomic.Int64
+	forced_relogons     atomic.Int64
+	session_renewals    atomic.Int64
+	keepalives          atomic.Int64
+	idle_logoffs        atomic.Int64
 }
 type HMC_logon struct {
-	connected bool
-	token     string
-	mu        sync.Mutex
+	connected  bool
+	token      string
+	issued     time.Time // token logon time
+	lastUsed   time.Time // last request with the token
+	keepalive  time.Duration
+	maxAge     time.Duration
+	idleLogoff time.Duration
+	failure    string // last logon error notified, repeats are not
+	mu         sync.Mutex
 }
 type HMC_mgmc struct {
+	mu         sync.Mutex
 	mgmConsole *ManagementConsole
+	fetched    time.Time
+	invalid    bool // invalidated, still good as stale data
 	NextUpdate time.Time
 	Interval   time.Duration
 }
 
+// HMC_quick caches ManagedSystem quick data. While the event feed is active entries stay
+// valid until an event invalidates them, otherwise for the polling interval.
+type HMC_quick struct {
+	mu           sync.Mutex
+	entries      map[string]*quickEntry
+	feedActive   bool
+	pollInterval time.Duration
+	maxAge       time.Duration
+}
+type quickEntry struct {
+	data    []byte
+	fetched time.Time
+	invalid bool // invalidated, still good as stale data
+}
+
 type ManagementConsole struct {
 	//XMLName   xml.Name `xml:"http://www.w3.org/2005/Atom feed"`
-	ID        string     `xml:"entry>id"`
-	HMCType   string     `xml:"entry>content>ManagementConsole>MachineTypeModelAndSerialNumber>MachineType"`
-	HMCMod    string     `xml:"entry>content>ManagementConsole>MachineTypeModelAndSerialNumber>Model"`
-	HMCSerial string     `xml:"entry>content>ManagementConsole>MachineTypeModelAndSerialNumber>SerialNumber"`
-	HMCName   string     `xml:"entry>content>ManagementConsole>ManagementConsoleName"`
-	Links     []SysLinks `xml:"entry>content>ManagementConsole>ManagedSystems>link"`
+	ID        string     `xml:"entry>id" json:"id" yaml:"id"`
+	HMCType   string     `xml:"entry>content>ManagementConsole>MachineTypeModelAndSerialNumber>MachineType" json:"machine_type" yaml:"machine_type"`
+	HMCMod    string     `xml:"entry>content>ManagementConsole>MachineTypeModelAndSerialNumber>Model" json:"model" yaml:"model"`
+	HMCSerial string     `xml:"entry>content>ManagementConsole>MachineTypeModelAndSerialNumber>SerialNumber" json:"serial_number" yaml:"serial_number"`
+	HMCName   string     `xml:"entry>content>ManagementConsole>ManagementConsoleName" json:"name" yaml:"name"`
+	Links     []SysLinks `xml:"entry>content>ManagementConsole>ManagedSystems>link" json:"managed_systems" yaml:"managed_systems"`
 }
 type SysLinks struct {
-	Href string `xml:"href,attr"`
+	Href string `xml:"href,attr" json:"href" yaml:"href"`
 }
 
-func NewHMC(config *viper.Viper) *HMC {
+func NewHMC(config *viper.Viper) (*HMC, error) {
 
 	hmc_logon := &HMC_logon{
-		connected: false,
-		token:     "",
+		connected:  false,
+		token:      "",
+		keepalive:  configDuration(config, "hmc_session_keepalive", 10*time.Minute),
+		maxAge:     configDuration(config, "hmc_session_max_age", 0),
+		idleLogoff: configDuration(config, "hmc_session_idle_logoff", 0),
 	}
-	hmc_stats := &HMC_stats{
-		logon_requests:      0,
-		url_requests:        0,
-		mgmconsole_requests: 0,
-		quick_mgms_requests: 0,
+	if err := checkIdleLogoff(config, hmc_logon.idleLogoff); err != nil {
+		return nil, err
 	}
+	hmc_stats := &HMC_stats{}
 
-	intervalS := config.GetString("hmc_mgms_retrieve_interval")
-	if intervalS == "" {
-		intervalS = "10m"
-	}
-	intervalD, err := time.ParseDuration(intervalS)
-	if err != nil {
-		log.Warnf("Error parsing hmc_mgms_retrieve_interval. Used 10m as a default value. err=%s", err)
-		intervalD = 10 * time.Minute
-	}
+	intervalD := configDuration(config, "hmc_mgms_retrieve_interval", 10*time.Minute)
 	hmc_mgmc := &HMC_mgmc{
 		mgmConsole: nil,
 		NextUpdate: time.Now(),
 		Interval:   intervalD,
 	}
 
-	tls_skip_verify := false
-	if config.GetString("tls_skip_verify") == "yes" {
-		tls_skip_verify = true
+	hmc_quick := &HMC_quick{
+		entries:      map[string]*quickEntry{},
+		feedActive:   false,
+		pollInterval: configDuration(config, "hmc_poll_interval", time.Minute),
+		maxAge:       configDuration(config, "hmc_quick_max_age", 10*time.Minute),
+	}
+
+	endpoints, err := newHMCEndpoints(config)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := hmcProxy(config)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newHMCTLSConfig(config)
+	if err != nil {
+		return nil, err
 	}
 	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: tls_skip_verify, // HMC appears not to have a genuine recognised CA certficate
-		},
+		Proxy:               proxy,
+		TLSClientConfig:     tlsConfig,
 		MaxIdleConns:        1,
 		MaxIdleConnsPerHost: 1,
 		IdleConnTimeout:     60 * time.Second,
@@ -114,15 +169,111 @@ func NewHMC(config *viper.Viper) *HMC {
 		},
 		hmcName:     config.GetString("hmc_name"),
 		hmcHostname: config.GetString("hmc_hostname"),
+		endpoints:   endpoints,
 		user:        config.GetString("hmc_user"),
 		passwd:      config.GetString("hmc_passwd"),
 		logon:       hmc_logon,
 		stats:       hmc_stats,
 		mgmc:        hmc_mgmc,
+		quick:       hmc_quick,
+		sevents: &HMC_sevents{
+			NextUpdate: time.Now(),
+			Interval:   configDuration(config, "hmc_sevents_interval", 5*time.Minute),
+		},
+		pcm: &HMC_pcm{
+			metrics:           map[string]*pcmEntry{},
+			Interval:          configDuration(config, "hmc_pcm_interval", 30*time.Second),
+			enableAggregation: strings.ToLower(config.GetString("hmc_pcm_enable_aggregation")) == "yes",
+		},
+		flight:      newFlightGroup(),
+		updates:     make(chan struct{}, 1),
+		staleMaxAge: configDuration(config, "hmc_stale_max_age", 30*time.Minute),
+		revalidate:  strings.ToLower(config.GetString("hmc_stale_while_revalidate")) == "yes",
 		//connected:   false,
 	}
 
-	return hmc
+	return hmc, nil
+}
+
+// checkIdleLogoff rejects an hmc_session_idle_logoff that can not take effect: the event feed
+// long-polls the HMC all the time, and polling more often than the idle time keeps the session
+// busy as well. Only a session left alone between polls can be logged off.
+func checkIdleLogoff(config *viper.Viper, idleLogoff time.Duration) error {
+	if idleLogoff <= 0 {
+		return nil
+	}
+	if strings.ToLower(config.GetString("hmc_event_feed")) != "no" {
+		return fmt.Errorf("hmc_session_idle_logoff requires hmc_event_feed \"no\", the event feed keeps the session in use")
+	}
+	if poll := configDuration(config, "hmc_poll_interval", time.Minute); idleLogoff >= poll {
+		return fmt.Errorf("hmc_session_idle_logoff %s must be shorter than hmc_poll_interval %s, polling keeps the session in use", idleLogoff, poll)
+	}
+	return nil
+}
+
+// hmcBaseURL is the root of the HMC REST API, https://host:12443 unless hmc_scheme,
+// hmc_port or hmc_base_path say otherwise, e.g. for an HMC behind a reverse proxy.
+// IPv6 literals may be given with or without brackets.
+func hmcBaseURL(config *viper.Viper, host string) (*url.URL, error) {
+
+	host = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(host), "["), "]")
+	if host == "" {
+		return nil, fmt.Errorf("HMC host name is empty")
+	}
+	scheme := strings.ToLower(config.GetString("hmc_scheme"))
+	if scheme == "" {
+		scheme = "https"
+	}
+	if scheme != "https" && scheme != "http" {
+		return nil, fmt.Errorf("hmc_scheme %q, expected https or http", scheme)
+	}
+	port := config.GetString("hmc_port")
+	if port == "" {
+		port = "12443"
+	}
+	return &url.URL{
+		Scheme: scheme,
+		Host:   net.JoinHostPort(host, port),
+		Path:   strings.TrimSuffix(config.GetString("hmc_base_path"), "/"),
+	}, nil
+}
+
+// hmcProxy selects the outbound proxy. Empty hmc_proxy takes HTTPS_PROXY, HTTP_PROXY and
+// NO_PROXY from the environment, "none" connects directly.
+func hmcProxy(config *viper.Viper) (func(*http.Request) (*url.URL, error), error) {
+
+	value := config.GetString("hmc_proxy")
+	switch strings.ToLower(value) {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case "none", "direct":
+		return nil, nil
+	}
+	proxyURL, err := url.Parse(value)
+	if err != nil || proxyURL.Host == "" {
+		return nil, fmt.Errorf("hmc_proxy %q is not a proxy URL", value)
+	}
+	log.Infof("HMC connections through proxy %s", proxyURL.Redacted())
+	return http.ProxyURL(proxyURL), nil
+}
+
+// apiURL returns the absolute URL of an HMC REST API path, e.g. /rest/api/uom/ManagementConsole.
+func (hmc *HMC) apiURL(path string) string {
+	return hmc.endpoints.current().baseURL.String() + path
+}
+
+// configDuration parses a duration config value, falling back to def when it is empty or invalid.
+func configDuration(config *viper.Viper, key string, def time.Duration) time.Duration {
+	value := config.GetString(key)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Warnf("Error parsing %s. Used %s as a default value. err=%s", key, def, err)
+		return def
+	}
+	return d
 }
 
 // for debugging, when real HMC is not reachable
@@ -141,17 +292,32 @@ func readFileSafely(filename string) ([]byte, error) {
 	return data, nil
 }
 
-func (hmc *HMC) Logon(ctx context.Context, lock bool) error {
+func (hmc *HMC) Logon(ctx context.Context, lock bool) (err error) {
 
-	hmc.stats.logon_requests++
+	logger := ctxLogger(ctx)
+	hmc.stats.logon_requests.Add(1)
 
 	if lock {
 		hmc.logon.mu.Lock()
 		defer hmc.logon.mu.Unlock()
 	}
+	// under the logon lock, the failure is part of the logon state
+	defer func() {
+		if err == nil {
+			hmc.logon.failure = ""
+		} else if err.Error() != hmc.logon.failure {
+			hmc.logon.failure = err.Error()
+			hmc.notify.Notify(&Notification{
+				Kind:    notifyLogonFailure,
+				HMC:     hmc.hmcName,
+				User:    hmc.user,
+				Message: fmt.Sprintf("HMC %s logon as %s failed: %s", hmc.hmcName, hmc.user, err),
+			})
+		}
+	}()
 
 	if hmc.logon.connected {
-		log.Warnln("HMC Logon. Attempting to logon when already connected !")
+		logger.Warnln("HMC Logon. Attempting to logon when already connected !")
 		return nil
 	}
 
@@ -159,7 +325,7 @@ func (hmc *HMC) Logon(ctx context.Context, lock bool) error {
 	hmc.logon.token = ""
 	//hmc.logon.connected = false		// it is already false if we are here - see "if.." above :)
 
-	url := "https://" + hmc.hmcHostname + ":12443/rest/api/web/Logon"
+	url := hmc.apiURL("/rest/api/web/Logon")
 	payload := "<LogonRequest schemaVersion=\"V1_0\" xmlns=\"http://www.ibm.com/xmlns/systems/power/firmware/web/mc/2012_10/\" " +
 		"xmlns:mc=\"http://www.ibm.com/xmlns/systems/power/firmware/web/mc/2012_10/\">" +
 		"<UserID>" + hmc.user + "</UserID><Password>" + hmc.passwd + "</Password></LogonRequest>"
@@ -175,17 +341,16 @@ func (hmc *HMC) Logon(ctx context.Context, lock bool) error {
 	req.Header.Set("Content-Type", "application/vnd.ibm.powervm.web+xml; type=LogonRequest")
 	//req.Header.Set("Accept", "application/xml")
 	//req.Header.Set("Connection", "keep-alive")
-	req.Header.Set("Host", hmc.hmcHostname+":12443")
 	req.Header.Set("Accept", "*/*")
 
 	// Execute request
 	resp, err := hmc.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("HMC Logon Do. %w", err)
+		return fmt.Errorf("HMC Logon Do. %w: %w", errHMCUnavailable, err)
 	}
 	defer resp.Body.Close()
 
-	log.Infof("HMC %s Logon status:%s", hmc.hmcName, resp.Status)
+	logger.Infof("HMC %s Logon status:%s", hmc.hmcName, resp.Status)
 	//log.Debugf("Logon Header:%v\n", resp.Header)
 
 	body, err := io.ReadAll(resp.Body)
@@ -193,7 +358,7 @@ func (hmc *HMC) Logon(ctx context.Context, lock bool) error {
 		return fmt.Errorf("HMC Logon Body %w", err)
 	}
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("Logon failed error code: %s url: %s\n", resp.Status, url)
+		return fmt.Errorf("%w: Logon failed error code: %s url: %s", errHMCUnavailable, resp.Status, url)
 	}
 	//log.Debugf("Body: %s\n", body)
 
@@ -205,26 +370,30 @@ func (hmc *HMC) Logon(ctx context.Context, lock bool) error {
 	if err := xml.Unmarshal([]byte(body), &response); err != nil {
 		return fmt.Errorf("Logon failed to parse XML: %w", err)
 	}
-	log.Debugf("Token: %s", response.Token)
+	logger.Debugf("Token: %s", response.Token)
 
 	hmc.logon.token = response.Token
 	hmc.logon.connected = true
+	hmc.logon.issued = time.Now()
+	hmc.logon.lastUsed = hmc.logon.issued
+	hmc.stats.logons.Add(1)
 	return nil
 }
 
 func (hmc *HMC) Logoff(ctx context.Context, lock bool) error {
 
+	logger := ctxLogger(ctx)
 	if lock {
 		hmc.logon.mu.Lock()
 		defer hmc.logon.mu.Unlock()
 	}
 	if !hmc.logon.connected {
-		log.Warnln("HMC Logoff. Attempting to logoff when connected")
+		logger.Warnln("HMC Logoff. Attempting to logoff when connected")
 		//return fmt.Errorf("Attempting to logoff when not connected")
 		return nil
 	}
 
-	url := "https://" + hmc.hmcHostname + ":12443/rest/api/web/Logon"
+	url := hmc.apiURL("/rest/api/web/Logon")
 
 	// Create request with context. Suppose ctx - context with timeout...
 	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url, nil)
@@ -234,7 +403,6 @@ func (hmc *HMC) Logoff(ctx context.Context, lock bool) error {
 
 	// Set headers
 	req.Header.Set("X-API-Session", hmc.logon.token)
-	req.Header.Set("Host", hmc.hmcHostname+":12443")
 	req.Header.Set("Accept", "*/*")
 
 	// Execute request
@@ -245,14 +413,14 @@ func (hmc *HMC) Logoff(ctx context.Context, lock bool) error {
 	}
 	defer resp.Body.Close()
 
-	log.Debugf("Logoff %s status:%s", hmc.hmcName, resp.Status)
+	logger.Debugf("Logoff %s status:%s", hmc.hmcName, resp.Status)
 	//log.Debugf("Header:%v\n", resp.Header)
 
 	hmc.logon.token = ""
 	hmc.logon.connected = false
 
 	body, _ := io.ReadAll(resp.Body)
-	log.Debugf("Logoff Body: %s", body)
+	logger.Debugf("Logoff Body: %s", body)
 
 	if resp.StatusCode != 200 && resp.StatusCode != 202 && resp.StatusCode != 204 {
 		return fmt.Errorf("Logoff failed error code: %s, url: %s", resp.Status, url)
@@ -262,14 +430,16 @@ func (hmc *HMC) Logoff(ctx context.Context, lock bool) error {
 
 func (hmc *HMC) reLogon(ctx context.Context, token string) (string, error) {
 
+	logger := ctxLogger(ctx)
 	hmc.logon.mu.Lock()
 	defer hmc.logon.mu.Unlock()
 
 	newToken := hmc.logon.token
 	if newToken != token {
-		log.Debugln("reLogon. New Token differ from old one. Smbdy already re-logoned.")
+		logger.Debugln("reLogon. New Token differ from old one. Smbdy already re-logoned.")
 		return newToken, nil
 	}
+	hmc.stats.forced_relogons.Add(1)
 	_ = hmc.Logoff(ctx, false)
 	hmc.CloseIdleConnections()
 
@@ -295,32 +465,46 @@ func (hmc *HMC) CloseIdleConnections() {
 }
 
 func (hmc *HMC) GetInfoByUrl(ctx context.Context, url string, headers map[string]string) ([]byte, error) {
+	return hmc.SendByUrl(ctx, http.MethodGet, url, nil, headers)
+}
 
+// sendByUrl sends the request to the HMC serving now, see SendByUrl.
+func (hmc *HMC) sendByUrl(ctx context.Context, method string, url string, payload []byte, headers map[string]string) ([]byte, error) {
+
+	logger := ctxLogger(ctx)
 	myname := "hmc.getInfoByUrl"
 
-	log.Debugf("%s url=%s", myname, url)
-	hmc.stats.url_requests++
+	logger.Debugf("%s %s url=%s", myname, method, url)
+	hmc.stats.url_requests.Add(1)
 
-	if !hmc.logon.connected {
-		log.Infof("%s not connected. Trying to logon", myname)
-		if err := hmc.Logon(ctx, true); err != nil {
-			return []byte{}, fmt.Errorf("%s Not connected. Logon error: %w", myname, err)
-		}
+	var reqBody io.Reader
+	if payload != nil {
+		reqBody = bytes.NewReader(payload)
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
 
 	if err != nil {
 		return []byte{}, fmt.Errorf("%s %w", myname, err)
 	}
 
-	// Set headers
+	// connected and token together, KeepSession and failover change them in the background
+	hmc.logon.mu.Lock()
+	if !hmc.logon.connected || hmc.logon.token == "" {
+		logger.Infof("%s not connected. Trying to logon", myname)
+		hmc.logon.connected = false
+		if err := hmc.Logon(ctx, false); err != nil {
+			hmc.logon.mu.Unlock()
+			return []byte{}, fmt.Errorf("%s Not connected. Logon error: %w", myname, err)
+		}
+	}
+	hmc.logon.lastUsed = time.Now()
 	token := hmc.logon.token // this token var is Inportant thinngs.
+	hmc.logon.mu.Unlock()
 	// In case of authority error we will compare this token with hmc.logon.token,
 	// may be smbdy already re-logoned while we processed the request
 
 	req.Header.Set("X-API-Session", token)
 	//req.Header.Set("Content-Type", "application/vnd.ibm.powervm.uom+xml; Type=ManagedSystem")
-	req.Header.Set("Host", hmc.hmcHostname+":12443")
 	req.Header.Set("Accept", "*/*")
 	// Set custom headers
 	for key, value := range headers {
@@ -329,12 +513,12 @@ func (hmc *HMC) GetInfoByUrl(ctx context.Context, url string, headers map[string
 	// Execute request
 	resp, err := hmc.client.Do(req)
 	if err != nil {
-		return []byte{}, fmt.Errorf("%s %w", myname, err)
+		return []byte{}, fmt.Errorf("%s %w: %w", myname, errHMCUnavailable, err)
 	}
 	defer resp.Body.Close()
 	body, errBody := io.ReadAll(resp.Body)
 
-	log.Debugf("%s status:%s, %d", myname, resp.Status, resp.StatusCode)
+	logger.Debugf("%s status:%s, %d", myname, resp.Status, resp.StatusCode)
 	//log.Debugf("Header:%v\n", resp.Header)
 	//log.Debugf("Body: %s\n", body)
 
@@ -345,17 +529,20 @@ func (hmc *HMC) GetInfoByUrl(ctx context.Context, url string, headers map[string
 	} else if resp.StatusCode == 401 || resp.StatusCode == 403 {
 		// Not authorised - not logged on
 		// try to logoff/logon once again
-		log.Infof("%s not connected to HMC by response. Trying to Logoff/Logon.", myname)
+		logger.Infof("%s not connected to HMC by response. Trying to Logoff/Logon.", myname)
 		token, err := hmc.reLogon(ctx, token)
 		if err == nil {
 			// New token from new Logon and repeat the request
 			req.Header.Set("X-API-Session", token)
+			if req.GetBody != nil {
+				req.Body, _ = req.GetBody()
+			}
 			resp, err := hmc.client.Do(req)
 			if err == nil {
 				defer resp.Body.Close()
 				body, errBody := io.ReadAll(resp.Body)
 
-				log.Debugf("%s status:%s, %d", myname, resp.Status, resp.StatusCode)
+				logger.Debugf("%s status:%s, %d", myname, resp.Status, resp.StatusCode)
 
 				if resp.StatusCode == 200 {
 					return body, errBody
@@ -365,61 +552,206 @@ func (hmc *HMC) GetInfoByUrl(ctx context.Context, url string, headers map[string
 					return []byte{}, fmt.Errorf("%s response status: %s, url: %s", myname, resp.Status, url)
 				}
 			}
+			return []byte{}, fmt.Errorf("%s %w: %w", myname, errHMCUnavailable, err)
 		}
+		return []byte{}, fmt.Errorf("%s relogon %w", myname, err)
 	}
 	// finally was not able to process the request
 	return []byte{}, fmt.Errorf("%s response status: %s, url: %s", myname, resp.Status, url)
 }
+
+// GetManagementConsole retrieves the raw ManagementConsole XML. Concurrent calls share one HMC request.
 func (hmc *HMC) GetManagementConsole(ctx context.Context) ([]byte, error) {
 
-	hmc.stats.mgmconsole_requests++
+	v, err, shared := hmc.flight.Do(ctx, "ManagementConsole", func(ctx context.Context) (interface{}, error) {
+		hmc.stats.mgmconsole_requests.Add(1)
 
-	consoleURL := "https://" + hmc.hmcHostname + ":12443/rest/api/uom/ManagementConsole"
-	consoleHeader := map[string]string{}
-	return hmc.GetInfoByUrl(ctx, consoleURL, consoleHeader)
+		consoleURL := hmc.apiURL("/rest/api/uom/ManagementConsole")
+		consoleHeader := map[string]string{}
+		return hmc.GetInfoByUrl(ctx, consoleURL, consoleHeader)
 
-	// Use read from file for development/debugging purposes in case real HMC is not reachable
-	//return readFileSafely("./mgms.xml")
+		// Use read from file for development/debugging purposes in case real HMC is not reachable
+		//return readFileSafely("./mgms.xml")
+	})
+	if shared {
+		hmc.stats.coalesced_requests.Add(1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
 }
+
+// GetManagementConsoleData returns the ManagementConsole, from the cache while it is valid.
+// When the refresh fails the cached data is served until it is older than hmc_stale_max_age.
 func (hmc *HMC) GetManagementConsoleData(ctx context.Context) (*ManagementConsole, error) {
 
+	logger := ctxLogger(ctx)
 	mgmc := hmc.mgmc
 
 	//var mgmCons ManagementConsole
 	myname := "GetManagementConsoleData"
 
-	if (mgmc.mgmConsole == nil) || mgmc.NextUpdate.Before(time.Now()) {
-		log.Debugf("%s. Retrieving data from HMC", myname)
-		mgmc.mgmConsole = nil
-		xmlData, err := hmc.GetManagementConsole(ctx)
-		if err != nil {
-			return nil, fmt.Errorf("%s %s", myname, err)
-		}
-		mgmConsole := &ManagementConsole{}
-		err = xml.Unmarshal(xmlData, mgmConsole)
-		if err != nil {
-			return nil, fmt.Errorf("%s %s", myname, err)
+	mgmc.mu.Lock()
+	cached, fetched, invalid := mgmc.mgmConsole, mgmc.fetched, mgmc.invalid
+	valid := cached != nil && !invalid && mgmc.NextUpdate.After(time.Now())
+	mgmc.mu.Unlock()
+
+	if valid {
+		logger.Debugf("%s. Retrieving data from buffer", myname)
+		return cached, nil
+	}
+	stale := cached != nil && time.Since(fetched) < hmc.staleMaxAge
+	if stale && hmc.revalidate && !invalid {
+		logger.Debugf("%s. Retrieving stale data from buffer, revalidating", myname)
+		hmc.stats.stale_responses.Add(1)
+		refreshCtx, cancel := detachedContext(ctx)
+		go func() {
+			defer cancel()
+			hmc.refreshManagementConsole(refreshCtx)
+		}()
+		return cached, nil
+	}
+
+	logger.Debugf("%s. Retrieving data from HMC", myname)
+	mgmConsole, err := hmc.refreshManagementConsole(ctx)
+	if err != nil {
+		if stale {
+			logger.Warnf("%s. Serving data of %s: %s", myname, fetched.Format(time.RFC3339), err)
+			hmc.stats.stale_responses.Add(1)
+			return cached, nil
 		}
-		mgmc.mgmConsole = mgmConsole
-		mgmc.NextUpdate = time.Now().Add(mgmc.Interval)
-	} else {
-		log.Debugf("%s. Retrieving data from buffer", myname)
+		return nil, fmt.Errorf("%s %w", myname, err)
 	}
-	return mgmc.mgmConsole, nil
+	return mgmConsole, nil
+}
+
+func (hmc *HMC) refreshManagementConsole(ctx context.Context) (*ManagementConsole, error) {
+
+	xmlData, err := hmc.GetManagementConsole(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mgmConsole := &ManagementConsole{}
+	if err := xml.Unmarshal(xmlData, mgmConsole); err != nil {
+		return nil, err
+	}
+	mgmc := hmc.mgmc
+	mgmc.mu.Lock()
+	mgmc.mgmConsole = mgmConsole
+	mgmc.fetched = time.Now()
+	mgmc.invalid = false
+	mgmc.NextUpdate = mgmc.fetched.Add(mgmc.Interval)
+	mgmc.mu.Unlock()
+	return mgmConsole, nil
 }
 
 func (hmc *HMC) GetMgmsQuick(ctx context.Context, mgmsUUID string) ([]byte, error) {
 
-	hmc.stats.quick_mgms_requests++
+	hmc.stats.quick_mgms_requests.Add(1)
 
 	mgmsHeader := map[string]string{"Content-Type": "application/vnd.ibm.powervm.uom+xml; Type=ManagedSystem"}
-	mgmsURL := "https://" + hmc.hmcHostname + ":12443/rest/api/uom/ManagedSystem/" + mgmsUUID + "/quick"
+	mgmsURL := hmc.apiURL("/rest/api/uom/ManagedSystem/" + mgmsUUID + "/quick")
 	return hmc.GetInfoByUrl(ctx, mgmsURL, mgmsHeader)
 
 	// Use read from file for development/debugging purposes in case real HMC is not reachable
 	//return readFileSafely("./mgms-quick.xml")
 }
 
+// GetMgmsQuickCached returns the ManagedSystem quick data from the cache if it is still
+// valid, otherwise retrieves and caches it. Stale data is served as for GetManagementConsoleData.
+func (hmc *HMC) GetMgmsQuickCached(ctx context.Context, mgmsUUID string) ([]byte, error) {
+
+	q := hmc.quick
+	logger := ctxLogger(ctx)
+
+	q.mu.Lock()
+	var entry quickEntry
+	cached, exists := q.entries[mgmsUUID]
+	if exists {
+		entry = *cached
+	}
+	valid := exists && !entry.invalid && time.Since(entry.fetched) < q.maxAge &&
+		(q.feedActive || time.Since(entry.fetched) < q.pollInterval)
+	q.mu.Unlock()
+
+	if valid {
+		logger.Debugf("GetMgmsQuickCached. %s from buffer", mgmsUUID)
+		return entry.data, nil
+	}
+	stale := exists && time.Since(entry.fetched) < hmc.staleMaxAge
+	if stale && hmc.revalidate && !entry.invalid {
+		logger.Debugf("GetMgmsQuickCached. %s stale from buffer, revalidating", mgmsUUID)
+		hmc.stats.stale_responses.Add(1)
+		refreshCtx, cancel := detachedContext(ctx)
+		go func() {
+			defer cancel()
+			hmc.RefreshMgmsQuick(refreshCtx, mgmsUUID)
+		}()
+		return entry.data, nil
+	}
+	data, err := hmc.RefreshMgmsQuick(ctx, mgmsUUID)
+	if err != nil && stale {
+		logger.Warnf("GetMgmsQuickCached. Serving %s data of %s: %s", mgmsUUID, entry.fetched.Format(time.RFC3339), err)
+		hmc.stats.stale_responses.Add(1)
+		return entry.data, nil
+	}
+	return data, err
+}
+
+// RefreshMgmsQuick retrieves the ManagedSystem quick data and stores it in the cache.
+// Concurrent calls for the same system share one HMC request.
+func (hmc *HMC) RefreshMgmsQuick(ctx context.Context, mgmsUUID string) ([]byte, error) {
+
+	v, err, shared := hmc.flight.Do(ctx, "quick/"+mgmsUUID, func(ctx context.Context) (interface{}, error) {
+		data, err := hmc.GetMgmsQuick(ctx, mgmsUUID)
+		if err != nil {
+			return data, err
+		}
+		hmc.quick.mu.Lock()
+		hmc.quick.entries[mgmsUUID] = &quickEntry{data: data, fetched: time.Now()}
+		hmc.quick.mu.Unlock()
+		return data, nil
+	})
+	if shared {
+		hmc.stats.coalesced_requests.Add(1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+// InvalidateMgmsQuick marks cached quick data outdated, of all systems if mgmsUUID is empty.
+func (hmc *HMC) InvalidateMgmsQuick(mgmsUUID string) {
+	hmc.quick.mu.Lock()
+	defer hmc.quick.mu.Unlock()
+	for uuid, entry := range hmc.quick.entries {
+		if mgmsUUID == "" || uuid == mgmsUUID {
+			entry.invalid = true
+		}
+	}
+}
+
+// InvalidateManagementConsole forces the next GetManagementConsoleData to retrieve the managed systems list.
+func (hmc *HMC) InvalidateManagementConsole() {
+	hmc.mgmc.mu.Lock()
+	hmc.mgmc.invalid = true
+	hmc.mgmc.mu.Unlock()
+}
+
+// Updates signals that cached managed system data was refreshed in the background.
+func (hmc *HMC) Updates() <-chan struct{} {
+	return hmc.updates
+}
+
+func (hmc *HMC) notifyUpdate() {
+	select {
+	case hmc.updates <- struct{}{}:
+	default:
+	}
+}
+
 /*
 func (hmc *HMC) getSystemLinks(mgmtConsole []byte) ([]string, error) {
 
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Authoritative record rules, hmc_authoritative. Any other value must name the preferred HMC.
+const (
+	authConnected = "connected" // first HMC in configuration order connected to the frame
+	authOrder     = "order"     // first HMC in configuration order
+	authLED       = "led"       // a lit LED on any HMC wins, then connected
+)
+
+// HMCSet are all HMCs hmc_led knows, in configuration order. Frames managed by more than one
+// HMC are merged by MTMS into one record taken from the authoritative HMC.
+type HMCSet struct {
+	list    []*HMC
+	configs []*viper.Viper
+	rule    string
+	updates chan struct{}
+}
+
+// ManagingHMC is the view of one HMC of a merged managed system.
+type ManagingHMC struct {
+	HMC           string `json:"hmc" yaml:"hmc" xml:"hmc"`
+	State         string `json:"state" yaml:"state" xml:"state"`
+	LED           bool   `json:"led" yaml:"led" xml:"led"`
+	Authoritative bool   `json:"authoritative" yaml:"authoritative" xml:"authoritative"`
+}
+
+// hmcConfigs returns one configuration per entry of the "hmcs" list, each the top level
+// configuration overridden by the hmc_* keys of the entry. Without "hmcs" there is one HMC.
+func hmcConfigs(config *viper.Viper) ([]*viper.Viper, error) {
+
+	var entries []map[string]interface{}
+	if err := config.UnmarshalKey("hmcs", &entries); err != nil {
+		return nil, fmt.Errorf("hmcs %w", err)
+	}
+	if len(entries) == 0 {
+		return []*viper.Viper{config}, nil
+	}
+
+	configs := []*viper.Viper{}
+	names := map[string]bool{}
+	for i, entry := range entries {
+		c := subConfig(config, entry, "hmcs")
+		name := c.GetString("hmc_name")
+		if name == "" {
+			return nil, fmt.Errorf("hmcs[%d]: hmc_name is missing", i)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("hmcs[%d]: hmc_name %s is not unique", i, name)
+		}
+		names[name] = true
+		configs = append(configs, c)
+	}
+	return configs, nil
+}
+
+func NewHMCSet(config *viper.Viper) (*HMCSet, error) {
+
+	configs, err := hmcConfigs(config)
+	if err != nil {
+		return nil, err
+	}
+	set := &HMCSet{
+		configs: configs,
+		rule:    config.GetString("hmc_authoritative"),
+		updates: make(chan struct{}, 1),
+	}
+	switch set.rule {
+	case "":
+		set.rule = authConnected
+	case authConnected, authOrder, authLED:
+	default:
+		// a misspelt rule or HMC name would silently fall back to connected
+		known := false
+		for _, c := range configs {
+			known = known || c.GetString("hmc_name") == set.rule
+		}
+		if !known {
+			return nil, fmt.Errorf("hmc_authoritative %s is neither connected, order, led nor the hmc_name of an HMC", set.rule)
+		}
+	}
+	for _, c := range configs {
+		hmc, err := NewHMC(c)
+		if err != nil {
+			return nil, fmt.Errorf("HMC %s: %w", c.GetString("hmc_name"), err)
+		}
+		// one signal for all HMCs, the monitor collects them together
+		hmc.updates = set.updates
+		set.list = append(set.list, hmc)
+	}
+	if len(set.list) > 1 {
+		log.Infof("HMCs %s, authoritative record: %s", set.Name(), set.rule)
+	}
+	return set, nil
+}
+
+// Run starts the background work of every HMC.
+func (set *HMCSet) Run(ctx context.Context, wg *sync.WaitGroup) {
+	for i, hmc := range set.list {
+		wg.Add(3)
+		go NewEventListener(set.configs[i], hmc).Run(ctx, wg)
+		go hmc.KeepSession(ctx, wg)
+		go hmc.WatchEndpoints(ctx, wg)
+	}
+}
+
+func (set *HMCSet) Shutdown(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for _, hmc := range set.list {
+		wg.Add(1)
+		go hmc.Shutdown(ctx, wg)
+	}
+}
+
+// SetNotifications makes every HMC report its logon failures to notify.
+func (set *HMCSet) SetNotifications(notify *Notifications) {
+	for _, hmc := range set.list {
+		hmc.notify = notify
+	}
+}
+
+func (set *HMCSet) CloseIdleConnections() {
+	for _, hmc := range set.list {
+		hmc.CloseIdleConnections()
+	}
+}
+
+// Updates signals that cached managed system data of any HMC was refreshed in the background.
+func (set *HMCSet) Updates() <-chan struct{} {
+	return set.updates
+}
+
+// Name is the HMC name, or the comma separated names of all HMCs.
+func (set *HMCSet) Name() string {
+	names := []string{}
+	for _, hmc := range set.list {
+		names = append(names, hmc.hmcName)
+	}
+	return strings.Join(names, ",")
+}
+
+// Get returns the HMC by name, the first one for an empty name.
+func (set *HMCSet) Get(name string) *HMC {
+	if name == "" {
+		return set.list[0]
+	}
+	for _, hmc := range set.list {
+		if hmc.hmcName == name {
+			return hmc
+		}
+	}
+	return nil
+}
+
+// CollectQuickMgms collects the managed systems of all HMCs, merged by MTMS.
+// HMCs which fail are logged and skipped, unless all fail.
+func (set *HMCSet) CollectQuickMgms(ctx context.Context) (*RespJson, error) {
+
+	if len(set.list) == 1 {
+		return set.list[0].CollectQuickMgms(ctx)
+	}
+
+	start := time.Now()
+	merged := &RespJson{HMC: set.Name(), Systems: []*QuickMgms{}}
+	hmcMTMS := []string{}
+	views := [][]*QuickMgms{}
+	var firstErr error
+	for _, hmc := range set.list {
+		respJson, err := hmc.CollectQuickMgms(ctx)
+		if err != nil {
+			ctxLogger(ctx).Errorf("CollectQuickMgms. HMC %s: %s", hmc.hmcName, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		hmcMTMS = append(hmcMTMS, respJson.HMCmtms)
+		views = append(views, respJson.Systems)
+	}
+	if len(views) == 0 {
+		return nil, firstErr
+	}
+
+	// group the records by frame, in order of first appearance
+	groups := map[string][]*QuickMgms{}
+	order := []string{}
+	for _, systems := range views {
+		for _, system := range systems {
+			key := frameKey(system)
+			if _, exists := groups[key]; !exists {
+				order = append(order, key)
+			}
+			groups[key] = append(groups[key], system)
+		}
+	}
+	for _, key := range order {
+		merged.Systems = append(merged.Systems, set.merge(groups[key]))
+	}
+	merged.HMCmtms = strings.Join(hmcMTMS, ",")
+	merged.Elapsed = int64(time.Since(start)) / 1000000
+	return merged, nil
+}
+
+// GetSystem returns the authoritative record of a managed system and the HMC it came from.
+func (set *HMCSet) GetSystem(ctx context.Context, uuid string) (*HMC, *QuickMgms, error) {
+
+	if len(set.list) == 1 {
+		system, err := set.list[0].GetSystem(ctx, uuid)
+		return set.list[0], system, err
+	}
+
+	records := []*QuickMgms{}
+	var firstErr error
+	for _, hmc := range set.list {
+		system, err := hmc.GetSystem(ctx, uuid)
+		if err == nil {
+			records = append(records, system)
+		} else if !errors.Is(err, errSystemNotFound) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if len(records) == 0 {
+		if firstErr == nil {
+			firstErr = fmt.Errorf("GetSystem %s: %w", uuid, errSystemNotFound)
+		}
+		return nil, nil, firstErr
+	}
+	system := set.merge(records)
+	return set.Get(system.HMC), system, nil
+}
+
+// frameKey identifies a frame across HMCs.
+func frameKey(system *QuickMgms) string {
+	if system.MTMS != "" {
+		return system.MTMS
+	}
+	return system.HMC + "/" + system.UUID
+}
+
+// merge picks the authoritative record of one frame, records are in HMC configuration order.
+func (set *HMCSet) merge(records []*QuickMgms) *QuickMgms {
+
+	best := 0
+	for i := 1; i < len(records); i++ {
+		if set.better(records[i], records[best]) {
+			best = i
+		}
+	}
+	system := *records[best]
+	system.ManagedBy = []*ManagingHMC{}
+	for i, r := range records {
+		system.ManagedBy = append(system.ManagedBy, &ManagingHMC{
+			HMC:           r.HMC,
+			State:         r.State,
+			LED:           r.LED,
+			Authoritative: i == best,
+		})
+	}
+	return &system
+}
+
+// better is true when record a wins over b, which comes earlier in configuration order.
+func (set *HMCSet) better(a *QuickMgms, b *QuickMgms) bool {
+	switch set.rule {
+	case authOrder:
+		return false
+	case authLED:
+		if a.LED != b.LED {
+			return a.LED
+		}
+	case authConnected:
+	default:
+		if a.HMC == set.rule || b.HMC == set.rule {
+			return a.HMC == set.rule
+		}
+	}
+	return frameConnected(a.State) && !frameConnected(b.State)
+}
+
+// frameConnected is false for the states an HMC reports when it can not talk to the frame.
+func frameConnected(state string) bool {
+	state = strings.ToLower(state)
+	for _, prefix := range []string{"no connection", "failed authentication", "pending authentication", "incomplete", "version mismatch", "recovery"} {
+		if strings.HasPrefix(state, prefix) {
+			return false
+		}
+	}
+	return true
+}
@@ -37,6 +37,7 @@ func New(flagSet *flag.FlagSet) (*viper.Viper, error) {
 	}
 
 	setLogLevel(config.GetString("log_level"))
+	setLogFormat(config.GetString("log_format"))
 
 	return config, nil
 }
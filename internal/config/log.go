@@ -16,4 +16,16 @@ func setLogLevel(level string) {
 		log.Warnln("Unrecognized minimum log level; using 'info' as default")
 		log.SetLevel(log.InfoLevel)
 	}
-}
\ No newline at end of file
+}
+
+func setLogFormat(format string) {
+	switch format {
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	case "text", "":
+		log.SetFormatter(&log.TextFormatter{})
+	default:
+		log.Warnln("Unrecognized log format; using 'text' as default")
+		log.SetFormatter(&log.TextFormatter{})
+	}
+}
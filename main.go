@@ -31,9 +31,18 @@ func init() {
 	flag.String("srv_port", "9680", "The port number to listen on for HTTP requests")
 	flag.String("srv_addr", "0.0.0.0", "The address to listen on for HTTP requests")
 	flag.String("log_level", "info", "The minimum logging level; levels are, in ascending order: debug, info, warn, error")
+	flag.String("log_format", "text", "The log output format: text or json")
 	flag.String("hmc_name", "", "The name of connected HMC, e.g. HMC1")
-	flag.String("hmc_hostname", "hmc.localhost", "The host name of connected HMC api interface. Hrdcored port 12443, e.g. https://host:12443.")
+	flag.String("hmc_hostname", "hmc.localhost", "The host name or IP address of connected HMC api interface")
+	flag.StringSlice("hmc_addresses", []string{}, "Addresses of the same HMC or HMC pair in order of preference, instead of hmc_hostname")
+	flag.String("hmc_scheme", "https", "The scheme of the HMC api interface, https or http")
+	flag.String("hmc_port", "12443", "The port of the HMC api interface")
+	flag.String("hmc_base_path", "", "The path prefix of the HMC api interface, e.g. behind a reverse proxy")
+	flag.String("hmc_proxy", "", "Outbound proxy URL for HMC connections, none for direct. Default HTTPS_PROXY and NO_PROXY environment")
 	flag.String("tls_skip_verify", "no", "For HTTPS scheme, should certificates signed by unknown authority being ignored")
+	flag.String("hmc_ca_file", "", "PEM file with the CA certificates (or the HMC certificate) to verify the HMC against")
+	flag.String("hmc_server_name", "", "The name to verify the HMC certificate against and send as SNI, when hmc_hostname is an IP address")
+	flag.StringSlice("hmc_pin_sha256", []string{}, "SHA-256 fingerprints of the HMC certificate or public key, see fetch-cert")
 	flag.StringP("config", "c", "", "The path to a custom configuration file. NOTE: it must be in yaml format.")
 	flag.CommandLine.SortFlags = false
 
@@ -49,6 +58,8 @@ func main() {
 		showHelp()
 	case *versionFlag:
 		showVersion()
+	case flag.Arg(0) == "fetch-cert":
+		runFetchCert()
 	default:
 		run()
 	}
@@ -68,13 +79,70 @@ func run() {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
-	// Init HMC struct
-	hmc := NewHMC(globalConfig)
-	defer hmc.CloseIdleConnections()
+	// Init HMC structs
+	hmcs, err := NewHMCSet(globalConfig)
+	if err != nil {
+		log.Fatalf("Could not initialize HMC connection: %s", err)
+	}
+	defer hmcs.CloseIdleConnections()
 
-	// Init http server
 	srv := Srv{}
-	srv.SrvInit(ctx, globalConfig, hmc)
+
+	// notifications of system changes, HMC logon and authentication failures
+	notifiers, err := NewNotifiers(globalConfig, &NotifierDeps{Collect: srv.CollectTracked})
+	if err != nil {
+		log.Fatalf("Could not initialize notifiers: %s", err)
+	}
+	silences, err := NewSilenceStore(globalConfig)
+	if err != nil {
+		log.Fatalf("Could not load silences: %s", err)
+	}
+	acks, err := NewAckStore(globalConfig)
+	if err != nil {
+		log.Fatalf("Could not load acknowledgements: %s", err)
+	}
+	notify := NewNotifications()
+	notify.SetSilences(silences)
+	notify.Subscribe(notifiers.Dispatch)
+	hmcs.SetNotifications(notify)
+
+	// optional alert rules over the collected systems
+	alerts, err := NewAlertEngine(globalConfig, notify)
+	if err != nil {
+		log.Fatalf("Could not initialize alert rules: %s", err)
+	}
+
+	// Init http server
+	srv.notify, srv.notifiers, srv.alerts, srv.silences, srv.acks = notify, notifiers, alerts, silences, acks
+	srv.SrvInit(ctx, globalConfig, hmcs)
+
+	// optional MQTT publisher, fed by the tracker
+	mqtt, err := NewMQTTPublisher(globalConfig)
+	if err != nil {
+		log.Fatalf("Could not initialize MQTT publisher: %s", err)
+	}
+	if mqtt != nil {
+		// before the first tracker update, which publishes every system
+		srv.mqtt = mqtt
+		srv.tracker.Subscribe(mqtt.Publish)
+	}
+
+	// keep the managed systems data current in the background
+	var wgBg sync.WaitGroup
+	wgBg.Add(1)
+	go srv.Monitor(ctx, &wgBg)
+	wgBg.Add(1)
+	go srv.tracker.Run(ctx, &wgBg)
+	hmcs.Run(ctx, &wgBg)
+	notifiers.Run(ctx, &wgBg)
+	if alerts != nil {
+		wgBg.Add(1)
+		go alerts.Run(ctx, &wgBg)
+	}
+	if mqtt != nil {
+		wgBg.Add(1)
+		go mqtt.Run(ctx, &wgBg)
+	}
 
 	// run http server, waiting for chan message in case of server ended.
 	chSrv := make(chan error)
@@ -94,8 +162,9 @@ func run() {
 
 		wg.Add(1)
 		go srv.Shutdown(ctxShutdown, &wg)
+		wgBg.Wait()
 		wg.Add(1)
-		go hmc.Shutdown(ctxShutdown, &wg)
+		go hmcs.Shutdown(ctxShutdown, &wg)
 
 		// wait for srv.shutdown results
 		if e, ok := <-chSrv; ok == true {
@@ -109,6 +178,9 @@ func run() {
 
 	case e := <-chSrv: // srv.ListenAndServe ended itself, probably due to error.
 		log.Errorf("Server: %s", e)
+		// stop background listeners
+		stop()
+		wgBg.Wait()
 		// Create a deadline to wait for shutdown timeout.
 
 		ctxShutdown, cancelShutd := context.WithTimeout(context.Background(), 10*time.Second)
@@ -117,20 +189,56 @@ func run() {
 		var wg sync.WaitGroup
 
 		wg.Add(1)
-		go hmc.Shutdown(ctxShutdown, &wg)
+		go hmcs.Shutdown(ctxShutdown, &wg)
 		wg.Wait()
 
 	}
 }
 
+// runFetchCert prints the HMC certificate chain, to be pinned or saved as hmc_ca_file.
+func runFetchCert() {
+	globalConfig, err := config.New(flag.CommandLine)
+	if err != nil {
+		log.Fatalf("Could not initialize config: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	configs, err := hmcConfigs(globalConfig)
+	if err != nil {
+		log.Fatalf("Could not initialize config: %s", err)
+	}
+	for _, c := range configs {
+		if err := fetchCert(ctx, c, os.Stdout); err != nil {
+			log.Fatalf("Could not fetch HMC %s certificate: %s", c.GetString("hmc_name"), err)
+		}
+	}
+}
+
 func showHelp() {
 	flag.Usage()
 	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  fetch-cert                - print the HMC certificate chain with SHA-256 fingerprints and exit")
+	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintln(os.Stderr, "Endpoints:")
 	fmt.Fprintln(os.Stderr, "  GET /health               - Health check (public)")
 	fmt.Fprintln(os.Stderr, "  GET /status               - Some statistics (public)")
-	fmt.Fprintln(os.Stderr, "  GET /getManagementConsole - raw XML /rest/api/uom/ManagementConsole")
-	fmt.Fprintln(os.Stderr, "  GET /quickManagedSystem   - YAML - servers LED status")
+	fmt.Fprintln(os.Stderr, "  GET /getManagementConsole - raw XML /rest/api/uom/ManagementConsole, ?hmc=name selects the HMC")
+	fmt.Fprintln(os.Stderr, "  GET /quickManagedSystem   - servers LED status")
+	fmt.Fprintln(os.Stderr, "  GET /systems/{uuid}/partitions - logical partitions and VIOS of a server")
+	fmt.Fprintln(os.Stderr, "  GET /systems/{uuid}/serviceable-events - serviceable events of a server")
+	fmt.Fprintln(os.Stderr, "  GET /systems/{uuid}/metrics - PCM utilization, energy and temperature of a server")
+	fmt.Fprintln(os.Stderr, "  GET /metrics              - PCM metrics of all servers, Prometheus text by default")
+	fmt.Fprintln(os.Stderr, "  GET /partitions           - logical partitions and VIOS of all servers")
+	fmt.Fprintln(os.Stderr, "  GET /ui                   - web dashboard of servers LED status")
+	fmt.Fprintln(os.Stderr, "  GET /alerts               - pending and firing alerts of the alert_rules")
+	fmt.Fprintln(os.Stderr, "  GET /silences             - active and scheduled silences, POST creates one (basic auth)")
+	fmt.Fprintln(os.Stderr, "  GET|DELETE /silences/{id} - a silence, DELETE expires it (basic auth)")
+	fmt.Fprintln(os.Stderr, "  GET /acks                 - acknowledged attention LEDs")
+	fmt.Fprintln(os.Stderr, "  POST|DELETE /systems/{uuid}/ack - acknowledge a lit attention LED or withdraw it (basic auth)")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Response format is selected by ?format=json|yaml|csv|xml|text or the Accept header.")
+	fmt.Fprintln(os.Stderr, "JSON is the default, raw XML for /getManagementConsole. text is the Prometheus exposition format.")
 	fmt.Fprintln(os.Stderr, "")
 	os.Exit(0)
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Monitor collects the managed systems whenever the event listener refreshed them,
+// so changes are tracked without waiting for a client request.
+func (s *Srv) Monitor(ctx context.Context, wg *sync.WaitGroup) {
+
+	defer wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.hmcs.Updates():
+			s.collect(ctx)
+		}
+	}
+}
+
+func (s *Srv) collect(ctx context.Context) {
+
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+
+	if _, err := s.collectTracked(ctx, true); err != nil {
+		log.Errorf("Monitor. CollectQuickMgms err=%s", err)
+	}
+}
+
+// CollectTracked collects the managed systems of all HMCs and records them in the tracker,
+// which sets their LastChange.
+func (s *Srv) CollectTracked(ctx context.Context) (*RespJson, error) {
+	return s.collectTracked(ctx, false)
+}
+
+// collectTracked with poll true for the collections after an HMC refresh, see SystemTracker.Update.
+func (s *Srv) collectTracked(ctx context.Context, poll bool) (*RespJson, error) {
+
+	respJson, err := s.hmcs.CollectQuickMgms(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.tracker.Update(respJson.Systems, poll)
+	return respJson, nil
+}
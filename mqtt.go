@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// MQTT 3.1.1 control packet types, only what a publisher needs.
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+)
+
+// mqttAckTimeout bounds the wait for CONNACK, PUBACK and PINGRESP.
+const mqttAckTimeout = 10 * time.Second
+
+// MQTTPublisher publishes the LED, state and reference code of every managed system as
+// retained messages, whenever the tracker sees them change:
+//
+//	<prefix>/<hmc>/<system>/led      on | off
+//	<prefix>/<hmc>/<system>/state    the HMC state of the frame
+//	<prefix>/<hmc>/<system>/refcode  the reference code
+//	<prefix>/status                  online | offline, offline is also the last will
+//
+// The messages are kept and published again after every reconnect.
+type MQTTPublisher struct {
+	broker    *url.URL
+	clientID  string
+	user      string
+	passwd    string
+	prefix    string
+	qos       byte
+	keepalive time.Duration
+	tlsConfig *tls.Config
+
+	mu       sync.Mutex
+	retained map[string]string // topic -> last payload
+	pending  []string          // topics not yet published on the current connection
+	signal   chan struct{}
+	stats    MQTTStats
+}
+
+// MQTTStats is the MQTT part of /status.
+type MQTTStats struct {
+	Broker    string `json:"broker" yaml:"broker" xml:"broker"`
+	Connected bool   `json:"connected" yaml:"connected" xml:"connected"`
+	Connects  int64  `json:"connects" yaml:"connects" xml:"connects"`
+	Published int64  `json:"published" yaml:"published" xml:"published"`
+	Pending   int    `json:"pending" yaml:"pending" xml:"pending"`
+	LastError string `json:"last_error,omitempty" yaml:"last_error,omitempty" xml:"last_error,omitempty"`
+}
+
+// NewMQTTPublisher returns nil without mqtt_broker. The broker is tcp://host[:1883] or,
+// for TLS, ssl://host[:8883] (tls:// and mqtts:// are the same).
+func NewMQTTPublisher(config *viper.Viper) (*MQTTPublisher, error) {
+
+	broker := config.GetString("mqtt_broker")
+	if broker == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt_broker %w", err)
+	}
+	useTLS := false
+	port := "1883"
+	switch strings.ToLower(u.Scheme) {
+	case "tcp", "mqtt":
+	case "ssl", "tls", "mqtts":
+		useTLS = true
+		port = "8883"
+	default:
+		return nil, fmt.Errorf("mqtt_broker %s: scheme must be tcp, ssl, tls or mqtts", broker)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("mqtt_broker %s: host is missing", broker)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	p := &MQTTPublisher{
+		broker:    u,
+		clientID:  config.GetString("mqtt_client_id"),
+		user:      config.GetString("mqtt_user"),
+		passwd:    config.GetString("mqtt_passwd"),
+		prefix:    strings.TrimSuffix(config.GetString("mqtt_topic_prefix"), "/"),
+		keepalive: configDuration(config, "mqtt_keepalive", 60*time.Second),
+		retained:  map[string]string{},
+		signal:    make(chan struct{}, 1),
+	}
+	if p.clientID == "" {
+		host, _ := os.Hostname()
+		p.clientID = "hmc_led-" + host
+	}
+	if p.prefix == "" {
+		p.prefix = "hmc_led"
+	}
+	switch config.GetString("mqtt_qos") {
+	case "0":
+		p.qos = 0
+	case "", "1":
+		p.qos = 1
+	default:
+		return nil, fmt.Errorf("mqtt_qos must be 0 or 1")
+	}
+	if p.keepalive > 0xffff*time.Second {
+		p.keepalive = 0xffff * time.Second
+	}
+	if useTLS {
+		if p.tlsConfig, err = newMQTTTLSConfig(config, u.Hostname()); err != nil {
+			return nil, err
+		}
+	}
+	p.stats.Broker = u.Scheme + "://" + u.Host
+	return p, nil
+}
+
+// newMQTTTLSConfig trusts mqtt_ca_file instead of the system roots and presents
+// mqtt_client_cert and mqtt_client_key, when given.
+func newMQTTTLSConfig(config *viper.Viper, host string) (*tls.Config, error) {
+
+	tlsConfig := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+	if caFile := config.GetString("mqtt_ca_file"); caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt_ca_file %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("mqtt_ca_file %s: no PEM certificates found", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	certFile, keyFile := config.GetString("mqtt_client_cert"), config.GetString("mqtt_client_key")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt_client_cert %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if strings.ToLower(config.GetString("mqtt_tls_skip_verify")) == "yes" {
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return tlsConfig, nil
+}
+
+// Publish queues the messages of the changed systems, it is a SystemTracker subscriber.
+func (p *MQTTPublisher) Publish(changes []*SystemChange) {
+
+	p.mu.Lock()
+	for _, change := range changes {
+		system := change.System
+		name := system.SysName
+		if name == "" {
+			name = system.UUID
+		}
+		base := p.prefix + "/" + mqttTopicLevel(system.HMC) + "/" + mqttTopicLevel(name) + "/"
+		led := "off"
+		if system.LED {
+			led = "on"
+		}
+		p.set(base+"led", led)
+		p.set(base+"state", system.State)
+		p.set(base+"refcode", system.RefCode)
+	}
+	p.mu.Unlock()
+
+	select {
+	case p.signal <- struct{}{}:
+	default:
+	}
+}
+
+// set queues a topic whose payload changed, p.mu is held.
+func (p *MQTTPublisher) set(topic string, payload string) {
+	if last, exists := p.retained[topic]; exists && last == payload {
+		return
+	}
+	p.retained[topic] = payload
+	for _, t := range p.pending {
+		if t == topic {
+			return
+		}
+	}
+	p.pending = append(p.pending, topic)
+}
+
+// mqttTopicLevel keeps a name from spanning topic levels or acting as a wildcard.
+func mqttTopicLevel(name string) string {
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(name)
+}
+
+func (p *MQTTPublisher) Stats() *MQTTStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.Pending = len(p.pending)
+	return &stats
+}
+
+// Run keeps the broker connection up until ctx is done, then publishes offline and disconnects.
+func (p *MQTTPublisher) Run(ctx context.Context, wg *sync.WaitGroup) {
+
+	defer wg.Done()
+
+	log.Infof("MQTT publishing to %s as %s, topic prefix %s", p.stats.Broker, p.clientID, p.prefix)
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := p.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		p.mu.Lock()
+		p.stats.Connected = false
+		p.stats.LastError = err.Error()
+		p.mu.Unlock()
+		log.Errorf("MQTT %s: %s", p.stats.Broker, err)
+
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// session is one broker connection: connect, publish everything retained, then publish
+// changes as they come and ping while idle.
+func (p *MQTTPublisher) session(ctx context.Context) error {
+
+	conn, err := p.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	p.mu.Lock()
+	p.stats.Connected = true
+	p.stats.Connects++
+	p.stats.LastError = ""
+	// a new connection starts from scratch, the broker may have lost the retained messages
+	p.pending = p.pending[:0]
+	for topic := range p.retained {
+		p.pending = append(p.pending, topic)
+	}
+	p.mu.Unlock()
+	log.Infof("MQTT connected to %s", p.stats.Broker)
+
+	c := newMQTTConn(conn)
+	go c.readLoop()
+
+	if err := c.publish(p.prefix+"/status", "online", p.qos); err != nil {
+		return err
+	}
+	if err := p.flush(c); err != nil {
+		return err
+	}
+
+	ping := p.keepalive
+	if ping <= 0 {
+		ping = time.Hour
+	}
+	ticker := time.NewTicker(ping / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// a clean disconnect does not trigger the last will, so say it ourselves.
+			// QoS 0 does not hold up the shutdown, the broker handles it before the DISCONNECT.
+			c.publish(p.prefix+"/status", "offline", 0)
+			c.write([]byte{mqttDisconnect << 4, 0})
+			return nil
+		case err := <-c.closed:
+			return err
+		case <-p.signal:
+			if err := p.flush(c); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if time.Since(c.lastWrite()) < ping/2 {
+				continue
+			}
+			if err := c.ping(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// flush publishes the pending topics, a topic stays pending until the broker has it.
+func (p *MQTTPublisher) flush(c *mqttConn) error {
+	for {
+		p.mu.Lock()
+		if len(p.pending) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		topic := p.pending[0]
+		payload := p.retained[topic]
+		p.mu.Unlock()
+
+		if err := c.publish(topic, payload, p.qos); err != nil {
+			return err
+		}
+
+		p.mu.Lock()
+		// the topic may have been queued again meanwhile, then it is no longer first
+		if len(p.pending) > 0 && p.pending[0] == topic && p.retained[topic] == payload {
+			p.pending = p.pending[1:]
+		}
+		p.stats.Published++
+		p.mu.Unlock()
+	}
+}
+
+// connect dials the broker and completes the MQTT CONNECT handshake.
+func (p *MQTTPublisher) connect(ctx context.Context) (net.Conn, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	var conn net.Conn
+	var err error
+	if p.tlsConfig != nil {
+		dialer := &tls.Dialer{Config: p.tlsConfig}
+		conn, err = dialer.DialContext(ctx, "tcp", p.broker.Host)
+	} else {
+		dialer := &net.Dialer{}
+		conn, err = dialer.DialContext(ctx, "tcp", p.broker.Host)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connect %w", err)
+	}
+
+	// variable header: protocol name and level, flags, keep alive
+	flags := byte(0x02) // clean session
+	flags |= 0x04 | p.qos<<3 | 0x20
+	payload := mqttString(p.clientID)
+	payload = append(payload, mqttString(p.prefix+"/status")...)
+	payload = append(payload, mqttString("offline")...)
+	if p.user != "" {
+		flags |= 0x80
+		payload = append(payload, mqttString(p.user)...)
+		if p.passwd != "" {
+			flags |= 0x40
+			payload = append(payload, mqttString(p.passwd)...)
+		}
+	}
+	body := append(mqttString("MQTT"), 4, flags, 0, 0)
+	binary.BigEndian.PutUint16(body[len(body)-2:], uint16(p.keepalive/time.Second))
+	body = append(body, payload...)
+
+	conn.SetDeadline(time.Now().Add(mqttAckTimeout))
+	if _, err := conn.Write(mqttPacket(mqttConnect<<4, body)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("connect %w", err)
+	}
+	typ, ack, err := readMQTTPacket(bufio.NewReader(conn))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("connack %w", err)
+	}
+	if typ>>4 != mqttConnack || len(ack) != 2 {
+		conn.Close()
+		return nil, fmt.Errorf("connack: unexpected packet type %d", typ>>4)
+	}
+	if ack[1] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("connection refused: %s", mqttConnackReason(ack[1]))
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func mqttConnackReason(code byte) string {
+	switch code {
+	case 1:
+		return "unacceptable protocol version"
+	case 2:
+		return "identifier rejected"
+	case 3:
+		return "server unavailable"
+	case 4:
+		return "bad user name or password"
+	case 5:
+		return "not authorized"
+	default:
+		return fmt.Sprintf("return code %d", code)
+	}
+}
+
+// mqttConn is an established broker connection. The read loop hands acknowledgements
+// to the writer, which sends one packet at a time.
+type mqttConn struct {
+	conn     net.Conn
+	acks     chan uint16
+	pongs    chan struct{}
+	closed   chan error
+	packetID uint16
+
+	mu      sync.Mutex
+	written time.Time
+}
+
+func newMQTTConn(conn net.Conn) *mqttConn {
+	return &mqttConn{
+		conn:    conn,
+		acks:    make(chan uint16, 16),
+		pongs:   make(chan struct{}, 1),
+		closed:  make(chan error, 1),
+		written: time.Now(),
+	}
+}
+
+func (c *mqttConn) readLoop() {
+	r := bufio.NewReader(c.conn)
+	for {
+		typ, body, err := readMQTTPacket(r)
+		if err != nil {
+			c.closed <- fmt.Errorf("read %w", err)
+			return
+		}
+		switch typ >> 4 {
+		case mqttPuback:
+			if len(body) == 2 {
+				select {
+				case c.acks <- binary.BigEndian.Uint16(body):
+				default: // nobody waits for it any more
+				}
+			}
+		case mqttPingresp:
+			select {
+			case c.pongs <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (c *mqttConn) write(packet []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(mqttAckTimeout))
+	if _, err := c.conn.Write(packet); err != nil {
+		return fmt.Errorf("write %w", err)
+	}
+	c.mu.Lock()
+	c.written = time.Now()
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *mqttConn) lastWrite() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.written
+}
+
+// publish sends a retained message, for QoS 1 it waits for the PUBACK.
+func (c *mqttConn) publish(topic string, payload string, qos byte) error {
+
+	body := mqttString(topic)
+	var id uint16
+	if qos > 0 {
+		c.packetID++
+		if c.packetID == 0 {
+			c.packetID = 1
+		}
+		id = c.packetID
+		body = binary.BigEndian.AppendUint16(body, id)
+	}
+	body = append(body, payload...)
+	if err := c.write(mqttPacket(mqttPublish<<4|qos<<1|1, body)); err != nil {
+		return err
+	}
+	if qos == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(mqttAckTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case ack := <-c.acks:
+			if ack == id {
+				return nil
+			}
+		case err := <-c.closed:
+			c.closed <- err
+			return err
+		case <-timer.C:
+			return fmt.Errorf("publish %s: no PUBACK within %s", topic, mqttAckTimeout)
+		}
+	}
+}
+
+func (c *mqttConn) ping() error {
+	if err := c.write([]byte{mqttPingreq << 4, 0}); err != nil {
+		return err
+	}
+	select {
+	case <-c.pongs:
+		return nil
+	case err := <-c.closed:
+		c.closed <- err
+		return err
+	case <-time.After(mqttAckTimeout):
+		return errors.New("no PINGRESP from broker")
+	}
+}
+
+// mqttString is a length prefixed UTF-8 string.
+func mqttString(s string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)
+}
+
+// mqttPacket prepends the fixed header to body.
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// readMQTTPacket returns the first header byte and the rest of the packet.
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		shift += 7
+		if shift > 21 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
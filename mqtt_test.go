@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// mqttPacketSeen is a packet the broker stand-in received.
+type mqttPacketSeen struct {
+	conn   int // connection number, from 1
+	header byte
+	body   []byte
+}
+
+// mqttPublishSeen is a decoded PUBLISH.
+type mqttPublishSeen struct {
+	topic    string
+	payload  string
+	qos      byte
+	retained bool
+	id       uint16
+}
+
+func (p *mqttPacketSeen) publish(t *testing.T) mqttPublishSeen {
+	t.Helper()
+	if p.header>>4 != mqttPublish {
+		t.Fatalf("packet type %d, want PUBLISH", p.header>>4)
+	}
+	n := int(binary.BigEndian.Uint16(p.body))
+	pub := mqttPublishSeen{
+		topic:    string(p.body[2 : 2+n]),
+		qos:      p.header >> 1 & 3,
+		retained: p.header&1 == 1,
+	}
+	rest := p.body[2+n:]
+	if pub.qos > 0 {
+		pub.id = binary.BigEndian.Uint16(rest)
+		rest = rest[2:]
+	}
+	pub.payload = string(rest)
+	return pub
+}
+
+// mqttBroker is a broker stand-in: it accepts connections, answers CONNECT, QoS 1 PUBLISH
+// and PINGREQ, and hands every packet to the test.
+type mqttBroker struct {
+	ln      net.Listener
+	packets chan *mqttPacketSeen
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newMQTTBroker(t *testing.T) *mqttBroker {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &mqttBroker{ln: ln, packets: make(chan *mqttPacketSeen, 100)}
+	t.Cleanup(func() {
+		ln.Close()
+		b.dropConnections()
+	})
+	go b.accept()
+	return b
+}
+
+func (b *mqttBroker) accept() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		b.conns = append(b.conns, conn)
+		n := len(b.conns)
+		b.mu.Unlock()
+		go b.serve(n, conn)
+	}
+}
+
+func (b *mqttBroker) serve(n int, conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		header, body, err := readMQTTPacket(r)
+		if err != nil {
+			return
+		}
+		b.packets <- &mqttPacketSeen{conn: n, header: header, body: body}
+		switch header >> 4 {
+		case mqttConnect:
+			conn.Write([]byte{mqttConnack << 4, 2, 0, 0})
+		case mqttPublish:
+			if header>>1&3 == 1 {
+				n := int(binary.BigEndian.Uint16(body))
+				conn.Write(mqttPacket(mqttPuback<<4, body[2+n:4+n]))
+			}
+		case mqttPingreq:
+			conn.Write([]byte{mqttPingresp << 4, 0})
+		}
+	}
+}
+
+func (b *mqttBroker) dropConnections() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, conn := range b.conns {
+		conn.Close()
+	}
+}
+
+func (b *mqttBroker) next(t *testing.T) *mqttPacketSeen {
+	t.Helper()
+	select {
+	case p := <-b.packets:
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatal("no packet from the publisher")
+		return nil
+	}
+}
+
+// publishes reads n PUBLISH packets, by topic.
+func (b *mqttBroker) publishes(t *testing.T, n int) map[string]mqttPublishSeen {
+	t.Helper()
+	seen := map[string]mqttPublishSeen{}
+	for len(seen) < n {
+		pub := b.next(t).publish(t)
+		seen[pub.topic] = pub
+	}
+	return seen
+}
+
+func TestMQTTPublisher(t *testing.T) {
+
+	broker := newMQTTBroker(t)
+	config := viper.New()
+	config.Set("mqtt_broker", "tcp://"+broker.ln.Addr().String())
+	config.Set("mqtt_client_id", "test-client")
+	config.Set("mqtt_topic_prefix", "test/")
+	config.Set("mqtt_keepalive", "30s")
+	p, err := NewMQTTPublisher(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// queued before the connection, like the first tracker update
+	p.Publish([]*SystemChange{{
+		First:  true,
+		System: &QuickMgms{HMC: "HMC1", SysName: "P10/a", State: "operating", LED: true, RefCode: "B7001234"},
+	}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go p.Run(ctx, &wg)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	// CONNECT: MQTT 3.1.1, clean session, retained QoS 1 last will, keep alive
+	connect := broker.next(t)
+	if connect.header>>4 != mqttConnect {
+		t.Fatalf("first packet type %d, want CONNECT", connect.header>>4)
+	}
+	r := bytes.NewReader(connect.body)
+	var head struct {
+		NameLen   uint16
+		Name      [4]byte
+		Level     byte
+		Flags     byte
+		KeepAlive uint16
+	}
+	if err := binary.Read(r, binary.BigEndian, &head); err != nil {
+		t.Fatal(err)
+	}
+	if string(head.Name[:]) != "MQTT" || head.Level != 4 {
+		t.Errorf("protocol %q level %d, want MQTT 4", head.Name, head.Level)
+	}
+	if head.Flags != 0x02|0x04|1<<3|0x20 {
+		t.Errorf("connect flags %#x", head.Flags)
+	}
+	if head.KeepAlive != 30 {
+		t.Errorf("keep alive %d, want 30", head.KeepAlive)
+	}
+	if !bytes.Contains(connect.body, []byte("test-client")) || !bytes.Contains(connect.body, []byte("test/status")) {
+		t.Errorf("connect payload %q lacks the client id or the will topic", connect.body)
+	}
+
+	want := map[string]string{
+		"test/status":             "online",
+		"test/HMC1/P10_a/led":     "on",
+		"test/HMC1/P10_a/state":   "operating",
+		"test/HMC1/P10_a/refcode": "B7001234",
+	}
+	seen := broker.publishes(t, len(want))
+	for topic, payload := range want {
+		pub, ok := seen[topic]
+		if !ok {
+			t.Errorf("%s not published", topic)
+			continue
+		}
+		if pub.payload != payload || !pub.retained || pub.qos != 1 || pub.id == 0 {
+			t.Errorf("%s: %+v, want %q retained QoS 1 with a packet id", topic, pub, payload)
+		}
+	}
+
+	// a change publishes only what changed, once the broker acknowledged the rest
+	p.Publish([]*SystemChange{{
+		System: &QuickMgms{HMC: "HMC1", SysName: "P10/a", State: "operating", LED: false, RefCode: "B7001234"},
+	}})
+	if pub := broker.next(t).publish(t); pub.topic != "test/HMC1/P10_a/led" || pub.payload != "off" {
+		t.Errorf("change published %+v, want led off", pub)
+	}
+	waitFor(t, func() bool {
+		stats := p.Stats()
+		return stats.Published == 4 && stats.Pending == 0 // the status is not counted
+	})
+
+	// after a lost connection the publisher connects again and publishes everything again
+	broker.dropConnections()
+	reconnect := broker.next(t)
+	if reconnect.header>>4 != mqttConnect || reconnect.conn != 2 {
+		t.Fatalf("packet type %d on connection %d, want CONNECT on connection 2", reconnect.header>>4, reconnect.conn)
+	}
+	want["test/HMC1/P10_a/led"] = "off"
+	seen = broker.publishes(t, len(want))
+	for topic, payload := range want {
+		if seen[topic].payload != payload {
+			t.Errorf("after reconnect %s: %q, want %q", topic, seen[topic].payload, payload)
+		}
+	}
+	waitFor(t, func() bool { return p.Stats().Connects == 2 })
+}
+
+func TestMQTTPacketLength(t *testing.T) {
+	for _, n := range []int{0, 127, 128, 16383, 16384, 2097152} {
+		body := bytes.Repeat([]byte{'x'}, n)
+		header, got, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(mqttPacket(mqttPublish<<4, body))))
+		if err != nil {
+			t.Fatalf("length %d: %s", n, err)
+		}
+		if header != mqttPublish<<4 || len(got) != n {
+			t.Errorf("length %d: header %#x, %d bytes", n, header, len(got))
+		}
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 5s")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Notifier delivers notifications to one destination. Notify must not block, a notifier
+// queues what it can not deliver at once and delivers it in Run.
+type Notifier interface {
+	Notify(ev *Notification)
+	Run(ctx context.Context, wg *sync.WaitGroup)
+	Stats() interface{}
+}
+
+// NotifierDeps is what notifiers may need from the rest of hmc_led.
+type NotifierDeps struct {
+	// Collect retrieves the managed systems of all HMCs
+	Collect func(ctx context.Context) (*RespJson, error)
+}
+
+// NotifierFactory builds a notifier of one type from its configuration,
+// nil without error when the configuration does not ask for one.
+type NotifierFactory func(config *viper.Viper, deps *NotifierDeps) (Notifier, error)
+
+var notifierFactories = map[string]NotifierFactory{}
+
+// legacyNotifiers are configured by top level keys, as before the notifiers list.
+var legacyNotifiers = []string{"syslog", "snmp", "smtp"}
+
+// RegisterNotifier makes a notifier type available to the notifiers configuration.
+func RegisterNotifier(typ string, factory NotifierFactory) {
+	notifierFactories[typ] = factory
+}
+
+// NotifyRoute sends the notifications matching Events, HMC, Systems, and for alerts Severities
+// and Labels, to Notifiers. Empty fields match everything, Systems are path.Match patterns
+// over the system name.
+type NotifyRoute struct {
+	Notifiers  []string          `mapstructure:"notifiers"`
+	Events     []string          `mapstructure:"events"`
+	HMC        string            `mapstructure:"hmc"`
+	Systems    []string          `mapstructure:"systems"`
+	Severities []string          `mapstructure:"severities"`
+	Labels     map[string]string `mapstructure:"labels"`
+}
+
+func (route *NotifyRoute) matches(ev *Notification) bool {
+	if len(route.Events) > 0 {
+		found := false
+		for _, kind := range route.Events {
+			found = found || kind == ev.Kind
+		}
+		if !found {
+			return false
+		}
+	}
+	if route.HMC != "" && route.HMC != ev.HMC {
+		return false
+	}
+	if len(route.Severities) > 0 {
+		found := false
+		for _, severity := range route.Severities {
+			found = found || severity == ev.Severity
+		}
+		if !found {
+			return false
+		}
+	}
+	for name, value := range route.Labels {
+		if ev.Labels[name] != value {
+			return false
+		}
+	}
+	if len(route.Systems) == 0 {
+		return true
+	}
+	for _, pattern := range route.Systems {
+		if ok, _ := path.Match(pattern, ev.System); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type namedNotifier struct {
+	name     string
+	typ      string
+	notifier Notifier
+	routed   bool // named by a route, gets only the routed notifications
+}
+
+// NotifierStatus is one notifier in /status.
+type NotifierStatus struct {
+	Name  string      `json:"name" yaml:"name" xml:"name"`
+	Type  string      `json:"type" yaml:"type" xml:"type"`
+	Stats interface{} `json:"stats" yaml:"stats" xml:"stats"`
+}
+
+// Notifiers routes the notifications to the configured notifiers. A notifier not named
+// by any route gets all notifications.
+type Notifiers struct {
+	list   []*namedNotifier
+	routes []*NotifyRoute
+}
+
+// NewNotifiers builds the notifiers of the top level syslog, snmp and smtp keys, named after
+// their type, and those of the "notifiers" list, each entry the top level configuration
+// overridden by the entry's keys, with a unique name and a type.
+func NewNotifiers(config *viper.Viper, deps *NotifierDeps) (*Notifiers, error) {
+
+	n := &Notifiers{}
+	names := map[string]bool{}
+	add := func(name string, typ string, c *viper.Viper) error {
+		factory, exists := notifierFactories[typ]
+		if !exists {
+			return fmt.Errorf("notifier %s: unknown type %s, known are %s", name, typ, strings.Join(notifierTypes(), ", "))
+		}
+		notifier, err := factory(c, deps)
+		if err != nil {
+			return fmt.Errorf("notifier %s: %w", name, err)
+		}
+		if notifier == nil {
+			return nil
+		}
+		if names[name] {
+			return fmt.Errorf("notifier name %s is not unique", name)
+		}
+		names[name] = true
+		n.list = append(n.list, &namedNotifier{name: name, typ: typ, notifier: notifier})
+		return nil
+	}
+
+	for _, typ := range legacyNotifiers {
+		if err := add(typ, typ, config); err != nil {
+			return nil, err
+		}
+	}
+
+	var entries []map[string]interface{}
+	if err := config.UnmarshalKey("notifiers", &entries); err != nil {
+		return nil, fmt.Errorf("notifiers %w", err)
+	}
+	for i, entry := range entries {
+		c := subConfig(config, entry, "notifiers")
+		name, typ := c.GetString("name"), c.GetString("type")
+		if name == "" || typ == "" {
+			return nil, fmt.Errorf("notifiers[%d]: name and type are required", i)
+		}
+		before := len(n.list)
+		if err := add(name, typ, c); err != nil {
+			return nil, err
+		}
+		if len(n.list) == before {
+			return nil, fmt.Errorf("notifier %s: %s configuration is incomplete", name, typ)
+		}
+	}
+
+	if err := config.UnmarshalKey("notify_routes", &n.routes); err != nil {
+		return nil, fmt.Errorf("notify_routes %w", err)
+	}
+	for i, route := range n.routes {
+		if len(route.Notifiers) == 0 {
+			return nil, fmt.Errorf("notify_routes[%d]: notifiers are missing", i)
+		}
+		for _, name := range route.Notifiers {
+			nn := n.get(name)
+			if nn == nil {
+				return nil, fmt.Errorf("notify_routes[%d]: notifier %s is not configured", i, name)
+			}
+			nn.routed = true
+		}
+	}
+	for _, nn := range n.list {
+		if nn.routed {
+			log.Infof("Notifier %s (%s), routed", nn.name, nn.typ)
+		} else {
+			log.Infof("Notifier %s (%s), all notifications", nn.name, nn.typ)
+		}
+	}
+	return n, nil
+}
+
+// subConfig is the configuration without key, overridden by entry.
+func subConfig(config *viper.Viper, entry map[string]interface{}, key string) *viper.Viper {
+	c := viper.New()
+	for _, k := range config.AllKeys() {
+		if k != key && !strings.HasPrefix(k, key+".") {
+			c.Set(k, config.Get(k))
+		}
+	}
+	for k, value := range entry {
+		c.Set(strings.ToLower(k), value)
+	}
+	return c
+}
+
+func (n *Notifiers) get(name string) *namedNotifier {
+	for _, nn := range n.list {
+		if nn.name == name {
+			return nn
+		}
+	}
+	return nil
+}
+
+// Dispatch hands ev to the notifiers it is routed to, it is a Notifications subscriber.
+func (n *Notifiers) Dispatch(ev *Notification) {
+
+	routed := map[string]bool{}
+	for _, route := range n.routes {
+		if route.matches(ev) {
+			for _, name := range route.Notifiers {
+				routed[name] = true
+			}
+		}
+	}
+	for _, nn := range n.list {
+		if !nn.routed || routed[nn.name] {
+			nn.notifier.Notify(ev)
+		}
+	}
+}
+
+// Run runs every notifier until ctx is done.
+func (n *Notifiers) Run(ctx context.Context, wg *sync.WaitGroup) {
+	for _, nn := range n.list {
+		wg.Add(1)
+		go nn.notifier.Run(ctx, wg)
+	}
+}
+
+func (n *Notifiers) Stats() []*NotifierStatus {
+	stats := []*NotifierStatus{}
+	for _, nn := range n.list {
+		stats = append(stats, &NotifierStatus{Name: nn.name, Type: nn.typ, Stats: nn.notifier.Stats()})
+	}
+	return stats
+}
+
+// Types are the registered notifier types, for messages.
+func notifierTypes() []string {
+	types := []string{}
+	for typ := range notifierFactories {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// messageTemplate parses the text/template of key, nil when it is not set.
+// The template gets the Notification.
+func messageTemplate(config *viper.Viper, key string) (*texttemplate.Template, error) {
+	text := config.GetString(key)
+	if text == "" {
+		return nil, nil
+	}
+	tmpl, err := texttemplate.New(key).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("%s %w", key, err)
+	}
+	return tmpl, nil
+}
+
+// render is the notification message, formatted by tmpl when there is one.
+// A failing template falls back to the plain message.
+func (ev *Notification) render(tmpl *texttemplate.Template) string {
+	if tmpl == nil {
+		return ev.Message
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, ev); err != nil {
+		log.Warnf("Notification template %s: %s", tmpl.Name(), err)
+		return ev.Message
+	}
+	return b.String()
+}
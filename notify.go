@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Notification kinds
+const (
+	notifyLEDOn        = "led_on"
+	notifyLEDOff       = "led_off"
+	notifyState        = "state_change"
+	notifyRefCode      = "refcode_change"
+	notifyLogonFailure = "logon_failure"
+	notifyAuthFailure  = "auth_failure"
+	notifyAlertFiring  = "alert_firing"
+	notifyAlertResolve = "alert_resolved"
+)
+
+// Notification is something an operator or a SIEM should hear about.
+type Notification struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Message string    `json:"message"`
+	// managed system notifications
+	HMC      string     `json:"hmc,omitempty"`
+	System   string     `json:"system,omitempty"`
+	UUID     string     `json:"uuid,omitempty"`
+	MTMS     string     `json:"mtms,omitempty"`
+	RefCode  string     `json:"refcode,omitempty"`
+	Location string     `json:"location,omitempty"`
+	Old      string     `json:"old,omitempty"`
+	New      string     `json:"new,omitempty"`
+	Mgms     *QuickMgms `json:"system_data,omitempty"` // the system as collected
+	// authentication failures
+	Client string `json:"client,omitempty"`
+	User   string `json:"user,omitempty"`
+	// alerts
+	Rule     string            `json:"rule,omitempty"`
+	Severity string            `json:"severity,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// Notifications hands every notification to the subscribed outputs.
+// A nil *Notifications drops them, so producers need not check.
+type Notifications struct {
+	mu       sync.RWMutex
+	sinks    []func(*Notification)
+	silences *SilenceStore
+}
+
+func NewNotifications() *Notifications {
+	return &Notifications{}
+}
+
+// Subscribe registers fn, which must not block.
+func (n *Notifications) Subscribe(fn func(*Notification)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sinks = append(n.sinks, fn)
+}
+
+// SetSilences mutes the notifications matched by an active silence.
+func (n *Notifications) SetSilences(silences *SilenceStore) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.silences = silences
+}
+
+func (n *Notifications) Notify(ev *Notification) {
+	if n == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if s := n.silences.Notification(ev); s != nil {
+		log.Debugf("Notification %s of %s %s silenced by %s", ev.Kind, ev.HMC, ev.System, s.ID)
+		return
+	}
+	for _, fn := range n.sinks {
+		fn(ev)
+	}
+}
+
+// SystemChanges turns tracker changes into LED, state and reference code notifications, it is
+// a SystemTracker subscriber. A system seen for the first time only notifies a lit LED. A new
+// reference code is notified while the LED stays lit, not the progress codes of a starting system.
+func (n *Notifications) SystemChanges(changes []*SystemChange) {
+
+	for _, change := range changes {
+		system := change.System
+		ev := Notification{
+			HMC:      system.HMC,
+			System:   system.SysName,
+			UUID:     system.UUID,
+			MTMS:     system.MTMS,
+			RefCode:  system.RefCode,
+			Location: system.Location,
+			Mgms:     system,
+		}
+		if system.LED != change.PrevLED && (system.LED || !change.First) {
+			led := ev
+			led.Kind, led.Old, led.New = notifyLEDOff, "on", "off"
+			if system.LED {
+				led.Kind, led.Old, led.New = notifyLEDOn, "off", "on"
+			}
+			if change.First {
+				led.Old = ""
+			}
+			led.Message = fmt.Sprintf("System %s attention LED %s, reference code %s", system.SysName, led.New, system.RefCode)
+			n.Notify(&led)
+		}
+		if !change.First && system.State != change.PrevState {
+			state := ev
+			state.Kind, state.Old, state.New = notifyState, change.PrevState, system.State
+			state.Message = fmt.Sprintf("System %s state %s -> %s", system.SysName, change.PrevState, system.State)
+			n.Notify(&state)
+		}
+		if !change.First && system.LED && change.PrevLED && system.RefCode != change.PrevRefCode {
+			refCode := ev
+			refCode.Kind, refCode.Old, refCode.New = notifyRefCode, change.PrevRefCode, system.RefCode
+			refCode.Message = fmt.Sprintf("System %s reference code %s -> %s", system.SysName, change.PrevRefCode, system.RefCode)
+			n.Notify(&refCode)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Partition is a logical partition or Virtual I/O Server of a managed system.
+type Partition struct {
+	UUID       string `json:"uuid" yaml:"uuid" xml:"uuid"`
+	Name       string `json:"name" yaml:"name" xml:"name"`
+	ID         int    `json:"id" yaml:"id" xml:"id"`
+	Type       string `json:"type" yaml:"type" xml:"type"`
+	State      string `json:"state" yaml:"state" xml:"state"`
+	RefCode    string `json:"rfc" yaml:"rfc" xml:"rfc"`
+	RMC        string `json:"rmc" yaml:"rmc" xml:"rmc"`
+	OSVersion  string `json:"os_version" yaml:"os_version" xml:"os_version"`
+	SystemUUID string `json:"system_uuid" yaml:"system_uuid" xml:"system_uuid"`
+	SystemName string `json:"systemname" yaml:"systemname" xml:"systemname"`
+	HMC        string `json:"hmc" yaml:"hmc" xml:"hmc"`
+}
+
+// PartitionsResponse is the /partitions and /systems/{uuid}/partitions response.
+type PartitionsResponse struct {
+	XMLName    xml.Name     `json:"-" yaml:"-" xml:"partitions"`
+	HMC        string       `json:"hmc" yaml:"hmc" xml:"hmc"`
+	Partitions []*Partition `json:"partitions" yaml:"partitions" xml:"partition"`
+}
+
+// partitionXML is the subset of LogicalPartition and VirtualIOServer we need from the full feed.
+type partitionXML struct {
+	UUID      string `xml:"PartitionUUID"`
+	Name      string `xml:"PartitionName"`
+	ID        int    `xml:"PartitionID"`
+	Type      string `xml:"PartitionType"`
+	State     string `xml:"PartitionState"`
+	RefCode   string `xml:"ReferenceCode"`
+	RMC       string `xml:"ResourceMonitoringControlState"`
+	OSVersion string `xml:"OperatingSystemVersion"`
+}
+
+type partitionFeed struct {
+	Entries []struct {
+		LPAR *partitionXML `xml:"content>LogicalPartition"`
+		VIOS *partitionXML `xml:"content>VirtualIOServer"`
+	} `xml:"entry"`
+}
+
+// GetPartitions returns the logical partitions and VIOS of a managed system. The quick API is
+// used first, the full LogicalPartition/VirtualIOServer feeds if the HMC does not offer it.
+func (hmc *HMC) GetPartitions(ctx context.Context, system *QuickMgms) ([]*Partition, error) {
+
+	myname := "GetPartitions"
+	logger := ctxLogger(ctx)
+	partitions := []*Partition{}
+
+	for _, kind := range []string{"LogicalPartition", "VirtualIOServer"} {
+		hmc.stats.partition_requests.Add(1)
+
+		url := hmc.apiURL("/rest/api/uom/ManagedSystem/" + system.UUID + "/" + kind)
+		list, err := hmc.getPartitionsQuick(ctx, url+"/quick/All")
+		if err != nil {
+			logger.Debugf("%s. %s quick: %s. Trying full feed.", myname, kind, err)
+			list, err = hmc.getPartitionsFeed(ctx, url)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s %s %s: %w", myname, system.UUID, kind, err)
+		}
+		for _, p := range list {
+			p.SystemUUID = system.UUID
+			p.SystemName = system.SysName
+			p.HMC = hmc.hmcName
+		}
+		partitions = append(partitions, list...)
+	}
+	return partitions, nil
+}
+
+func (hmc *HMC) getPartitionsQuick(ctx context.Context, url string) ([]*Partition, error) {
+
+	data, err := hmc.GetInfoByUrl(ctx, url, map[string]string{})
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return []*Partition{}, nil
+	}
+	list := []map[string]interface{}{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("unmarshal error: %w", err)
+	}
+
+	partitions := []*Partition{}
+	for _, m := range list {
+		p := &Partition{
+			UUID:      assertString(m["UUID"]),
+			Name:      assertString(m["PartitionName"]),
+			State:     assertString(m["PartitionState"]),
+			RefCode:   assertString(m["ReferenceCode"]),
+			RMC:       assertString(m["RMCState"]),
+			OSVersion: assertString(m["OperatingSystemVersion"]),
+		}
+		if p.UUID == "" {
+			p.UUID = assertString(m["PartitionUUID"])
+		}
+		if p.RMC == "" {
+			p.RMC = assertString(m["ResourceMonitoringControlState"])
+		}
+		switch id := m["PartitionID"].(type) {
+		case float64:
+			p.ID = int(id)
+		case string:
+			p.ID, _ = strconv.Atoi(id)
+		}
+		p.Type = partitionType(assertString(m["PartitionType"]), p.OSVersion)
+		partitions = append(partitions, p)
+	}
+	return partitions, nil
+}
+
+func (hmc *HMC) getPartitionsFeed(ctx context.Context, url string) ([]*Partition, error) {
+
+	data, err := hmc.GetInfoByUrl(ctx, url, map[string]string{})
+	if err != nil {
+		return nil, err
+	}
+	partitions := []*Partition{}
+	if len(data) == 0 {
+		return partitions, nil
+	}
+	feed := &partitionFeed{}
+	if err := xml.Unmarshal(data, feed); err != nil {
+		return nil, fmt.Errorf("unmarshal error: %w", err)
+	}
+	for _, entry := range feed.Entries {
+		px := entry.LPAR
+		if px == nil {
+			px = entry.VIOS
+		}
+		if px == nil {
+			continue
+		}
+		partitions = append(partitions, &Partition{
+			UUID:      px.UUID,
+			Name:      px.Name,
+			ID:        px.ID,
+			Type:      partitionType(px.Type, px.OSVersion),
+			State:     px.State,
+			RefCode:   px.RefCode,
+			RMC:       px.RMC,
+			OSVersion: px.OSVersion,
+		})
+	}
+	return partitions, nil
+}
+
+// partitionType maps the HMC PartitionType to AIX, Linux, IBMi or VIOS.
+// AIX and Linux share a type on the HMC, the OS version tells them apart when RMC reports it.
+func partitionType(hmcType string, osVersion string) string {
+	switch strings.ToLower(hmcType) {
+	case "os400":
+		return "IBMi"
+	case "virtual io server", "virtualioserver":
+		return "VIOS"
+	case "aix/linux", "aixlinux":
+		os := strings.ToLower(osVersion)
+		switch {
+		case strings.HasPrefix(os, "aix"):
+			return "AIX"
+		case strings.HasPrefix(os, "linux"):
+			return "Linux"
+		}
+		return "AIX/Linux"
+	}
+	return hmcType
+}
+
+// MarshalCSV renders one row per partition.
+func (resp *PartitionsResponse) MarshalCSV() [][]string {
+	records := [][]string{
+		{"hmc", "system_uuid", "systemname", "uuid", "name", "id", "type", "state", "rfc", "rmc", "os_version"},
+	}
+	for _, p := range resp.Partitions {
+		records = append(records, []string{
+			p.HMC, p.SystemUUID, p.SystemName, p.UUID, p.Name, strconv.Itoa(p.ID),
+			p.Type, p.State, p.RefCode, p.RMC, p.OSVersion,
+		})
+	}
+	return records
+}
+
+// WritePrometheus renders the partition states in the Prometheus text exposition format.
+func (resp *PartitionsResponse) WritePrometheus(w io.Writer) {
+	fmt.Fprintln(w, "# HELP hmc_led_partition_info Logical partition state, reference code and RMC connectivity.")
+	fmt.Fprintln(w, "# TYPE hmc_led_partition_info gauge")
+	for _, p := range resp.Partitions {
+		fmt.Fprintf(w, "hmc_led_partition_info{hmc=%s,systemname=%s,partition=%s,id=\"%d\",type=%s,state=%s,rfc=%s,rmc=%s} 1\n",
+			promQuote(p.HMC), promQuote(p.SystemName), promQuote(p.Name), p.ID,
+			promQuote(p.Type), promQuote(p.State), promQuote(p.RefCode), promQuote(p.RMC))
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// errPCMDisabled is returned when PCM aggregation is off for a system and may not be enabled.
+var errPCMDisabled = errors.New("PCM aggregation is not enabled for the managed system")
+
+// SystemMetrics are frame level utilization values from the HMC PCM ProcessedMetrics.
+// Values the system does not report, typically energy and temperatures, are omitted.
+type SystemMetrics struct {
+	HMC                string   `json:"hmc" yaml:"hmc" xml:"hmc"`
+	SystemUUID         string   `json:"system_uuid" yaml:"system_uuid" xml:"system_uuid"`
+	SystemName         string   `json:"systemname" yaml:"systemname" xml:"systemname"`
+	MTMS               string   `json:"mtms" yaml:"mtms" xml:"mtms"`
+	Timestamp          string   `json:"timestamp" yaml:"timestamp" xml:"timestamp"`
+	AggregationEnabled bool     `json:"aggregation_enabled" yaml:"aggregation_enabled" xml:"aggregation_enabled"`
+	EnergyMonitoring   bool     `json:"energy_monitoring" yaml:"energy_monitoring" xml:"energy_monitoring"`
+	CPUTotal           *float64 `json:"cpu_total_units,omitempty" yaml:"cpu_total_units,omitempty" xml:"cpu_total_units,omitempty"`
+	CPUUtilized        *float64 `json:"cpu_utilized_units,omitempty" yaml:"cpu_utilized_units,omitempty" xml:"cpu_utilized_units,omitempty"`
+	CPUAvailable       *float64 `json:"cpu_available_units,omitempty" yaml:"cpu_available_units,omitempty" xml:"cpu_available_units,omitempty"`
+	MemTotal           *float64 `json:"memory_total_mb,omitempty" yaml:"memory_total_mb,omitempty" xml:"memory_total_mb,omitempty"`
+	MemAvailable       *float64 `json:"memory_available_mb,omitempty" yaml:"memory_available_mb,omitempty" xml:"memory_available_mb,omitempty"`
+	MemAssigned        *float64 `json:"memory_assigned_mb,omitempty" yaml:"memory_assigned_mb,omitempty" xml:"memory_assigned_mb,omitempty"`
+	PowerWatts         *float64 `json:"power_watts,omitempty" yaml:"power_watts,omitempty" xml:"power_watts,omitempty"`
+	InletTemp          *float64 `json:"inlet_temperature_celsius,omitempty" yaml:"inlet_temperature_celsius,omitempty" xml:"inlet_temperature_celsius,omitempty"`
+	CPUTemp            *float64 `json:"cpu_temperature_celsius,omitempty" yaml:"cpu_temperature_celsius,omitempty" xml:"cpu_temperature_celsius,omitempty"`
+}
+
+// MetricsResponse is the /metrics and /systems/{uuid}/metrics response.
+// Prometheus text is the default format.
+type MetricsResponse struct {
+	XMLName xml.Name         `json:"-" yaml:"-" xml:"metrics"`
+	HMC     string           `json:"hmc" yaml:"hmc" xml:"hmc"`
+	Systems []*SystemMetrics `json:"systems" yaml:"systems" xml:"system"`
+}
+
+func (resp *MetricsResponse) DefaultFormat() string {
+	return formatText
+}
+
+// HMC_pcm caches the processed metrics per system, the HMC aggregates them every 30 seconds.
+type HMC_pcm struct {
+	mu                sync.Mutex
+	metrics           map[string]*pcmEntry
+	Interval          time.Duration
+	enableAggregation bool
+}
+type pcmEntry struct {
+	metrics *SystemMetrics
+	err     error // errPCMDisabled, the HMC is not asked again for the interval
+	fetched time.Time
+}
+
+// pcmPreference is the part of ManagedSystemPcmPreference we look at.
+type pcmPreference struct {
+	Aggregation     bool `xml:"entry>content>ManagedSystemPcmPreference>AggregationEnabled"`
+	LongTerm        bool `xml:"entry>content>ManagedSystemPcmPreference>LongTermMonitorEnabled"`
+	EnergyMonitor   bool `xml:"entry>content>ManagedSystemPcmPreference>EnergyMonitorEnabled"`
+	EnergyCapable   bool `xml:"entry>content>ManagedSystemPcmPreference>EnergyMonitoringCapable"`
+	ComputeLongTerm bool `xml:"entry>content>ManagedSystemPcmPreference>ComputeLTMEnabled"`
+}
+
+type pcmMetricsFeed struct {
+	Entries []struct {
+		Category struct {
+			Term string `xml:"term,attr"`
+		} `xml:"category"`
+		Link struct {
+			Href string `xml:"href,attr"`
+		} `xml:"link"`
+	} `xml:"entry"`
+}
+
+// processedMetrics is the part of the ProcessedMetrics JSON we use. Every value is a list of samples.
+type processedMetrics struct {
+	SystemUtil struct {
+		UtilSamples []struct {
+			SampleInfo struct {
+				TimeStamp string `json:"timeStamp"`
+			} `json:"sampleInfo"`
+			ServerUtil struct {
+				Processor struct {
+					TotalProcUnits     []float64 `json:"totalProcUnits"`
+					UtilizedProcUnits  []float64 `json:"utilizedProcUnits"`
+					AvailableProcUnits []float64 `json:"availableProcUnits"`
+				} `json:"processor"`
+				Memory struct {
+					TotalMem           []float64 `json:"totalMem"`
+					AvailableMem       []float64 `json:"availableMem"`
+					AssignedMemToLpars []float64 `json:"assignedMemToLpars"`
+				} `json:"memory"`
+			} `json:"serverUtil"`
+			EnergyUtil struct {
+				PowerUtil struct {
+					PowerReading []float64 `json:"powerReading"`
+				} `json:"powerUtil"`
+				ThermalUtil struct {
+					InletTemperatures []pcmTemperature `json:"inletTemperatures"`
+					CPUTemperatures   []pcmTemperature `json:"cpuTemperatures"`
+				} `json:"thermalUtil"`
+			} `json:"energyUtil"`
+		} `json:"utilSamples"`
+	} `json:"systemUtil"`
+}
+
+type pcmTemperature struct {
+	TemperatureReading []float64 `json:"temperatureReading"`
+}
+
+// GetSystemMetrics returns the latest PCM processed metrics of a managed system.
+// Aggregation is enabled on the HMC first if it is off and hmc_pcm_enable_aggregation allows it,
+// if it may not be the system is not asked again for the interval either.
+func (hmc *HMC) GetSystemMetrics(ctx context.Context, system *QuickMgms) (*SystemMetrics, error) {
+
+	pcm := hmc.pcm
+	pcm.mu.Lock()
+	entry, exists := pcm.metrics[system.UUID]
+	pcm.mu.Unlock()
+	if exists && time.Since(entry.fetched) < pcm.Interval {
+		return entry.metrics, entry.err
+	}
+
+	v, err, shared := hmc.flight.Do(ctx, "SystemMetrics "+system.UUID, func(ctx context.Context) (interface{}, error) {
+		metrics, err := hmc.fetchSystemMetrics(ctx, system)
+		if err != nil && !errors.Is(err, errPCMDisabled) {
+			return nil, err
+		}
+		pcm.mu.Lock()
+		pcm.metrics[system.UUID] = &pcmEntry{metrics: metrics, err: err, fetched: time.Now()}
+		pcm.mu.Unlock()
+		return metrics, err
+	})
+	if shared {
+		hmc.stats.coalesced_requests.Add(1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v.(*SystemMetrics), nil
+}
+
+func (hmc *HMC) fetchSystemMetrics(ctx context.Context, system *QuickMgms) (*SystemMetrics, error) {
+
+	myname := "GetSystemMetrics"
+	logger := ctxLogger(ctx)
+	hmc.stats.pcm_requests.Add(1)
+
+	pref, err := hmc.pcmEnsureAggregation(ctx, system)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", myname, system.UUID, err)
+	}
+
+	metrics := &SystemMetrics{
+		HMC:                hmc.hmcName,
+		SystemUUID:         system.UUID,
+		SystemName:         system.SysName,
+		MTMS:               system.MTMS,
+		AggregationEnabled: pref.Aggregation,
+		EnergyMonitoring:   pref.EnergyMonitor,
+	}
+
+	feedURL := hmc.apiURL("/rest/api/pcm/ManagedSystem/" + system.UUID + "/ProcessedMetrics?NoOfSamples=1")
+	data, err := hmc.GetInfoByUrl(ctx, feedURL, map[string]string{})
+	if err != nil {
+		return nil, fmt.Errorf("%s %w", myname, err)
+	}
+	if len(data) == 0 {
+		// no samples yet, e.g. right after aggregation was enabled
+		logger.Infof("%s %s: no processed metrics yet", myname, system.SysName)
+		return metrics, nil
+	}
+	feed := &pcmMetricsFeed{}
+	if err := xml.Unmarshal(data, feed); err != nil {
+		return nil, fmt.Errorf("%s %w", myname, err)
+	}
+
+	for _, entry := range feed.Entries {
+		if entry.Category.Term != "" && entry.Category.Term != "ManagedSystem" {
+			continue
+		}
+		link, err := url.Parse(entry.Link.Href)
+		if err != nil || link.Path == "" {
+			continue
+		}
+		// links carry the host name the HMC knows itself by, use the one we connect to
+		jsonURL := hmc.apiURL(link.RequestURI())
+		data, err := hmc.GetInfoByUrl(ctx, jsonURL, map[string]string{"Accept": "application/json"})
+		if err != nil {
+			return nil, fmt.Errorf("%s %w", myname, err)
+		}
+		pm := &processedMetrics{}
+		if err := json.Unmarshal(data, pm); err != nil {
+			return nil, fmt.Errorf("%s %w", myname, err)
+		}
+		metrics.fill(pm)
+		break
+	}
+	return metrics, nil
+}
+
+// pcmEnsureAggregation reads the PCM preferences of the system and enables aggregation
+// (and energy monitoring where the system is capable) if configured to.
+func (hmc *HMC) pcmEnsureAggregation(ctx context.Context, system *QuickMgms) (*pcmPreference, error) {
+
+	prefURL := hmc.apiURL("/rest/api/pcm/ManagedSystem/" + system.UUID + "/preferences")
+	data, err := hmc.GetInfoByUrl(ctx, prefURL, map[string]string{})
+	if err != nil {
+		return nil, err
+	}
+	pref := &pcmPreference{}
+	if err := xml.Unmarshal(data, pref); err != nil {
+		return nil, fmt.Errorf("PCM preferences %w", err)
+	}
+	if pref.Aggregation {
+		return pref, nil
+	}
+	if !hmc.pcm.enableAggregation {
+		return nil, errPCMDisabled
+	}
+
+	ctxLogger(ctx).Infof("HMC %s enabling PCM aggregation for %s", hmc.hmcName, system.SysName)
+	doc := setXMLElement(string(data), "AggregationEnabled", "true")
+	if pref.EnergyCapable {
+		doc = setXMLElement(doc, "EnergyMonitorEnabled", "true")
+	}
+	headers := map[string]string{"Content-Type": "application/xml"}
+	if _, err := hmc.SendByUrl(ctx, "POST", prefURL, []byte(doc), headers); err != nil {
+		return nil, fmt.Errorf("PCM enable aggregation %w", err)
+	}
+	pref.Aggregation = true
+	pref.EnergyMonitor = pref.EnergyCapable
+	return pref, nil
+}
+
+// setXMLElement replaces the text of every <name> element, keeping the document as the HMC sent it.
+func setXMLElement(doc string, name string, value string) string {
+	re := regexp.MustCompile(`(<` + name + `(?:\s[^>]*)?>)[^<]*(</` + name + `>)`)
+	return re.ReplaceAllString(doc, "${1}"+value+"${2}")
+}
+
+func (m *SystemMetrics) fill(pm *processedMetrics) {
+	samples := pm.SystemUtil.UtilSamples
+	if len(samples) == 0 {
+		return
+	}
+	s := samples[len(samples)-1]
+	m.Timestamp = s.SampleInfo.TimeStamp
+	m.CPUTotal = lastSample(s.ServerUtil.Processor.TotalProcUnits)
+	m.CPUUtilized = lastSample(s.ServerUtil.Processor.UtilizedProcUnits)
+	m.CPUAvailable = lastSample(s.ServerUtil.Processor.AvailableProcUnits)
+	m.MemTotal = lastSample(s.ServerUtil.Memory.TotalMem)
+	m.MemAvailable = lastSample(s.ServerUtil.Memory.AvailableMem)
+	m.MemAssigned = lastSample(s.ServerUtil.Memory.AssignedMemToLpars)
+	m.PowerWatts = lastSample(s.EnergyUtil.PowerUtil.PowerReading)
+	m.InletTemp = maxTemperature(s.EnergyUtil.ThermalUtil.InletTemperatures)
+	m.CPUTemp = maxTemperature(s.EnergyUtil.ThermalUtil.CPUTemperatures)
+}
+
+func lastSample(values []float64) *float64 {
+	if len(values) == 0 {
+		return nil
+	}
+	v := values[len(values)-1]
+	return &v
+}
+
+// maxTemperature is the hottest of the sensors.
+func maxTemperature(sensors []pcmTemperature) *float64 {
+	var hottest *float64
+	for _, sensor := range sensors {
+		if v := lastSample(sensor.TemperatureReading); v != nil && (hottest == nil || *v > *hottest) {
+			hottest = v
+		}
+	}
+	return hottest
+}
+
+// MarshalCSV renders one row per system.
+func (resp *MetricsResponse) MarshalCSV() [][]string {
+	records := [][]string{
+		{"hmc", "systemname", "mtms", "timestamp", "cpu_total_units", "cpu_utilized_units", "cpu_available_units",
+			"memory_total_mb", "memory_available_mb", "memory_assigned_mb", "power_watts",
+			"inlet_temperature_celsius", "cpu_temperature_celsius"},
+	}
+	for _, m := range resp.Systems {
+		records = append(records, []string{
+			m.HMC, m.SystemName, m.MTMS, m.Timestamp,
+			formatSample(m.CPUTotal), formatSample(m.CPUUtilized), formatSample(m.CPUAvailable),
+			formatSample(m.MemTotal), formatSample(m.MemAvailable), formatSample(m.MemAssigned),
+			formatSample(m.PowerWatts), formatSample(m.InletTemp), formatSample(m.CPUTemp),
+		})
+	}
+	return records
+}
+
+func formatSample(v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%g", *v)
+}
+
+// WritePrometheus renders the metrics in the Prometheus text exposition format.
+func (resp *MetricsResponse) WritePrometheus(w io.Writer) {
+	gauges := []struct {
+		name  string
+		help  string
+		value func(m *SystemMetrics) *float64
+	}{
+		{"hmc_led_cpu_total_units", "Total processor units of the managed system.", func(m *SystemMetrics) *float64 { return m.CPUTotal }},
+		{"hmc_led_cpu_utilized_units", "Utilized processor units of the managed system.", func(m *SystemMetrics) *float64 { return m.CPUUtilized }},
+		{"hmc_led_cpu_available_units", "Available processor units of the managed system.", func(m *SystemMetrics) *float64 { return m.CPUAvailable }},
+		{"hmc_led_memory_total_megabytes", "Total memory of the managed system.", func(m *SystemMetrics) *float64 { return m.MemTotal }},
+		{"hmc_led_memory_available_megabytes", "Available memory of the managed system.", func(m *SystemMetrics) *float64 { return m.MemAvailable }},
+		{"hmc_led_memory_assigned_megabytes", "Memory assigned to partitions.", func(m *SystemMetrics) *float64 { return m.MemAssigned }},
+		{"hmc_led_power_watts", "Power consumption of the managed system.", func(m *SystemMetrics) *float64 { return m.PowerWatts }},
+		{"hmc_led_inlet_temperature_celsius", "Highest inlet temperature of the managed system.", func(m *SystemMetrics) *float64 { return m.InletTemp }},
+		{"hmc_led_cpu_temperature_celsius", "Highest processor temperature of the managed system.", func(m *SystemMetrics) *float64 { return m.CPUTemp }},
+	}
+	for _, g := range gauges {
+		header := false
+		for _, m := range resp.Systems {
+			v := g.value(m)
+			if v == nil {
+				continue
+			}
+			if !header {
+				fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+				header = true
+			}
+			fmt.Fprintf(w, "%s{hmc=%s,systemname=%s,mtms=%s} %g\n",
+				g.name, promQuote(m.HMC), promQuote(m.SystemName), promQuote(m.MTMS), *v)
+		}
+	}
+	fmt.Fprintln(w, "# HELP hmc_led_pcm_aggregation_enabled PCM aggregation preference of the managed system.")
+	fmt.Fprintln(w, "# TYPE hmc_led_pcm_aggregation_enabled gauge")
+	for _, m := range resp.Systems {
+		fmt.Fprintf(w, "hmc_led_pcm_aggregation_enabled{hmc=%s,systemname=%s,mtms=%s} %d\n",
+			promQuote(m.HMC), promQuote(m.SystemName), promQuote(m.MTMS), boolToInt(m.AggregationEnabled))
+	}
+}
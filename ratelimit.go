@@ -0,0 +1,201 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// RateLimitRule is a token bucket per client identity for the routes matching Path.
+// Path is a path.Match pattern over the route template, e.g. "/systems/{uuid}/partitions".
+// Rate is in requests per second, Burst is the bucket size.
+type RateLimitRule struct {
+	Path  string  `mapstructure:"path" json:"path" yaml:"path" xml:"path"`
+	Rate  float64 `mapstructure:"rate" json:"rate" yaml:"rate" xml:"rate"`
+	Burst int     `mapstructure:"burst" json:"burst" yaml:"burst" xml:"burst"`
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter protects the HMC from request floods: rate limits per client identity
+// and route, and a global cap on concurrently served HMC backed requests.
+type RateLimiter struct {
+	mu        sync.Mutex
+	rules     []*RateLimitRule
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+
+	hmcSlots chan struct{} // nil when concurrency is not limited
+
+	rejectedRate        atomic.Int64
+	rejectedConcurrency atomic.Int64
+}
+
+// RateLimitStats is reported by /status.
+type RateLimitStats struct {
+	Rules               []*RateLimitRule `json:"rules" yaml:"rules" xml:"rule"`
+	Clients             int              `json:"clients" yaml:"clients" xml:"clients"`
+	MaxConcurrentHMC    int              `json:"max_concurrent_hmc" yaml:"max_concurrent_hmc" xml:"max_concurrent_hmc"`
+	ActiveHMC           int              `json:"active_hmc" yaml:"active_hmc" xml:"active_hmc"`
+	RejectedRate        int64            `json:"rejected_rate" yaml:"rejected_rate" xml:"rejected_rate"`
+	RejectedConcurrency int64            `json:"rejected_concurrency" yaml:"rejected_concurrency" xml:"rejected_concurrency"`
+}
+
+func NewRateLimiter(config *viper.Viper) *RateLimiter {
+
+	l := &RateLimiter{
+		rules:     []*RateLimitRule{},
+		buckets:   map[string]*tokenBucket{},
+		lastSweep: time.Now(),
+	}
+	if err := config.UnmarshalKey("srv_rate_limits", &l.rules); err != nil {
+		log.Fatalf("srv_rate_limits: %s", err)
+	}
+	for _, rule := range l.rules {
+		if rule.Rate <= 0 {
+			log.Fatalf("srv_rate_limits %s: rate must be positive", rule.Path)
+		}
+		if rule.Burst < 1 {
+			rule.Burst = 1
+		}
+		log.Infof("Srv rate limit %s: %g req/s, burst %d", rule.Path, rule.Rate, rule.Burst)
+	}
+
+	maxConcurrent := 8
+	if config.IsSet("srv_max_concurrent_hmc") {
+		maxConcurrent = config.GetInt("srv_max_concurrent_hmc")
+	}
+	if maxConcurrent > 0 {
+		l.hmcSlots = make(chan struct{}, maxConcurrent)
+	}
+	return l
+}
+
+func (l *RateLimiter) rule(route string) *RateLimitRule {
+	for _, rule := range l.rules {
+		if rule.Path == "*" || rule.Path == route {
+			return rule
+		}
+		if matched, _ := path.Match(rule.Path, route); matched {
+			return rule
+		}
+	}
+	return nil
+}
+
+// take removes a token from the bucket of key. If the bucket is empty
+// it returns the time until the next token is available.
+func (l *RateLimiter) take(key string, rule *RateLimitRule) (bool, time.Duration) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > 10*time.Minute {
+		l.sweep(now)
+	}
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &tokenBucket{tokens: float64(rule.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(rule.Burst), b.tokens+now.Sub(b.last).Seconds()*rule.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rule.Rate * float64(time.Second))
+}
+
+// sweep drops buckets idle long enough to be full again. Caller holds l.mu.
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > time.Hour {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// clientIdentity is the user verified by the auth middleware, else the client address.
+// Unverified credentials are not an identity, a client could present new ones on every request.
+func clientIdentity(r *http.Request) string {
+	info := requestInfoFrom(r.Context())
+	if info != nil && info.user != "" {
+		return "user:" + info.user
+	}
+	if info != nil {
+		return "ip:" + info.clientIP
+	}
+	return "ip:" + r.RemoteAddr
+}
+
+// Wrap applies the limits to an HMC backed handler
+func (l *RateLimiter) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		route := r.URL.Path
+		if cr := mux.CurrentRoute(r); cr != nil {
+			if tmpl, err := cr.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+
+		if rule := l.rule(route); rule != nil {
+			identity := clientIdentity(r)
+			if ok, wait := l.take(route+"|"+identity, rule); !ok {
+				l.rejectedRate.Add(1)
+				ctxLogger(r.Context()).Warnf("Srv rate limit exceeded by %s on %s", identity, route)
+				tooManyRequests(w, r, wait)
+				return
+			}
+		}
+
+		if l.hmcSlots != nil {
+			select {
+			case l.hmcSlots <- struct{}{}:
+				defer func() { <-l.hmcSlots }()
+			default:
+				l.rejectedConcurrency.Add(1)
+				ctxLogger(r.Context()).Warnf("Srv concurrent HMC requests limit (%d) reached", cap(l.hmcSlots))
+				tooManyRequests(w, r, time.Second)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	respondError(w, r, http.StatusTooManyRequests, "too many requests")
+}
+
+func (l *RateLimiter) Stats() *RateLimitStats {
+
+	l.mu.Lock()
+	clients := len(l.buckets)
+	l.mu.Unlock()
+
+	return &RateLimitStats{
+		Rules:               l.rules,
+		Clients:             clients,
+		MaxConcurrentHMC:    cap(l.hmcSlots),
+		ActiveHMC:           len(l.hmcSlots),
+		RejectedRate:        l.rejectedRate.Load(),
+		RejectedConcurrency: l.rejectedConcurrency.Load(),
+	}
+}
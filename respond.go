@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Response formats, selected with the "format" query parameter or the Accept header.
+const (
+	formatJSON = "json"
+	formatYAML = "yaml"
+	formatCSV  = "csv"
+	formatXML  = "xml"
+	formatText = "text"
+)
+
+var formatContentTypes = map[string]string{
+	formatJSON: "application/json; charset=utf-8",
+	formatYAML: "application/yaml; charset=utf-8",
+	formatCSV:  "text/csv; charset=utf-8",
+	formatXML:  "application/xml; charset=utf-8",
+	formatText: "text/plain; version=0.0.4; charset=utf-8",
+}
+
+// plainTextContentType is the text format of payloads without a Prometheus rendering.
+const plainTextContentType = "text/plain; charset=utf-8"
+
+var mediaTypeFormats = map[string]string{
+	"application/json":   formatJSON,
+	"text/json":          formatJSON,
+	"application/yaml":   formatYAML,
+	"application/x-yaml": formatYAML,
+	"text/yaml":          formatYAML,
+	"text/x-yaml":        formatYAML,
+	"text/csv":           formatCSV,
+	"application/csv":    formatCSV,
+	"application/xml":    formatXML,
+	"text/xml":           formatXML,
+	"text/plain":         formatText,
+}
+
+// csvMarshaler is implemented by payloads with a tabular representation.
+// The first record is the header.
+type csvMarshaler interface {
+	MarshalCSV() [][]string
+}
+
+// promMarshaler is implemented by payloads with a Prometheus text representation.
+type promMarshaler interface {
+	WritePrometheus(w io.Writer)
+}
+
+// defaultFormatter is implemented by payloads preferring another format than JSON
+// when the client accepts anything.
+type defaultFormatter interface {
+	DefaultFormat() string
+}
+
+// rawXML is a payload that is already XML encoded, e.g. passed through from the HMC.
+// For any other format the decoded value is rendered instead.
+type rawXML struct {
+	data    []byte
+	decoded interface{}
+}
+
+func (raw rawXML) DefaultFormat() string {
+	return formatXML
+}
+
+type errorResponse struct {
+	XMLName xml.Name `json:"-" yaml:"-" xml:"error"`
+	Result  string   `json:"result" yaml:"result" xml:"result"`
+}
+
+// negotiateFormat picks the response format. An explicit "format" query parameter wins,
+// otherwise the Accept header is matched by quality value. Wildcards select defFormat.
+// A browser (accepting text/html) lists XML for XHTML, not asking for it, so XML is
+// not matched then.
+func negotiateFormat(r *http.Request, defFormat string) (string, bool) {
+
+	if f := strings.ToLower(r.URL.Query().Get("format")); f != "" {
+		if f == "prometheus" || f == "txt" {
+			f = formatText
+		}
+		_, ok := formatContentTypes[f]
+		return f, ok
+	}
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return defFormat, true
+	}
+
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+	ranges := []mediaRange{}
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mr := mediaRange{
+			mediaType: strings.ToLower(strings.TrimSpace(params[0])),
+			q:         1,
+		}
+		for _, p := range params[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(p), "=")
+			if strings.ToLower(key) == "q" {
+				if q, err := strconv.ParseFloat(value, 64); err == nil {
+					mr.q = q
+				}
+			}
+		}
+		if mr.q > 0 {
+			ranges = append(ranges, mr)
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+
+	browser := false
+	for _, mr := range ranges {
+		browser = browser || mr.mediaType == "text/html"
+	}
+	for _, mr := range ranges {
+		if f, ok := mediaTypeFormats[mr.mediaType]; ok {
+			if browser && f == formatXML {
+				continue
+			}
+			return f, true
+		}
+		switch mr.mediaType {
+		case "*/*", "application/*":
+			return defFormat, true
+		case "text/*":
+			return formatText, true
+		}
+	}
+	return "", false
+}
+
+// respond renders payload in the format negotiated with the client.
+func respond(w http.ResponseWriter, r *http.Request, code int, payload interface{}) {
+
+	defFormat := formatJSON
+	if d, ok := payload.(defaultFormatter); ok {
+		defFormat = d.DefaultFormat()
+	}
+	format, ok := negotiateFormat(r, defFormat)
+	if !ok {
+		format = formatJSON
+		code = http.StatusNotAcceptable
+		payload = errorResponse{Result: "not acceptable, supported formats: json, yaml, csv, xml, text"}
+	}
+
+	body, err := encodePayload(format, payload)
+	if err != nil {
+		log.Errorf("respond. encoding %s: %s", format, err)
+		format = formatJSON
+		code = http.StatusInternalServerError
+		body, _ = json.Marshal(errorResponse{Result: "response encoding error"})
+	}
+
+	if info := requestInfoFrom(r.Context()); info != nil && info.hmcAddress != "" {
+		w.Header().Set("X-HMC-Address", info.hmcAddress)
+	}
+	contentType := formatContentTypes[format]
+	if _, prom := payload.(promMarshaler); format == formatText && !prom {
+		contentType = plainTextContentType
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+func respondError(w http.ResponseWriter, r *http.Request, code int, result string) {
+	respond(w, r, code, errorResponse{Result: result})
+}
+
+func encodePayload(format string, payload interface{}) ([]byte, error) {
+
+	if raw, ok := payload.(rawXML); ok {
+		if format == formatXML {
+			return raw.data, nil
+		}
+		payload = raw.decoded
+	}
+
+	switch format {
+	case formatYAML:
+		return yaml.Marshal(payload)
+	case formatXML:
+		data, err := xml.MarshalIndent(payload, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(xml.Header), data...), nil
+	case formatCSV:
+		var records [][]string
+		if m, ok := payload.(csvMarshaler); ok {
+			records = m.MarshalCSV()
+		} else {
+			names, values := flatFields(payload)
+			records = [][]string{names, values}
+		}
+		buf := &bytes.Buffer{}
+		cw := csv.NewWriter(buf)
+		if err := cw.WriteAll(records); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case formatText:
+		buf := &bytes.Buffer{}
+		if m, ok := payload.(promMarshaler); ok {
+			m.WritePrometheus(buf)
+		} else {
+			names, values := flatFields(payload)
+			for i := range names {
+				fmt.Fprintf(buf, "%s: %s\n", names[i], values[i])
+			}
+		}
+		return buf.Bytes(), nil
+	default:
+		return json.MarshalIndent(payload, "", "  ")
+	}
+}
+
+// flatFields returns the scalar fields of a struct payload, named after their json tags.
+func flatFields(payload interface{}) ([]string, []string) {
+
+	names := []string{}
+	values := []string{}
+
+	v := reflect.ValueOf(payload)
+	for v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return []string{"value"}, []string{fmt.Sprint(payload)}
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		switch field.Type.Kind() {
+		case reflect.Struct, reflect.Slice, reflect.Map, reflect.Pointer, reflect.Interface:
+			continue
+		}
+		names = append(names, name)
+		values = append(values, fmt.Sprint(v.Field(i).Interface()))
+	}
+	return names, values
+}
+
+// promQuote quotes a Prometheus label value.
+func promQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + s + `"`
+}
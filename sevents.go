@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServiceableEvent is an HMC serviceable (problem) event of a managed system.
+type ServiceableEvent struct {
+	ProblemNumber   string `json:"problem_number" yaml:"problem_number" xml:"problem_number"`
+	RefCode         string `json:"src" yaml:"src" xml:"src"`
+	Description     string `json:"description" yaml:"description" xml:"description"`
+	Status          string `json:"status" yaml:"status" xml:"status"`
+	FirstOccurrence string `json:"first_occurrence" yaml:"first_occurrence" xml:"first_occurrence"`
+	LastOccurrence  string `json:"last_occurrence" yaml:"last_occurrence" xml:"last_occurrence"`
+	CallHome        string `json:"call_home" yaml:"call_home" xml:"call_home"`
+	MTMS            string `json:"mtms" yaml:"mtms" xml:"mtms"`
+	FRUs            []*FRU `json:"fru_callouts" yaml:"fru_callouts" xml:"fru_callouts>fru"`
+}
+
+// FRU is a field replaceable unit called out by a serviceable event.
+type FRU struct {
+	PartNumber   string `xml:"PartNumber" json:"part_number" yaml:"part_number"`
+	LocationCode string `xml:"LocationCode" json:"location_code" yaml:"location_code"`
+	Description  string `xml:"Description" json:"description" yaml:"description"`
+	Priority     string `xml:"Priority" json:"priority" yaml:"priority"`
+}
+
+// Open is true until the problem is closed on the HMC.
+func (ev *ServiceableEvent) Open() bool {
+	return !strings.EqualFold(ev.Status, "closed")
+}
+
+// ServiceableEventsResponse is the /systems/{uuid}/serviceable-events response.
+type ServiceableEventsResponse struct {
+	XMLName    xml.Name            `json:"-" yaml:"-" xml:"serviceableEvents"`
+	HMC        string              `json:"hmc" yaml:"hmc" xml:"hmc"`
+	SystemUUID string              `json:"system_uuid" yaml:"system_uuid" xml:"system_uuid"`
+	SystemName string              `json:"systemname" yaml:"systemname" xml:"systemname"`
+	MTMS       string              `json:"mtms" yaml:"mtms" xml:"mtms"`
+	Open       int                 `json:"open" yaml:"open" xml:"open"`
+	Events     []*ServiceableEvent `json:"events" yaml:"events" xml:"event"`
+}
+
+// HMC_sevents caches the serviceable events of all systems managed by the HMC, they are
+// retrieved by one request.
+type HMC_sevents struct {
+	mu         sync.Mutex
+	events     []*ServiceableEvent
+	err        error     // of the last retrieval, not cached as events
+	retry      time.Time // no new retrieval before, after an error
+	NextUpdate time.Time
+	Interval   time.Duration
+}
+
+// serviceableEventsRetry is the wait after a failed retrieval, so an HMC not offering
+// serviceable events is not asked on every request.
+const serviceableEventsRetry = time.Minute
+
+type serviceableEventXML struct {
+	ProblemNumber   string `xml:"ProblemNumber"`
+	RefCode         string `xml:"ReferenceCode"`
+	Description     string `xml:"Description"`
+	Status          string `xml:"ProblemState"`
+	Status2         string `xml:"Status"`
+	FirstReported   string `xml:"FirstReportedTime"`
+	LastReported    string `xml:"LastReportedTime"`
+	Created         string `xml:"CreatedTime"`
+	CallHome        string `xml:"CallHomeStatus"`
+	CallHomeEnabled string `xml:"CallHomeEnabled"`
+	MachineType     string `xml:"FailingMTMS>MachineType"`
+	Model           string `xml:"FailingMTMS>Model"`
+	SerialNumber    string `xml:"FailingMTMS>SerialNumber"`
+	FRUs            []*FRU `xml:"FieldReplaceableUnits>FieldReplaceableUnit"`
+}
+
+type serviceableEventFeed struct {
+	Entries []struct {
+		Event *serviceableEventXML `xml:"content>ServiceableEvent"`
+	} `xml:"entry"`
+}
+
+// GetServiceableEvents returns the serviceable events of all managed systems, from the
+// cache while it is valid. Concurrent retrievals share one HMC request, made without
+// holding the cache. After a failed retrieval the error is returned until the next attempt.
+func (hmc *HMC) GetServiceableEvents(ctx context.Context) ([]*ServiceableEvent, error) {
+
+	se := hmc.sevents
+	now := time.Now()
+	se.mu.Lock()
+	if se.NextUpdate.After(now) {
+		events := se.events
+		se.mu.Unlock()
+		return events, nil
+	}
+	if se.err != nil && se.retry.After(now) {
+		err := se.err
+		se.mu.Unlock()
+		return nil, err
+	}
+	se.mu.Unlock()
+
+	v, err, shared := hmc.flight.Do(ctx, "ServiceableEvents", func(ctx context.Context) (interface{}, error) {
+		ctxLogger(ctx).Debugf("GetServiceableEvents. Retrieving data from HMC")
+		events, err := hmc.fetchServiceableEvents(ctx)
+
+		se.mu.Lock()
+		defer se.mu.Unlock()
+		se.err = err
+		if err != nil {
+			ctxLogger(ctx).Warnf("%s", err)
+			se.retry = time.Now().Add(serviceableEventsRetry)
+			return nil, err
+		}
+		se.events = events
+		se.NextUpdate = time.Now().Add(se.Interval)
+		return events, nil
+	})
+	if shared {
+		hmc.stats.coalesced_requests.Add(1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v.([]*ServiceableEvent), nil
+}
+
+func (hmc *HMC) fetchServiceableEvents(ctx context.Context) ([]*ServiceableEvent, error) {
+
+	myname := "GetServiceableEvents"
+	hmc.stats.sevent_requests.Add(1)
+
+	mgmConsole, err := hmc.GetManagementConsoleData(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s %w", myname, err)
+	}
+	url := hmc.apiURL("/rest/api/uom/ManagementConsole/" + mgmConsole.ID + "/ServiceableEvent")
+	data, err := hmc.GetInfoByUrl(ctx, url, map[string]string{})
+	if err != nil {
+		return nil, fmt.Errorf("%s %w", myname, err)
+	}
+	events := []*ServiceableEvent{}
+	if len(data) == 0 {
+		return events, nil
+	}
+	feed := &serviceableEventFeed{}
+	if err := xml.Unmarshal(data, feed); err != nil {
+		return nil, fmt.Errorf("%s %w", myname, err)
+	}
+	for _, entry := range feed.Entries {
+		if entry.Event != nil {
+			events = append(events, entry.Event.convert())
+		}
+	}
+	return events, nil
+}
+
+// InvalidateServiceableEvents forces the next GetServiceableEvents to ask the HMC.
+func (hmc *HMC) InvalidateServiceableEvents() {
+	hmc.sevents.mu.Lock()
+	hmc.sevents.NextUpdate = time.Now()
+	hmc.sevents.retry = time.Now()
+	hmc.sevents.mu.Unlock()
+}
+
+// SystemServiceableEvents returns the serviceable events reported against the system MTMS.
+func (hmc *HMC) SystemServiceableEvents(ctx context.Context, mtms string) ([]*ServiceableEvent, error) {
+	events, err := hmc.GetServiceableEvents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	list := []*ServiceableEvent{}
+	for _, ev := range events {
+		if ev.MTMS == mtms {
+			list = append(list, ev)
+		}
+	}
+	return list, nil
+}
+
+func (x *serviceableEventXML) convert() *ServiceableEvent {
+	ev := &ServiceableEvent{
+		ProblemNumber:   x.ProblemNumber,
+		RefCode:         x.RefCode,
+		Description:     x.Description,
+		Status:          x.Status,
+		FirstOccurrence: hmcTime(x.FirstReported),
+		LastOccurrence:  hmcTime(x.LastReported),
+		CallHome:        x.CallHome,
+		FRUs:            x.FRUs,
+	}
+	if ev.Status == "" {
+		ev.Status = x.Status2
+	}
+	if ev.FirstOccurrence == "" {
+		ev.FirstOccurrence = hmcTime(x.Created)
+	}
+	if ev.CallHome == "" {
+		ev.CallHome = x.CallHomeEnabled
+	}
+	if ev.FRUs == nil {
+		ev.FRUs = []*FRU{}
+	}
+	if x.MachineType != "" {
+		// same notation as QuickMgms.MTMS
+		ev.MTMS = x.MachineType + "-" + x.Model + "-" + x.SerialNumber
+	}
+	return ev
+}
+
+// hmcTime converts HMC epoch milliseconds to RFC 3339, other values are kept as they are.
+func hmcTime(value string) string {
+	ms, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		return value
+	}
+	return time.UnixMilli(ms).UTC().Format(time.RFC3339)
+}
+
+// MarshalCSV renders one row per serviceable event, FRU part numbers separated by ";".
+func (resp *ServiceableEventsResponse) MarshalCSV() [][]string {
+	records := [][]string{
+		{"hmc", "systemname", "mtms", "problem_number", "src", "status", "first_occurrence", "last_occurrence", "call_home", "fru_callouts", "description"},
+	}
+	for _, ev := range resp.Events {
+		frus := []string{}
+		for _, fru := range ev.FRUs {
+			frus = append(frus, fru.PartNumber+"@"+fru.LocationCode)
+		}
+		records = append(records, []string{
+			resp.HMC, resp.SystemName, resp.MTMS, ev.ProblemNumber, ev.RefCode, ev.Status,
+			ev.FirstOccurrence, ev.LastOccurrence, ev.CallHome, strings.Join(frus, ";"), ev.Description,
+		})
+	}
+	return records
+}
+
+// WritePrometheus renders the serviceable events in the Prometheus text exposition format.
+func (resp *ServiceableEventsResponse) WritePrometheus(w io.Writer) {
+	fmt.Fprintln(w, "# HELP hmc_led_serviceable_event Serviceable event of the managed system (1 = open).")
+	fmt.Fprintln(w, "# TYPE hmc_led_serviceable_event gauge")
+	for _, ev := range resp.Events {
+		fmt.Fprintf(w, "hmc_led_serviceable_event{hmc=%s,systemname=%s,mtms=%s,problem_number=%s,src=%s,status=%s} %d\n",
+			promQuote(resp.HMC), promQuote(resp.SystemName), promQuote(resp.MTMS), promQuote(ev.ProblemNumber),
+			promQuote(ev.RefCode), promQuote(ev.Status), boolToInt(ev.Open()))
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Silence mutes the notifications of the systems it matches between StartsAt and EndsAt,
+// e.g. during a planned service action. HMC is a name, System a path.Match pattern over
+// the system name or MTMS, SRC a pattern over the reference code; the given ones must all match.
+type Silence struct {
+	ID        string    `json:"id" yaml:"id" xml:"id"`
+	HMC       string    `json:"hmc,omitempty" yaml:"hmc,omitempty" xml:"hmc,omitempty"`
+	System    string    `json:"system,omitempty" yaml:"system,omitempty" xml:"system,omitempty"`
+	SRC       string    `json:"src,omitempty" yaml:"src,omitempty" xml:"src,omitempty"`
+	StartsAt  time.Time `json:"starts_at" yaml:"starts_at" xml:"starts_at"`
+	EndsAt    time.Time `json:"ends_at" yaml:"ends_at" xml:"ends_at"`
+	Reason    string    `json:"reason" yaml:"reason" xml:"reason"`
+	CreatedBy string    `json:"created_by,omitempty" yaml:"created_by,omitempty" xml:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at" yaml:"created_at" xml:"created_at"`
+	Active    bool      `json:"active" yaml:"active" xml:"active"`
+}
+
+// SilencesResponse is the GET /silences response.
+type SilencesResponse struct {
+	XMLName  xml.Name   `json:"-" yaml:"-" xml:"silences"`
+	Silences []*Silence `json:"silences" yaml:"silences" xml:"silence"`
+}
+
+// silenceRequest is the POST /silences body, Duration (e.g. "2h") may replace EndsAt.
+type silenceRequest struct {
+	HMC       string    `json:"hmc"`
+	System    string    `json:"system"`
+	SRC       string    `json:"src"`
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	Duration  string    `json:"duration"`
+	Reason    string    `json:"reason"`
+	CreatedBy string    `json:"created_by"`
+}
+
+func (req *silenceRequest) silence(now time.Time) (*Silence, error) {
+
+	if req.HMC == "" && req.System == "" && req.SRC == "" {
+		return nil, errors.New("hmc, system or src is required")
+	}
+	for _, pattern := range []string{req.System, req.SRC} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("pattern %q: %w", pattern, err)
+		}
+	}
+	if req.Reason == "" {
+		return nil, errors.New("reason is required")
+	}
+	s := &Silence{
+		ID:        newRequestID(),
+		HMC:       req.HMC,
+		System:    req.System,
+		SRC:       req.SRC,
+		StartsAt:  req.StartsAt,
+		EndsAt:    req.EndsAt,
+		Reason:    req.Reason,
+		CreatedBy: req.CreatedBy,
+		CreatedAt: now,
+	}
+	if s.StartsAt.IsZero() {
+		s.StartsAt = now
+	}
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil {
+			return nil, fmt.Errorf("duration %w", err)
+		}
+		s.EndsAt = s.StartsAt.Add(d)
+	}
+	if s.EndsAt.IsZero() {
+		return nil, errors.New("ends_at or duration is required")
+	}
+	if !s.EndsAt.After(s.StartsAt) || !s.EndsAt.After(now) {
+		return nil, errors.New("ends_at must be after starts_at and in the future")
+	}
+	return s, nil
+}
+
+// matches is true when s is active at now and matches the system attributes.
+func (s *Silence) matches(hmc, name, mtms, refCode string, now time.Time) bool {
+
+	if now.Before(s.StartsAt) || !now.Before(s.EndsAt) {
+		return false
+	}
+	if s.HMC != "" && s.HMC != hmc {
+		return false
+	}
+	// system and src patterns are about systems, even "*" does not match an HMC notification
+	if (s.System != "" || s.SRC != "") && name == "" && mtms == "" {
+		return false
+	}
+	if s.System != "" {
+		byName, _ := path.Match(s.System, name)
+		byMTMS, _ := path.Match(s.System, mtms)
+		if !byName && !byMTMS {
+			return false
+		}
+	}
+	if s.SRC != "" {
+		if ok, _ := path.Match(s.SRC, refCode); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// SilenceStore keeps the silences, saved to silences.json in state_dir on every change.
+// Silences are dropped once they ended.
+type SilenceStore struct {
+	file string
+
+	mu       sync.Mutex
+	silences map[string]*Silence
+}
+
+// NewSilenceStore loads the saved silences, state_dir defaults to /var/lib/hmc_led.
+func NewSilenceStore(config *viper.Viper) (*SilenceStore, error) {
+
+	store := &SilenceStore{
+		file:     filepath.Join(stateDir(config), "silences.json"),
+		silences: map[string]*Silence{},
+	}
+	data, err := os.ReadFile(store.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var silences []*Silence
+	if err := json.Unmarshal(data, &silences); err != nil {
+		return nil, fmt.Errorf("%s %w", store.file, err)
+	}
+	now := time.Now()
+	for _, s := range silences {
+		if s.EndsAt.After(now) {
+			store.silences[s.ID] = s
+		}
+	}
+	log.Infof("%d silences loaded from %s", len(store.silences), store.file)
+	return store, nil
+}
+
+// stateDir is where hmc_led keeps what must survive a restart.
+func stateDir(config *viper.Viper) string {
+	if dir := config.GetString("state_dir"); dir != "" {
+		return dir
+	}
+	return "/var/lib/hmc_led"
+}
+
+// saveState writes v as JSON to file, through a temporary file so a crash leaves the old one.
+func saveState(file string, v interface{}) error {
+
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// expire drops the silences which ended, the caller holds mu.
+func (store *SilenceStore) expire(now time.Time) {
+	for id, s := range store.silences {
+		if !s.EndsAt.After(now) {
+			delete(store.silences, id)
+		}
+	}
+}
+
+// save writes the silences, the caller holds mu.
+func (store *SilenceStore) save() error {
+	list := make([]*Silence, 0, len(store.silences))
+	for _, s := range store.silences {
+		list = append(list, s)
+	}
+	if err := saveState(store.file, list); err != nil {
+		return fmt.Errorf("saving silences %w", err)
+	}
+	return nil
+}
+
+func (store *SilenceStore) Add(s *Silence) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.expire(time.Now())
+	store.silences[s.ID] = s
+	if err := store.save(); err != nil {
+		delete(store.silences, s.ID)
+		return err
+	}
+	return nil
+}
+
+// Delete ends a silence, false when there is none with id.
+func (store *SilenceStore) Delete(id string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.expire(time.Now())
+	s, exists := store.silences[id]
+	if !exists {
+		return false, nil
+	}
+	delete(store.silences, id)
+	if err := store.save(); err != nil {
+		store.silences[id] = s
+		return true, err
+	}
+	return true, nil
+}
+
+// List returns the current and future silences, ending first.
+func (store *SilenceStore) List() []*Silence {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	list := []*Silence{}
+	for _, s := range store.silences {
+		if s.EndsAt.After(now) {
+			c := *s
+			c.Active = !now.Before(s.StartsAt)
+			list = append(list, &c)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].EndsAt.Before(list[j].EndsAt) })
+	return list
+}
+
+func (store *SilenceStore) Get(id string) *Silence {
+	for _, s := range store.List() {
+		if s.ID == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// match returns the active silence ending last which matches the attributes, or nil.
+// A nil *SilenceStore matches nothing.
+func (store *SilenceStore) match(hmc, name, mtms, refCode string) *Silence {
+	if store == nil {
+		return nil
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	var found *Silence
+	for _, s := range store.silences {
+		if s.matches(hmc, name, mtms, refCode, now) && (found == nil || s.EndsAt.After(found.EndsAt)) {
+			found = s
+		}
+	}
+	return found
+}
+
+// System returns the silence of a managed system, or nil.
+func (store *SilenceStore) System(system *QuickMgms) *Silence {
+	return store.match(system.HMC, system.SysName, system.MTMS, system.RefCode)
+}
+
+// Notification returns the silence of ev, or nil. HMC logon failures are matched by
+// silences of the HMC alone, authentication failures are never silenced.
+func (store *SilenceStore) Notification(ev *Notification) *Silence {
+	if ev.HMC == "" {
+		return nil
+	}
+	if ev.Mgms != nil {
+		return store.System(ev.Mgms)
+	}
+	return store.match(ev.HMC, ev.System, ev.MTMS, ev.RefCode)
+}
+
+// Mark sets Silenced and SilencedBy of the systems.
+func (store *SilenceStore) Mark(systems []*QuickMgms) {
+	for _, system := range systems {
+		if s := store.System(system); s != nil {
+			system.Silenced, system.SilencedBy = true, s.ID
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// flightTimeout bounds an HMC call shared by several requests, it is not cancelled with any of them.
+const flightTimeout = 2 * time.Minute
+
+// flightGroup coalesces identical in-flight HMC calls: while a call for a key is running,
+// further callers wait for its result instead of sending their own request.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done    chan struct{}
+	val     interface{}
+	err     error
+	address string // the HMC address that served fn, for every caller's X-HMC-Address
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: map[string]*flightCall{}}
+}
+
+// Do runs fn once for all concurrent callers of key and returns its result, shared is true
+// for the callers which did not start it. fn runs detached from the caller's cancellation,
+// so one client going away does not fail the others; every caller still stops waiting when
+// its own ctx is done.
+func (g *flightGroup) Do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error, bool) {
+
+	g.mu.Lock()
+	call, shared := g.calls[key]
+	if !shared {
+		call = &flightCall{done: make(chan struct{})}
+		g.calls[key] = call
+
+		fnCtx, cancel := detachedContext(ctx)
+		go func() {
+			defer cancel()
+			call.val, call.err = fn(fnCtx)
+			call.address = requestInfoFrom(fnCtx).hmcAddress
+
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+			close(call.done)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		if info := requestInfoFrom(ctx); info != nil && call.address != "" {
+			info.hmcAddress = call.address
+		}
+		return call.val, call.err, shared
+	case <-ctx.Done():
+		return nil, ctx.Err(), shared
+	}
+}
+
+// detachedContext is a context for HMC calls outliving the request of ctx, bounded by
+// flightTimeout. It keeps the request ID for the log, but nothing the request may still be
+// changing, and has its own requestInfo for the HMC address serving the calls.
+func detachedContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	info := &requestInfo{}
+	if parent := requestInfoFrom(ctx); parent != nil {
+		info.id = parent.id
+	}
+	return context.WithTimeout(withRequestInfo(context.Background(), info), flightTimeout)
+}
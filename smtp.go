@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	htmltemplate "html/template"
+	"math"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	RegisterNotifier("smtp", func(config *viper.Viper, deps *NotifierDeps) (Notifier, error) {
+		if n, err := NewSMTPNotifier(config, deps.Collect); n != nil || err != nil {
+			return n, err
+		}
+		return nil, nil
+	})
+}
+
+// MailRule sends the notifications of the listed kinds to Recipients. HMC and Systems
+// narrow it down, Systems are path.Match patterns over the system name.
+type MailRule struct {
+	Name       string   `mapstructure:"name" json:"name" yaml:"name" xml:"name"`
+	Recipients []string `mapstructure:"recipients" json:"recipients" yaml:"recipients" xml:"recipient"`
+	Events     []string `mapstructure:"events" json:"events" yaml:"events" xml:"event"`
+	HMC        string   `mapstructure:"hmc" json:"hmc,omitempty" yaml:"hmc,omitempty" xml:"hmc,omitempty"`
+	Systems    []string `mapstructure:"systems" json:"systems,omitempty" yaml:"systems,omitempty" xml:"system,omitempty"`
+}
+
+func (rule *MailRule) matches(ev *Notification) bool {
+	kindMatches := false
+	for _, kind := range rule.Events {
+		kindMatches = kindMatches || kind == ev.Kind
+	}
+	if !kindMatches || (rule.HMC != "" && rule.HMC != ev.HMC) {
+		return false
+	}
+	if len(rule.Systems) == 0 {
+		return true
+	}
+	for _, pattern := range rule.Systems {
+		if ok, _ := path.Match(pattern, ev.System); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// mailTemplate is the text and HTML body and the subject of one kind of mail.
+type mailTemplate struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// alertMailData is passed to the alert templates, Alerts has more than one entry when
+// the rate limit held mails back.
+type alertMailData struct {
+	Rule   string
+	Host   string
+	Alerts []*Notification
+}
+
+// digestMailData is passed to the digest templates.
+type digestMailData struct {
+	Host    string
+	Time    time.Time
+	Total   int
+	Lit     []*QuickMgms
+	Failure string // the systems could not be collected
+}
+
+const defaultAlertSubject = `hmc_led: {{if eq (len .Alerts) 1}}{{with index .Alerts 0}}{{.Message}}{{end}}{{else}}{{len .Alerts}} alerts{{end}}`
+
+const defaultAlertText = `{{range .Alerts}}{{.Time.Format "2006-01-02 15:04:05 MST"}}  {{.Message}}
+{{with .Mgms}}    HMC:       {{.HMC}}
+    System:    {{.SysName}} ({{.MTMS}})
+    State:     {{.State}}
+    LED:       {{if .LED}}on{{else}}off{{end}}
+    SRC:       {{.RefCode}}
+    Location:  {{.Location}}
+{{end}}
+{{end}}--
+hmc_led on {{.Host}}, rule {{.Rule}}
+`
+
+const defaultAlertHTML = `<html><body style="font-family: sans-serif">
+{{range .Alerts}}<h3>{{.Message}}</h3>
+<p>{{.Time.Format "2006-01-02 15:04:05 MST"}}</p>
+{{with .Mgms}}<table cellpadding="3">
+<tr><td>HMC</td><td>{{.HMC}}</td></tr>
+<tr><td>System</td><td>{{.SysName}} ({{.MTMS}})</td></tr>
+<tr><td>State</td><td>{{.State}}</td></tr>
+<tr><td>LED</td><td>{{if .LED}}<b style="color: #c00">on</b>{{else}}off{{end}}</td></tr>
+<tr><td>SRC</td><td>{{.RefCode}}</td></tr>
+<tr><td>Location</td><td>{{.Location}}</td></tr>
+</table>{{end}}
+{{end}}<p style="color: #888">hmc_led on {{.Host}}, rule {{.Rule}}</p>
+</body></html>
+`
+
+const defaultDigestSubject = `hmc_led digest: {{if .Failure}}systems not available{{else}}{{len .Lit}} of {{.Total}} systems with attention LED on{{end}}`
+
+const defaultDigestText = `Attention LED status {{.Time.Format "2006-01-02 15:04 MST"}}
+{{if .Failure}}
+The managed systems could not be collected: {{.Failure}}
+{{else if .Lit}}
+{{range .Lit}}{{.SysName}} ({{.MTMS}}) on {{.HMC}}
+    State: {{.State}}, SRC: {{.RefCode}}, location: {{.Location}}, since {{.LastChange.Format "2006-01-02 15:04"}}
+{{end}}{{else}}
+No attention LED is on, {{.Total}} systems.
+{{end}}
+--
+hmc_led on {{.Host}}
+`
+
+const defaultDigestHTML = `<html><body style="font-family: sans-serif">
+<h3>Attention LED status {{.Time.Format "2006-01-02 15:04 MST"}}</h3>
+{{if .Failure}}<p>The managed systems could not be collected: {{.Failure}}</p>
+{{else if .Lit}}<table cellpadding="3" border="1" style="border-collapse: collapse">
+<tr><th>System</th><th>MTMS</th><th>HMC</th><th>State</th><th>SRC</th><th>Location</th><th>Since</th></tr>
+{{range .Lit}}<tr><td>{{.SysName}}</td><td>{{.MTMS}}</td><td>{{.HMC}}</td><td>{{.State}}</td><td>{{.RefCode}}</td><td>{{.Location}}</td><td>{{.LastChange.Format "2006-01-02 15:04"}}</td></tr>
+{{end}}</table>
+{{else}}<p>No attention LED is on, {{.Total}} systems.</p>
+{{end}}<p style="color: #888">hmc_led on {{.Host}}</p>
+</body></html>
+`
+
+// SMTPNotifier mails notifications matching the mail rules and a daily digest of the systems
+// with the attention LED on. At most smtp_max_mails are sent per smtp_rate_interval, alerts
+// held back by the limit are mailed together as soon as the limit allows.
+type SMTPNotifier struct {
+	address    string
+	security   string // starttls, tls or none
+	tlsConfig  *tls.Config
+	user       string
+	passwd     string
+	from       string
+	host       string
+	rules      []*MailRule
+	alert      *mailTemplate
+	digest     *mailTemplate
+	digestAt   time.Duration // time of day
+	digestTo   []string
+	collect    func(ctx context.Context) (*RespJson, error)
+	rate       float64 // mails per second
+	burst      float64
+	queue      chan *Notification
+	pending    map[*MailRule][]*Notification
+	pendingSum int
+
+	mu     sync.Mutex
+	bucket tokenBucket
+	stats  SMTPStats
+}
+
+// SMTPStats is the SMTP part of /status.
+type SMTPStats struct {
+	Server     string `json:"server" yaml:"server" xml:"server"`
+	Sent       int64  `json:"sent" yaml:"sent" xml:"sent"`
+	Failed     int64  `json:"failed" yaml:"failed" xml:"failed"`
+	Held       int    `json:"held" yaml:"held" xml:"held"`
+	NextDigest string `json:"next_digest,omitempty" yaml:"next_digest,omitempty" xml:"next_digest,omitempty"`
+	LastError  string `json:"last_error,omitempty" yaml:"last_error,omitempty" xml:"last_error,omitempty"`
+}
+
+// NewSMTPNotifier returns nil without smtp_host. collect retrieves the systems for the digest.
+func NewSMTPNotifier(config *viper.Viper, collect func(ctx context.Context) (*RespJson, error)) (*SMTPNotifier, error) {
+
+	host := config.GetString("smtp_host")
+	if host == "" {
+		return nil, nil
+	}
+	n := &SMTPNotifier{
+		security: strings.ToLower(config.GetString("smtp_security")),
+		user:     config.GetString("smtp_user"),
+		passwd:   config.GetString("smtp_passwd"),
+		from:     config.GetString("smtp_from"),
+		digestTo: config.GetStringSlice("smtp_digest_recipients"),
+		collect:  collect,
+		queue:    make(chan *Notification, 256),
+		pending:  map[*MailRule][]*Notification{},
+	}
+	n.host, _ = os.Hostname()
+
+	port := config.GetString("smtp_port")
+	switch n.security {
+	case "", "starttls":
+		n.security = "starttls"
+		if port == "" {
+			port = "587"
+		}
+	case "tls":
+		if port == "" {
+			port = "465"
+		}
+	case "none":
+		if port == "" {
+			port = "25"
+		}
+	default:
+		return nil, fmt.Errorf("smtp_security must be starttls, tls or none")
+	}
+	n.address = net.JoinHostPort(host, port)
+	n.stats.Server = n.address
+
+	if n.security != "none" {
+		n.tlsConfig = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+		if caFile := config.GetString("smtp_ca_file"); caFile != "" {
+			data, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, fmt.Errorf("smtp_ca_file %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("smtp_ca_file %s: no PEM certificates found", caFile)
+			}
+			n.tlsConfig.RootCAs = pool
+		}
+		if strings.ToLower(config.GetString("smtp_tls_skip_verify")) == "yes" {
+			n.tlsConfig.InsecureSkipVerify = true
+		}
+	}
+	if n.from == "" {
+		n.from = "hmc_led@" + n.host
+	}
+
+	if err := config.UnmarshalKey("smtp_rules", &n.rules); err != nil {
+		return nil, fmt.Errorf("smtp_rules %w", err)
+	}
+	for i, rule := range n.rules {
+		if len(rule.Recipients) == 0 {
+			return nil, fmt.Errorf("smtp_rules[%d]: recipients are missing", i)
+		}
+		if rule.Name == "" {
+			rule.Name = "rule" + strconv.Itoa(i+1)
+		}
+		if len(rule.Events) == 0 {
+			rule.Events = []string{notifyLEDOn}
+		}
+	}
+
+	var err error
+	if n.alert, err = loadMailTemplate(config, "smtp_alert", defaultAlertSubject, defaultAlertText, defaultAlertHTML); err != nil {
+		return nil, err
+	}
+	if n.digest, err = loadMailTemplate(config, "smtp_digest", defaultDigestSubject, defaultDigestText, defaultDigestHTML); err != nil {
+		return nil, err
+	}
+	if len(n.digestTo) > 0 {
+		digestAt := config.GetString("smtp_digest_at")
+		if digestAt == "" {
+			digestAt = "07:00"
+		}
+		at, err := time.Parse("15:04", digestAt)
+		if err != nil {
+			return nil, fmt.Errorf("smtp_digest_at must be HH:MM: %w", err)
+		}
+		n.digestAt = time.Duration(at.Hour())*time.Hour + time.Duration(at.Minute())*time.Minute
+	}
+
+	maxMails := config.GetFloat64("smtp_max_mails")
+	if maxMails <= 0 {
+		maxMails = 10
+	}
+	interval := configDuration(config, "smtp_rate_interval", time.Hour)
+	n.rate = maxMails / interval.Seconds()
+	n.burst = maxMails
+	n.bucket = tokenBucket{tokens: maxMails, last: time.Now()}
+	return n, nil
+}
+
+// loadMailTemplate parses <prefix>_subject, <prefix>_text_template and <prefix>_html_template
+// files when given, the built-in templates otherwise.
+func loadMailTemplate(config *viper.Viper, prefix string, subject string, text string, html string) (*mailTemplate, error) {
+
+	if s := config.GetString(prefix + "_subject"); s != "" {
+		subject = s
+	}
+	for _, t := range []struct {
+		key  string
+		body *string
+	}{{prefix + "_text_template", &text}, {prefix + "_html_template", &html}} {
+		if file := config.GetString(t.key); file != "" {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("%s %w", t.key, err)
+			}
+			*t.body = string(data)
+		}
+	}
+
+	var err error
+	tmpl := &mailTemplate{}
+	if tmpl.subject, err = texttemplate.New("subject").Parse(subject); err != nil {
+		return nil, fmt.Errorf("%s_subject %w", prefix, err)
+	}
+	if tmpl.text, err = texttemplate.New("text").Parse(text); err != nil {
+		return nil, fmt.Errorf("%s_text_template %w", prefix, err)
+	}
+	if tmpl.html, err = htmltemplate.New("html").Parse(html); err != nil {
+		return nil, fmt.Errorf("%s_html_template %w", prefix, err)
+	}
+	return tmpl, nil
+}
+
+// Notify queues notifications matching any mail rule.
+func (n *SMTPNotifier) Notify(ev *Notification) {
+	for _, rule := range n.rules {
+		if rule.matches(ev) {
+			select {
+			case n.queue <- ev:
+			default:
+				log.Warnf("SMTP queue full, %s of %s dropped", ev.Kind, ev.System)
+			}
+			return
+		}
+	}
+}
+
+func (n *SMTPNotifier) Stats() interface{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	stats := n.stats
+	return &stats
+}
+
+// Run mails the queued alerts and the digest until ctx is done.
+func (n *SMTPNotifier) Run(ctx context.Context, wg *sync.WaitGroup) {
+
+	defer wg.Done()
+
+	log.Infof("SMTP notifications via %s (%s), %d rules, at most %.0f mails per %s",
+		n.address, n.security, len(n.rules), n.burst, time.Duration(n.burst/n.rate*float64(time.Second)))
+
+	var digest <-chan time.Time
+	var digestTimer *time.Timer
+	scheduleDigest := func() {
+		if len(n.digestTo) == 0 {
+			return
+		}
+		next := nextTimeOfDay(time.Now(), n.digestAt)
+		n.mu.Lock()
+		n.stats.NextDigest = next.Format(time.RFC3339)
+		n.mu.Unlock()
+		digestTimer = time.NewTimer(time.Until(next))
+		digest = digestTimer.C
+	}
+	scheduleDigest()
+
+	// held back alerts are retried when the bucket may have a token again
+	retry := time.NewTicker(time.Minute)
+	defer retry.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if digestTimer != nil {
+				digestTimer.Stop()
+			}
+			return
+		case ev := <-n.queue:
+			for _, rule := range n.rules {
+				if rule.matches(ev) {
+					n.pending[rule] = append(n.pending[rule], ev)
+					n.pendingSum++
+				}
+			}
+			n.flush(ctx)
+		case <-retry.C:
+			n.flush(ctx)
+		case <-digest:
+			n.sendDigest(ctx)
+			scheduleDigest()
+		}
+	}
+}
+
+// nextTimeOfDay is the next local time at the offset from midnight.
+func nextTimeOfDay(now time.Time, offset time.Duration) time.Time {
+	y, m, d := now.Date()
+	next := time.Date(y, m, d, 0, 0, 0, 0, now.Location()).Add(offset)
+	if !next.After(now) {
+		next = time.Date(y, m, d+1, 0, 0, 0, 0, now.Location()).Add(offset)
+	}
+	return next
+}
+
+// flush mails the pending alerts of every rule, one mail per rule, while the rate limit allows.
+func (n *SMTPNotifier) flush(ctx context.Context) {
+
+	for _, rule := range n.rules {
+		alerts := n.pending[rule]
+		if len(alerts) == 0 {
+			continue
+		}
+		if !n.take() {
+			log.Warnf("SMTP rate limit reached, %d alerts held back", n.pendingSum)
+			break
+		}
+		delete(n.pending, rule)
+		n.pendingSum -= len(alerts)
+		data := &alertMailData{Rule: rule.Name, Host: n.host, Alerts: alerts}
+		if err := n.mail(ctx, n.alert, data, rule.Recipients); err != nil {
+			log.Errorf("SMTP alert mail, rule %s: %s", rule.Name, err)
+		}
+	}
+	n.mu.Lock()
+	n.stats.Held = n.pendingSum
+	n.mu.Unlock()
+}
+
+// take is a token of the mail rate limit.
+func (n *SMTPNotifier) take() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := time.Now()
+	n.bucket.tokens = math.Min(n.burst, n.bucket.tokens+now.Sub(n.bucket.last).Seconds()*n.rate)
+	n.bucket.last = now
+	if n.bucket.tokens >= 1 {
+		n.bucket.tokens--
+		return true
+	}
+	return false
+}
+
+// sendDigest mails the systems with the attention LED on, it is not rate limited.
+func (n *SMTPNotifier) sendDigest(ctx context.Context) {
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+
+	data := &digestMailData{Host: n.host, Time: time.Now(), Lit: []*QuickMgms{}}
+	respJson, err := n.collect(ctx)
+	if err != nil {
+		data.Failure = err.Error()
+	} else {
+		data.Total = len(respJson.Systems)
+		for _, system := range respJson.Systems {
+			if system.LED {
+				data.Lit = append(data.Lit, system)
+			}
+		}
+	}
+	if err := n.mail(ctx, n.digest, data, n.digestTo); err != nil {
+		log.Errorf("SMTP digest mail: %s", err)
+	}
+}
+
+// mail renders tmpl and sends it to recipients as multipart/alternative text and HTML.
+func (n *SMTPNotifier) mail(ctx context.Context, tmpl *mailTemplate, data interface{}, recipients []string) error {
+
+	err := n.deliver(ctx, tmpl, data, recipients)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err != nil {
+		n.stats.Failed++
+		n.stats.LastError = err.Error()
+		return err
+	}
+	n.stats.Sent++
+	return nil
+}
+
+func (n *SMTPNotifier) deliver(ctx context.Context, tmpl *mailTemplate, data interface{}, recipients []string) error {
+
+	var subject, text, html bytes.Buffer
+	if err := tmpl.subject.Execute(&subject, data); err != nil {
+		return fmt.Errorf("subject template %w", err)
+	}
+	if err := tmpl.text.Execute(&text, data); err != nil {
+		return fmt.Errorf("text template %w", err)
+	}
+	if err := tmpl.html.Execute(&html, data); err != nil {
+		return fmt.Errorf("html template %w", err)
+	}
+	msg, err := n.message(strings.Join(strings.Fields(subject.String()), " "), text.Bytes(), html.Bytes(), recipients)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	dialer := &net.Dialer{}
+	var conn net.Conn
+	if n.security == "tls" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: n.tlsConfig}).DialContext(ctx, "tcp", n.address)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", n.address)
+	}
+	if err != nil {
+		return fmt.Errorf("connect %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	host, _, _ := net.SplitHostPort(n.address)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("smtp %w", err)
+	}
+	defer c.Close()
+
+	if err := c.Hello(n.host); err != nil {
+		return fmt.Errorf("EHLO %w", err)
+	}
+	if n.security == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("server does not offer STARTTLS, set smtp_security none to send in plain text")
+		}
+		if err := c.StartTLS(n.tlsConfig); err != nil {
+			return fmt.Errorf("STARTTLS %w", err)
+		}
+	}
+	if n.user != "" {
+		if err := c.Auth(smtp.PlainAuth("", n.user, n.passwd, host)); err != nil {
+			return fmt.Errorf("AUTH %w", err)
+		}
+	}
+	if err := c.Mail(n.from); err != nil {
+		return fmt.Errorf("MAIL FROM %w", err)
+	}
+	for _, to := range recipients {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("RCPT TO %s %w", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("DATA %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("DATA %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("DATA %w", err)
+	}
+	return c.Quit()
+}
+
+// message is the RFC 5322 mail with quoted-printable text and HTML alternatives.
+func (n *SMTPNotifier) message(subject string, text []byte, html []byte, recipients []string) ([]byte, error) {
+
+	random := make([]byte, 12)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	boundary := "hmc_led-" + hex.EncodeToString(random)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", n.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(recipients, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(random), n.host)
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=\"%s\"\r\n\r\n", boundary)
+	for _, part := range []struct {
+		contentType string
+		body        []byte
+	}{{"text/plain", text}, {"text/html", html}} {
+		fmt.Fprintf(&b, "--%s\r\n", boundary)
+		fmt.Fprintf(&b, "Content-Type: %s; charset=utf-8\r\n", part.contentType)
+		fmt.Fprintf(&b, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		qp := quotedprintable.NewWriter(&b)
+		body := bytes.ReplaceAll(part.body, []byte("\r\n"), []byte("\n"))
+		qp.Write(bytes.ReplaceAll(body, []byte("\n"), []byte("\r\n")))
+		qp.Close()
+		fmt.Fprintf(&b, "\r\n")
+	}
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+	return b.Bytes(), nil
+}
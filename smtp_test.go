@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// smtpMessage is a mail the SMTP sink received.
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// smtpSink is a local SMTP server without TLS and AUTH, it accepts every mail.
+type smtpSink struct {
+	ln       net.Listener
+	messages chan *smtpMessage
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpSink{ln: ln, messages: make(chan *smtpMessage, 10)}
+	t.Cleanup(func() { ln.Close() })
+	go s.accept()
+	return s
+}
+
+func (s *smtpSink) accept() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+	reply("220 sink ESMTP")
+	msg := &smtpMessage{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimRight(line, "\r\n")
+		switch verb := strings.ToUpper(strings.SplitN(cmd, " ", 2)[0]); verb {
+		case "EHLO", "HELO":
+			reply("250 sink")
+		case "MAIL":
+			msg.from = strings.Trim(strings.TrimPrefix(cmd, "MAIL FROM:"), "<>")
+			reply("250 OK")
+		case "RCPT":
+			msg.to = append(msg.to, strings.Trim(strings.TrimPrefix(cmd, "RCPT TO:"), "<>"))
+			reply("250 OK")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			msg.data = data.String()
+			s.messages <- msg
+			msg = &smtpMessage{}
+			reply("250 OK")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func (s *smtpSink) next(t *testing.T) *smtpMessage {
+	t.Helper()
+	select {
+	case msg := <-s.messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail from the notifier")
+		return nil
+	}
+}
+
+// parts parses the multipart/alternative mail into its subject and the decoded parts by content type.
+func (m *smtpMessage) parts(t *testing.T) (string, map[string]string) {
+	t.Helper()
+	parsed, err := mail.ReadMessage(strings.NewReader(m.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("content type %q %v, want multipart/alternative", mediaType, err)
+	}
+	parts := map[string]string{}
+	r := multipart.NewReader(parsed.Body, params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(part) // quoted-printable is decoded by the reader
+		if err != nil {
+			t.Fatal(err)
+		}
+		contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		parts[contentType] = string(body)
+	}
+	return subject, parts
+}
+
+func ledOn(system string) *Notification {
+	return &Notification{
+		Time:    time.Now(),
+		Kind:    notifyLEDOn,
+		HMC:     "HMC1",
+		System:  system,
+		Message: "Attention LED of " + system + " is on",
+		Mgms:    &QuickMgms{HMC: "HMC1", SysName: system, MTMS: "9080-HEX-7812345", State: "operating", LED: true},
+	}
+}
+
+func TestSMTPNotifier(t *testing.T) {
+
+	sink := newSMTPSink(t)
+	_, port, _ := net.SplitHostPort(sink.ln.Addr().String())
+	config := viper.New()
+	config.Set("smtp_host", "127.0.0.1")
+	config.Set("smtp_port", port)
+	config.Set("smtp_security", "none")
+	config.Set("smtp_from", "hmc_led@example.com")
+	config.Set("smtp_max_mails", "1")
+	config.Set("smtp_rules", []map[string]interface{}{{
+		"name":       "prod",
+		"recipients": []string{"ops@example.com", "oncall@example.com"},
+		"events":     []string{"led_on"},
+		"hmc":        "HMC1",
+		"systems":    []string{"P10-*"},
+	}})
+	n, err := NewSMTPNotifier(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go n.Run(ctx, &wg)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	// neither kind, HMC nor system matches the rule
+	off := ledOn("P10-a")
+	off.Kind = notifyLEDOff
+	n.Notify(off)
+	otherHMC := ledOn("P10-a")
+	otherHMC.HMC = "HMC2"
+	n.Notify(otherHMC)
+	n.Notify(ledOn("P9-a"))
+
+	n.Notify(ledOn("P10-a"))
+	msg := sink.next(t)
+	if msg.from != "hmc_led@example.com" || strings.Join(msg.to, ",") != "ops@example.com,oncall@example.com" {
+		t.Errorf("mail from %s to %v", msg.from, msg.to)
+	}
+	subject, parts := msg.parts(t)
+	if subject != "hmc_led: Attention LED of P10-a is on" {
+		t.Errorf("subject %q", subject)
+	}
+	if !strings.Contains(parts["text/plain"], "System:    P10-a (9080-HEX-7812345)") {
+		t.Errorf("text part %q", parts["text/plain"])
+	}
+	if !strings.Contains(parts["text/html"], "<h3>Attention LED of P10-a is on</h3>") {
+		t.Errorf("html part %q", parts["text/html"])
+	}
+	if len(parts) != 2 {
+		t.Errorf("%d parts, want text and html", len(parts))
+	}
+
+	// the only mail of the interval is sent, the next ones are held back
+	n.Notify(ledOn("P10-b"))
+	n.Notify(ledOn("P10-c"))
+	waitFor(t, func() bool { return n.Stats().(*SMTPStats).Held == 2 })
+
+	// once the limit allows, the held back alerts go out in one mail
+	n.mu.Lock()
+	n.bucket.tokens = 1
+	n.mu.Unlock()
+	n.Notify(ledOn("P10-d"))
+	subject, parts = sink.next(t).parts(t)
+	if subject != "hmc_led: 3 alerts" {
+		t.Errorf("subject %q, want 3 alerts", subject)
+	}
+	for _, system := range []string{"P10-b", "P10-c", "P10-d"} {
+		if !strings.Contains(parts["text/plain"], "Attention LED of "+system+" is on") {
+			t.Errorf("merged mail lacks %s: %q", system, parts["text/plain"])
+		}
+	}
+	waitFor(t, func() bool {
+		stats := n.Stats().(*SMTPStats)
+		return stats.Sent == 2 && stats.Held == 0 && stats.Failed == 0
+	})
+	select {
+	case msg := <-sink.messages:
+		t.Errorf("unexpected mail %q", msg.data)
+	default:
+	}
+}
+
+func TestSMTPDigestAtDefault(t *testing.T) {
+	config := viper.New()
+	config.Set("smtp_host", "127.0.0.1")
+	config.Set("smtp_digest_recipients", []string{"ops@example.com"})
+	n, err := NewSMTPNotifier(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.digestAt != 7*time.Hour {
+		t.Errorf("digest at %s, want 7h", n.digestAt)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// OIDs of HMC-LED-MIB, doc/HMC-LED-MIB.txt
+const (
+	oidHMCLed           = "1.3.6.1.4.1.32473.1"
+	oidTrapAttentionOn  = oidHMCLed + ".0.1"
+	oidTrapAttentionOff = oidHMCLed + ".0.2"
+	oidTrapStateChange  = oidHMCLed + ".0.3"
+	oidHMCLedHmc        = oidHMCLed + ".1.1.0"
+	oidHMCLedSystemName = oidHMCLed + ".1.2.0"
+	oidHMCLedMtms       = oidHMCLed + ".1.3.0"
+	oidHMCLedSrc        = oidHMCLed + ".1.4.0"
+	oidHMCLedLocation   = oidHMCLed + ".1.5.0"
+	oidHMCLedState      = oidHMCLed + ".1.6.0"
+	oidHMCLedPrevState  = oidHMCLed + ".1.7.0"
+	oidHMCLedUuid       = oidHMCLed + ".1.8.0"
+	oidSysUpTime        = "1.3.6.1.2.1.1.3.0"
+	oidSnmpTrapOID      = "1.3.6.1.6.3.1.1.4.1.0"
+)
+
+const (
+	snmpQueueSize        = 256
+	snmpDefaultTrapPort  = 162
+	snmpEngineIDTextType = 4 // RFC 3411 engine ID format: administratively assigned text
+)
+
+func init() {
+	RegisterNotifier("snmp", func(config *viper.Viper, deps *NotifierDeps) (Notifier, error) {
+		if sender, err := NewSNMPTrapSender(config); sender != nil || err != nil {
+			return sender, err
+		}
+		return nil, nil
+	})
+}
+
+// SNMPTrapSender sends SNMPv2c or SNMPv3 traps of LED and state changes to every receiver.
+type SNMPTrapSender struct {
+	receivers []*snmpReceiver
+	queue     chan *Notification
+	started   time.Time
+}
+
+type snmpReceiver struct {
+	snmp *gosnmp.GoSNMP
+	usm  *gosnmp.UsmSecurityParameters // v3 only
+
+	mu    sync.Mutex
+	stats SNMPReceiverStats
+}
+
+// SNMPStats is the SNMP part of /status.
+type SNMPStats struct {
+	Receivers []*SNMPReceiverStats `json:"receivers" yaml:"receivers" xml:"receiver"`
+}
+
+// SNMPReceiverStats is one receiver in /status.
+type SNMPReceiverStats struct {
+	Address   string `json:"address" yaml:"address" xml:"address"`
+	Version   string `json:"version" yaml:"version" xml:"version"`
+	Sent      int64  `json:"sent" yaml:"sent" xml:"sent"`
+	Failed    int64  `json:"failed" yaml:"failed" xml:"failed"`
+	LastError string `json:"last_error,omitempty" yaml:"last_error,omitempty" xml:"last_error,omitempty"`
+}
+
+// snmpReceiverConfig is one entry of snmp_receivers.
+type snmpReceiverConfig struct {
+	Address        string `mapstructure:"address"`
+	Version        string `mapstructure:"version"`
+	Community      string `mapstructure:"community"`
+	User           string `mapstructure:"user"`
+	AuthProtocol   string `mapstructure:"auth_protocol"`
+	AuthPassphrase string `mapstructure:"auth_passphrase"`
+	PrivProtocol   string `mapstructure:"priv_protocol"`
+	PrivPassphrase string `mapstructure:"priv_passphrase"`
+}
+
+var snmpAuthProtocols = map[string]gosnmp.SnmpV3AuthProtocol{
+	"md5": gosnmp.MD5, "sha": gosnmp.SHA, "sha224": gosnmp.SHA224, "sha256": gosnmp.SHA256,
+	"sha384": gosnmp.SHA384, "sha512": gosnmp.SHA512,
+}
+
+var snmpPrivProtocols = map[string]gosnmp.SnmpV3PrivProtocol{
+	"des": gosnmp.DES, "aes": gosnmp.AES, "aes192": gosnmp.AES192, "aes256": gosnmp.AES256,
+	"aes192c": gosnmp.AES192C, "aes256c": gosnmp.AES256C,
+}
+
+// NewSNMPTrapSender returns nil without snmp_receivers.
+func NewSNMPTrapSender(config *viper.Viper) (*SNMPTrapSender, error) {
+
+	var entries []snmpReceiverConfig
+	if err := config.UnmarshalKey("snmp_receivers", &entries); err != nil {
+		return nil, fmt.Errorf("snmp_receivers %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	sender := &SNMPTrapSender{
+		queue:   make(chan *Notification, snmpQueueSize),
+		started: time.Now(),
+	}
+	engineID, err := snmpEngineID(config.GetString("snmp_engine_id"))
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		receiver, err := newSNMPReceiver(entry, engineID, sender.started)
+		if err != nil {
+			return nil, fmt.Errorf("snmp_receivers[%d]: %w", i, err)
+		}
+		sender.receivers = append(sender.receivers, receiver)
+	}
+	return sender, nil
+}
+
+// snmpEngineID is the hex snmp_engine_id, by default one built from the host name.
+func snmpEngineID(value string) (string, error) {
+	if value != "" {
+		id, err := hex.DecodeString(strings.TrimPrefix(strings.ReplaceAll(value, ":", ""), "0x"))
+		if err != nil || len(id) < 5 || len(id) > 32 {
+			return "", fmt.Errorf("snmp_engine_id must be 5 to 32 bytes in hex")
+		}
+		return string(id), nil
+	}
+	host, _ := os.Hostname()
+	text := "hmc_led@" + host
+	if len(text) > 27 {
+		text = text[:27]
+	}
+	// enterprise 32473 with the high bit set, then the format
+	return string([]byte{0x80, 0x00, 0x7e, 0xd9, snmpEngineIDTextType}) + text, nil
+}
+
+func newSNMPReceiver(entry snmpReceiverConfig, engineID string, started time.Time) (*snmpReceiver, error) {
+
+	address := entry.Address
+	if !strings.Contains(address, "://") {
+		address = "udp://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("address %w", err)
+	}
+	transport := strings.ToLower(u.Scheme)
+	if transport != "udp" && transport != "tcp" {
+		return nil, fmt.Errorf("address %s: transport must be udp or tcp", entry.Address)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("address %s: host is missing", entry.Address)
+	}
+	port := snmpDefaultTrapPort
+	if u.Port() != "" {
+		if port, err = strconv.Atoi(u.Port()); err != nil {
+			return nil, fmt.Errorf("address %s: %w", entry.Address, err)
+		}
+	}
+
+	r := &snmpReceiver{
+		snmp: &gosnmp.GoSNMP{
+			Target:    u.Hostname(),
+			Port:      uint16(port),
+			Transport: transport,
+			Timeout:   5 * time.Second,
+			Retries:   1,
+		},
+	}
+	r.stats.Address = transport + "://" + net.JoinHostPort(u.Hostname(), strconv.Itoa(port))
+
+	switch strings.ToLower(entry.Version) {
+	case "", "2c", "v2c":
+		r.snmp.Version = gosnmp.Version2c
+		r.snmp.Community = entry.Community
+		if r.snmp.Community == "" {
+			r.snmp.Community = "public"
+		}
+		r.stats.Version = "2c"
+	case "3", "v3":
+		if entry.User == "" {
+			return nil, fmt.Errorf("user is required for SNMPv3")
+		}
+		r.usm = &gosnmp.UsmSecurityParameters{
+			UserName:                 entry.User,
+			AuthoritativeEngineID:    engineID,
+			AuthoritativeEngineBoots: snmpEngineBoots(started),
+			AuthenticationProtocol:   gosnmp.NoAuth,
+			PrivacyProtocol:          gosnmp.NoPriv,
+		}
+		r.snmp.Version = gosnmp.Version3
+		r.snmp.SecurityModel = gosnmp.UserSecurityModel
+		r.snmp.MsgFlags = gosnmp.NoAuthNoPriv
+		r.snmp.SecurityParameters = r.usm
+		if entry.AuthProtocol != "" {
+			auth, exists := snmpAuthProtocols[strings.ToLower(entry.AuthProtocol)]
+			if !exists {
+				return nil, fmt.Errorf("auth_protocol %s is unknown", entry.AuthProtocol)
+			}
+			r.usm.AuthenticationProtocol = auth
+			r.usm.AuthenticationPassphrase = entry.AuthPassphrase
+			r.snmp.MsgFlags = gosnmp.AuthNoPriv
+		}
+		if entry.PrivProtocol != "" {
+			if entry.AuthProtocol == "" {
+				return nil, fmt.Errorf("priv_protocol requires auth_protocol")
+			}
+			priv, exists := snmpPrivProtocols[strings.ToLower(entry.PrivProtocol)]
+			if !exists {
+				return nil, fmt.Errorf("priv_protocol %s is unknown", entry.PrivProtocol)
+			}
+			r.usm.PrivacyProtocol = priv
+			r.usm.PrivacyPassphrase = entry.PrivPassphrase
+			r.snmp.MsgFlags = gosnmp.AuthPriv
+		}
+		r.stats.Version = "3"
+	default:
+		return nil, fmt.Errorf("version must be 2c or 3")
+	}
+	return r, nil
+}
+
+// snmpEngineBoots must grow with every restart, as there is no place to count them
+// the start time in seconds since 2020 stands in.
+func snmpEngineBoots(started time.Time) uint32 {
+	return uint32(started.Unix() - time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).Unix())
+}
+
+// Notify queues the LED and state notifications, traps of other notifications are not defined.
+func (sender *SNMPTrapSender) Notify(ev *Notification) {
+	switch ev.Kind {
+	case notifyLEDOn, notifyLEDOff, notifyState:
+	default:
+		return
+	}
+	select {
+	case sender.queue <- ev:
+	default:
+		log.Warnf("SNMP trap queue full, %s of %s dropped", ev.Kind, ev.System)
+	}
+}
+
+func (sender *SNMPTrapSender) Stats() interface{} {
+	stats := &SNMPStats{Receivers: []*SNMPReceiverStats{}}
+	for _, r := range sender.receivers {
+		r.mu.Lock()
+		st := r.stats
+		r.mu.Unlock()
+		stats.Receivers = append(stats.Receivers, &st)
+	}
+	return stats
+}
+
+// Run sends the queued traps to all receivers until ctx is done.
+func (sender *SNMPTrapSender) Run(ctx context.Context, wg *sync.WaitGroup) {
+
+	defer wg.Done()
+
+	for _, r := range sender.receivers {
+		log.Infof("SNMPv%s traps to %s", r.stats.Version, r.stats.Address)
+	}
+	defer func() {
+		for _, r := range sender.receivers {
+			if r.snmp.Conn != nil {
+				r.snmp.Conn.Close()
+			}
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-sender.queue:
+			trap := sender.trap(ev)
+			for _, r := range sender.receivers {
+				r.send(trap, time.Since(sender.started))
+			}
+		}
+	}
+}
+
+// trap builds the notification, sysUpTime and snmpTrapOID come first as SNMPv2 requires.
+func (sender *SNMPTrapSender) trap(ev *Notification) gosnmp.SnmpTrap {
+
+	trapOID := oidTrapStateChange
+	switch ev.Kind {
+	case notifyLEDOn:
+		trapOID = oidTrapAttentionOn
+	case notifyLEDOff:
+		trapOID = oidTrapAttentionOff
+	}
+	str := func(oid string, value string) gosnmp.SnmpPDU {
+		return gosnmp.SnmpPDU{Name: oid, Type: gosnmp.OctetString, Value: value}
+	}
+	variables := []gosnmp.SnmpPDU{
+		{Name: oidSysUpTime, Type: gosnmp.TimeTicks, Value: uint32(time.Since(sender.started) / (10 * time.Millisecond))},
+		{Name: oidSnmpTrapOID, Type: gosnmp.ObjectIdentifier, Value: trapOID},
+		str(oidHMCLedHmc, ev.HMC),
+		str(oidHMCLedSystemName, ev.System),
+		str(oidHMCLedMtms, ev.MTMS),
+		str(oidHMCLedSrc, ev.RefCode),
+		str(oidHMCLedLocation, ev.Location),
+	}
+	if ev.Kind == notifyState {
+		variables = append(variables, str(oidHMCLedState, ev.New), str(oidHMCLedPrevState, ev.Old))
+	}
+	variables = append(variables, str(oidHMCLedUuid, ev.UUID))
+	return gosnmp.SnmpTrap{Variables: variables}
+}
+
+func (r *snmpReceiver) send(trap gosnmp.SnmpTrap, uptime time.Duration) {
+
+	var err error
+	if r.snmp.Conn == nil {
+		err = r.snmp.Connect()
+	}
+	if err == nil {
+		if r.usm != nil {
+			r.usm.AuthoritativeEngineTime = uint32(uptime / time.Second)
+		}
+		_, err = r.snmp.SendTrap(trap)
+		if err != nil && r.snmp.Conn != nil {
+			// connect again next time, a TCP receiver may have gone away
+			r.snmp.Conn.Close()
+			r.snmp.Conn = nil
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.stats.Failed++
+		r.stats.LastError = err.Error()
+		log.Errorf("SNMP trap to %s: %s", r.stats.Address, err)
+		return
+	}
+	r.stats.Sent++
+}
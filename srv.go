@@ -3,8 +3,9 @@ package main
 import (
 	"crypto/tls"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
-	"net"
 	"strings"
 
 	//"log/slog"
@@ -14,7 +15,7 @@ import (
 
 	//"bytes"
 
-	//"io"
+	"io"
 
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
@@ -26,28 +27,63 @@ import (
 
 type Srv struct {
 	//router 	*mux.Router
-	srv     *http.Server
-	hmc     *HMC
-	ctx     context.Context
-	tls     bool
-	certKEY string
-	certCRT string
+	srv       *http.Server
+	hmcs      *HMCSet
+	tracker   *SystemTracker
+	limiter   *RateLimiter
+	mqtt      *MQTTPublisher
+	notify    *Notifications
+	notifiers *Notifiers
+	alerts    *AlertEngine
+	silences  *SilenceStore
+	acks      *AckStore
+	ctx       context.Context
+	tls       bool
+	certKEY   string
+	certCRT   string
 }
 
-func (s *Srv) SrvInit(ctx context.Context, config *viper.Viper, hmc *HMC) {
+func (s *Srv) SrvInit(ctx context.Context, config *viper.Viper, hmcs *HMCSet) {
 
 	var err error
+	authenticated := false
+
+	s.limiter = NewRateLimiter(config)
 
 	router := mux.NewRouter()
+	if acl := NewIPACL(config); acl != nil {
+		router.Use(acl.Middleware)
+	}
 	router.HandleFunc("/health", healthCheck).Methods("GET")
 	router.HandleFunc("/status", s.status).Methods("GET")
-	router.HandleFunc("/getManagementConsole", s.getManagementConsole).Methods("GET", "POST") //
-	router.HandleFunc("/quickManagedSystem", s.quickManagedSystem).Methods("GET", "POST")     //
+	router.HandleFunc("/alerts", s.getAlerts).Methods("GET")
+	router.HandleFunc("/silences", s.getSilences).Methods("GET")
+	router.HandleFunc("/silences/{id}", s.getSilence).Methods("GET")
+	router.HandleFunc("/acks", s.getAcks).Methods("GET")
+	router.HandleFunc("/getManagementConsole", s.limiter.Wrap(s.getManagementConsole)).Methods("GET", "POST") //
+	router.HandleFunc("/quickManagedSystem", s.limiter.Wrap(s.quickManagedSystem)).Methods("GET", "POST")     //
+	router.HandleFunc("/systems/{uuid}/partitions", s.limiter.Wrap(s.systemPartitions)).Methods("GET")
+	router.HandleFunc("/systems/{uuid}/serviceable-events", s.limiter.Wrap(s.serviceableEvents)).Methods("GET")
+	router.HandleFunc("/systems/{uuid}/metrics", s.limiter.Wrap(s.systemMetrics)).Methods("GET")
+	router.HandleFunc("/metrics", s.limiter.Wrap(s.metrics)).Methods("GET")
+	router.HandleFunc("/partitions", s.limiter.Wrap(s.partitions)).Methods("GET")
+	router.Handle("/ui", http.RedirectHandler("/ui/", http.StatusMovedPermanently)).Methods("GET")
+	router.PathPrefix("/ui/").Handler(uiHandler()).Methods("GET")
 
 	s.ctx = ctx
-	s.hmc = hmc
+	s.hmcs = hmcs
+	s.tracker = NewSystemTracker(config)
+	if s.notify != nil {
+		s.tracker.Subscribe(s.notify.SystemChanges)
+	}
+	if s.alerts != nil {
+		s.tracker.Observe(s.alerts.Update)
+	}
+	if s.acks != nil {
+		s.tracker.Observe(s.acks.Observe)
+	}
 	s.srv = &http.Server{
-		Handler:      router,
+		Handler:      NewAccessLog(config, NewClientIPResolver(config)).Middleware(router),
 		Addr:         config.GetString("srv_addr") + ":" + config.GetString("srv_port"),
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
@@ -82,7 +118,9 @@ func (s *Srv) SrvInit(ctx context.Context, config *viper.Viper, hmc *HMC) {
 		// Create auth middleware
 		auth := NewAuthMiddleware(config)
 		if auth != nil {
+			auth.notify = s.notify
 			router.Use(auth.Middleware)
+			authenticated = true
 		}
 
 		s.certKEY = config.GetString("server_key")
@@ -94,16 +132,42 @@ func (s *Srv) SrvInit(ctx context.Context, config *viper.Viper, hmc *HMC) {
 		s.tls = false
 	}
 
+	// silences and acknowledgements mute notifications, nobody may change them anonymously
+	if authenticated {
+		router.HandleFunc("/silences", s.postSilence).Methods("POST")
+		router.HandleFunc("/silences/{id}", s.deleteSilence).Methods("DELETE")
+		router.HandleFunc("/systems/{uuid}/ack", s.postAck).Methods("POST")
+		router.HandleFunc("/systems/{uuid}/ack", s.deleteAck).Methods("DELETE")
+	} else {
+		log.Warnf("Srv without basic auth: silences and acknowledgements are read only")
+	}
+
 	ctx, cancel := context.WithTimeout(s.ctx, 15*time.Second)
 	defer cancel()
 
 	// Try to Logon to HMC here, to report any issues at program start, not when first request will be received
-	err = hmc.Logon(ctx, true)
-	if err != nil {
-		log.Errorf("Serv init. No connection to HMC. %s", err)
+	for _, hmc := range hmcs.list {
+		err = hmc.Logon(ctx, true)
+		if err != nil {
+			log.Errorf("Serv init. No connection to HMC %s. %s", hmc.hmcName, err)
+		}
 	}
 }
 
+// requestContext derives a handler context from the server context, keeping the
+// request ID so the HMC client logs can be traced back to the request.
+func (s *Srv) requestContext(r *http.Request, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx := s.ctx
+	if info := requestInfoFrom(r.Context()); info != nil {
+		if len(s.hmcs.list) == 1 {
+			// cached data came from the HMC serving now, as far as we know
+			info.hmcAddress = s.hmcs.list[0].ActiveAddress()
+		}
+		ctx = withRequestInfo(ctx, info)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
 func securityHeadersMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Security headers
@@ -140,29 +204,13 @@ func (s *Srv) Shutdown(ctx context.Context, wg *sync.WaitGroup) {
 	}
 }
 
-func healthCheck(w http.ResponseWriter, r *http.Request) {
-	respondWithJSON(w, http.StatusOK, map[string]string{"Server_status": "OK"})
+type healthResponse struct {
+	XMLName      xml.Name `json:"-" yaml:"-" xml:"health"`
+	ServerStatus string   `json:"Server_status" yaml:"Server_status" xml:"Server_status"`
 }
 
-func getClientIP(r *http.Request) string {
-	// Try various headers that might contain the real client IP
-	headers := []string{
-		"X-Real-Ip",
-		"X-Forwarded-For",
-		"X-Client-Ip",
-		"CF-Connecting-IP", // Cloudflare
-	}
-	for _, header := range headers {
-		if ip := r.Header.Get(header); ip != "" {
-			return ip
-		}
-	}
-	// Fallback to RemoteAddr
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr
-	}
-	return ip
+func healthCheck(w http.ResponseWriter, r *http.Request) {
+	respond(w, r, http.StatusOK, healthResponse{ServerStatus: "OK"})
 }
 
 func tlsVersionToString(version uint16) string {
@@ -180,217 +228,396 @@ func tlsVersionToString(version uint16) string {
 	}
 }
 
+type statusResponse struct {
+	XMLName            xml.Name          `json:"-" yaml:"-" xml:"status"`
+	Srv                string            `json:"server_status" yaml:"server_status" xml:"server_status"`
+	HMC                string            `json:"hmc_connection" yaml:"hmc_connection" xml:"hmc_connection"`
+	LogonRequests      int64             `json:"logon_requests" yaml:"logon_requests" xml:"logon_requests"`
+	URLRequests        int64             `json:"url_requests" yaml:"url_requests" xml:"url_requests"`
+	MgmConsoleRequests int64             `json:"mgmconsole_requests" yaml:"mgmconsole_requests" xml:"mgmconsole_requests"`
+	QuickMgmsRequests  int64             `json:"quick_mgms_requests" yaml:"quick_mgms_requests" xml:"quick_mgms_requests"`
+	CoalescedRequests  int64             `json:"coalesced_requests" yaml:"coalesced_requests" xml:"coalesced_requests"`
+	StaleResponses     int64             `json:"stale_responses" yaml:"stale_responses" xml:"stale_responses"`
+	Session            *SessionStats     `json:"session" yaml:"session" xml:"session"`
+	HMCAddresses       *EndpointStats    `json:"hmc_addresses" yaml:"hmc_addresses" xml:"hmc_addresses"`
+	HMCs               []*hmcStatus      `json:"hmcs,omitempty" yaml:"hmcs,omitempty" xml:"hmcs>hmc,omitempty"`
+	RateLimits         *RateLimitStats   `json:"rate_limits" yaml:"rate_limits" xml:"rate_limits"`
+	MQTT               *MQTTStats        `json:"mqtt,omitempty" yaml:"mqtt,omitempty" xml:"mqtt,omitempty"`
+	Notifiers          []*NotifierStatus `json:"notifiers,omitempty" yaml:"notifiers,omitempty" xml:"notifiers>notifier,omitempty"`
+}
+
+// hmcStatus is the status of every HMC when there are several, the top level fields are the first HMC.
+type hmcStatus struct {
+	Name         string         `json:"name" yaml:"name" xml:"name"`
+	HMC          string         `json:"hmc_connection" yaml:"hmc_connection" xml:"hmc_connection"`
+	URLRequests  int64          `json:"url_requests" yaml:"url_requests" xml:"url_requests"`
+	Session      *SessionStats  `json:"session" yaml:"session" xml:"session"`
+	HMCAddresses *EndpointStats `json:"hmc_addresses" yaml:"hmc_addresses" xml:"hmc_addresses"`
+}
+
 func (s *Srv) status(w http.ResponseWriter, r *http.Request) {
 
-	type Response struct {
-		Srv                string `json:"server_status"`
-		HMC                string `json:"hmc_connection"`
-		LogonRequests      int64  `json:"logon_requests"`
-		URLRequests        int64  `json:"url_requests"`
-		MgmConsoleRequests int64  `json:"mgmconsole_requests"`
-		QuickMgmsRequests  int64  `json:"quick_mgms_requests"`
-	}
-	//hmc := s.hmc
-
-	resp := Response{
-		Srv: "OK",
-		HMC: "",
-		//	LogonRequests:      hmc.logon_requests,
-		//	URLRequests:        hmc.url_requests,
-		//	MgmConsoleRequests: hmc.mgmconsole_requests,
-		//	QuickMgmsRequests:  hmc.quick_mgms_requests,
-	}
-	//if hmc.connected {
-	//	resp.HMC = "Connected"
-	//} else {
-	//	resp.HMC = "Disconnected"
-	//}
-	respondWithJSON(w, http.StatusOK, resp)
+	hmc := s.hmcs.list[0]
+
+	resp := statusResponse{
+		Srv:                "OK",
+		HMC:                "Disconnected",
+		LogonRequests:      hmc.stats.logon_requests.Load(),
+		URLRequests:        hmc.stats.url_requests.Load(),
+		MgmConsoleRequests: hmc.stats.mgmconsole_requests.Load(),
+		QuickMgmsRequests:  hmc.stats.quick_mgms_requests.Load(),
+		CoalescedRequests:  hmc.stats.coalesced_requests.Load(),
+		StaleResponses:     hmc.stats.stale_responses.Load(),
+		Session:            hmc.SessionStats(),
+		HMCAddresses:       hmc.EndpointStats(),
+		RateLimits:         s.limiter.Stats(),
+	}
+	if resp.Session.Connected {
+		resp.HMC = "Connected"
+	}
+	if s.mqtt != nil {
+		resp.MQTT = s.mqtt.Stats()
+	}
+	if s.notifiers != nil {
+		resp.Notifiers = s.notifiers.Stats()
+	}
+	if len(s.hmcs.list) > 1 {
+		for _, hmc := range s.hmcs.list {
+			st := &hmcStatus{
+				Name:         hmc.hmcName,
+				HMC:          "Disconnected",
+				URLRequests:  hmc.stats.url_requests.Load(),
+				Session:      hmc.SessionStats(),
+				HMCAddresses: hmc.EndpointStats(),
+			}
+			if st.Session.Connected {
+				st.HMC = "Connected"
+			}
+			resp.HMCs = append(resp.HMCs, st)
+		}
+	}
+	respond(w, r, http.StatusOK, resp)
+}
+
+// getAlerts lists the pending and firing alerts, the query parameters state, severity and hmc filter them.
+func (s *Srv) getAlerts(w http.ResponseWriter, r *http.Request) {
+
+	resp := &AlertsResponse{Alerts: []*Alert{}}
+	if s.alerts == nil {
+		respond(w, r, http.StatusOK, resp)
+		return
+	}
+	query := r.URL.Query()
+	for _, alert := range s.alerts.Alerts() {
+		if (query.Get("state") != "" && query.Get("state") != alert.State) ||
+			(query.Get("severity") != "" && query.Get("severity") != alert.Severity) ||
+			(query.Get("hmc") != "" && query.Get("hmc") != alert.HMC) {
+			continue
+		}
+		alert.Silenced = s.silences.System(alert.System) != nil
+		resp.Alerts = append(resp.Alerts, alert)
+	}
+	respond(w, r, http.StatusOK, resp)
+}
+
+func (s *Srv) getSilences(w http.ResponseWriter, r *http.Request) {
+	respond(w, r, http.StatusOK, &SilencesResponse{Silences: s.silences.List()})
 }
-func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
-	response, _ := json.Marshal(payload)
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.Header().Set("X-Content-Type-Options", "nosniff")
-	w.WriteHeader(code)
-	w.Write(response)
+func (s *Srv) getSilence(w http.ResponseWriter, r *http.Request) {
+	silence := s.silences.Get(mux.Vars(r)["id"])
+	if silence == nil {
+		respondError(w, r, http.StatusNotFound, "silence not found")
+		return
+	}
+	respond(w, r, http.StatusOK, silence)
+}
+
+// postSilence creates a silence from a JSON body, created_by defaults to the basic auth user.
+func (s *Srv) postSilence(w http.ResponseWriter, r *http.Request) {
+
+	myname := "postSilence"
+	req := &silenceRequest{}
+	decoder := json.NewDecoder(io.LimitReader(r.Body, 64*1024))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(req); err != nil {
+		respondError(w, r, http.StatusBadRequest, "silence: "+err.Error())
+		return
+	}
+	if user, _, ok := r.BasicAuth(); ok && req.CreatedBy == "" {
+		req.CreatedBy = user
+	}
+	silence, err := req.silence(time.Now())
+	if err != nil {
+		respondError(w, r, http.StatusBadRequest, "silence: "+err.Error())
+		return
+	}
+	if err := s.silences.Add(silence); err != nil {
+		ctxLogger(r.Context()).Errorf("%s: %s", myname, err)
+		respondError(w, r, http.StatusInternalServerError, "silence could not be saved")
+		return
+	}
+	ctxLogger(r.Context()).Infof("Silence %s added by %q until %s: %s", silence.ID, silence.CreatedBy, silence.EndsAt.Format(time.RFC3339), silence.Reason)
+	respond(w, r, http.StatusCreated, s.silences.Get(silence.ID))
+}
+
+func (s *Srv) deleteSilence(w http.ResponseWriter, r *http.Request) {
+
+	myname := "deleteSilence"
+	id := mux.Vars(r)["id"]
+	found, err := s.silences.Delete(id)
+	if !found {
+		respondError(w, r, http.StatusNotFound, "silence not found")
+		return
+	}
+	if err != nil {
+		ctxLogger(r.Context()).Errorf("%s: %s", myname, err)
+		respondError(w, r, http.StatusInternalServerError, "silence could not be saved")
+		return
+	}
+	ctxLogger(r.Context()).Infof("Silence %s deleted", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Srv) getAcks(w http.ResponseWriter, r *http.Request) {
+	respond(w, r, http.StatusOK, &AcksResponse{Acks: s.acks.List()})
+}
+
+// postAck acknowledges the lit LED of a system, given by UUID or MTMS, from a JSON body
+// with user, comment and ticket. user defaults to the basic auth user.
+func (s *Srv) postAck(w http.ResponseWriter, r *http.Request) {
+
+	myname := "postAck"
+	req := &ackRequest{}
+	decoder := json.NewDecoder(io.LimitReader(r.Body, 64*1024))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(req); err != nil {
+		respondError(w, r, http.StatusBadRequest, "acknowledgement: "+err.Error())
+		return
+	}
+	if user, _, ok := r.BasicAuth(); ok && req.User == "" {
+		req.User = user
+	}
+	if req.User == "" {
+		respondError(w, r, http.StatusBadRequest, "acknowledgement: user is required")
+		return
+	}
+	ack, err := s.acks.Acknowledge(mux.Vars(r)["uuid"], req)
+	switch {
+	case errors.Is(err, errSystemNotFound):
+		respondError(w, r, http.StatusNotFound, "managed system not found")
+		return
+	case errors.Is(err, errLEDNotLit):
+		respondError(w, r, http.StatusConflict, "attention LED is not lit")
+		return
+	case err != nil:
+		ctxLogger(r.Context()).Errorf("%s: %s", myname, err)
+		respondError(w, r, http.StatusInternalServerError, "acknowledgement could not be saved")
+		return
+	}
+	ctxLogger(r.Context()).Infof("Attention LED of %s acknowledged by %s, ticket %q: %s", ack.SystemName, ack.User, ack.Ticket, ack.Comment)
+	respond(w, r, http.StatusCreated, ack)
+}
+
+func (s *Srv) deleteAck(w http.ResponseWriter, r *http.Request) {
+
+	myname := "deleteAck"
+	found, err := s.acks.Delete(mux.Vars(r)["uuid"])
+	if !found {
+		respondError(w, r, http.StatusNotFound, "acknowledgement not found")
+		return
+	}
+	if err != nil {
+		ctxLogger(r.Context()).Errorf("%s: %s", myname, err)
+		respondError(w, r, http.StatusInternalServerError, "acknowledgement could not be saved")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (s *Srv) getManagementConsole(w http.ResponseWriter, r *http.Request) {
 
-	ctx, cancel := context.WithTimeout(s.ctx, 30*time.Second)
+	ctx, cancel := s.requestContext(r, 30*time.Second)
 	defer cancel()
 
 	myname := "getManagementConsole"
-	hmc := s.hmc
+	hmc := s.hmcs.Get(r.URL.Query().Get("hmc"))
+	if hmc == nil {
+		respondError(w, r, http.StatusNotFound, "HMC not found")
+		return
+	}
 	mgmtConsole, err := hmc.GetManagementConsole(ctx)
 	if err != nil {
-		log.Errorf("%s: %s", myname, err)
-		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"result": "getManagementConsole error"})
+		ctxLogger(ctx).Errorf("%s: %s", myname, err)
+		respondError(w, r, http.StatusInternalServerError, "getManagementConsole error")
+		return
+	}
+	mgmConsole := &ManagementConsole{}
+	if err = xml.Unmarshal(mgmtConsole, mgmConsole); err != nil {
+		ctxLogger(ctx).Errorf("%s: %s", myname, err)
+		respondError(w, r, http.StatusBadGateway, "getManagementConsole parse error")
+		return
 	}
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.Header().Set("X-Content-Type-Options", "nosniff")
-	w.WriteHeader(http.StatusOK)
-	w.Write(mgmtConsole)
+	respond(w, r, http.StatusOK, rawXML{data: mgmtConsole, decoded: mgmConsole})
 }
 
 func (s *Srv) quickManagedSystem(w http.ResponseWriter, r *http.Request) {
 
-	type QuickMgms struct {
-		UUID string `json:"uuid"`
-		HMC  string `json:"hmc"`
-		//HMCmtms   string `json:"hmc_mtms"`
-		MTMS          string `json:"mtms"`
-		SysName       string `json:"systemname"`
-		State         string `json:"state"`
-		LED           bool   `json:"led"`
-		RefCode       string `json:"rfc"`
-		MergedRefCode string `json:"mrfc"`
-		Location      string `json:"location"`
-		//Timestamp int64  `json:"timestamp"`
-		Elapsed int64 `json:"elapsed"`
-	}
-	type RespJson struct {
-		HMC     string `json:"hmc"`
-		HMCmtms string `json:"hmc_mtms"`
-		//HMCuuid   string      `json:"hmc_uuid"`
-		//Timestamp int64       `json:"timestamp"`
-		Elapsed int64        `json:"elapsed"`
-		Systems []*QuickMgms `json:"systems"`
-	}
-
-	//var err error
-
-	globalStart := time.Now()
-
-	ctx, cancel := context.WithTimeout(s.ctx, 60*time.Second)
+	ctx, cancel := s.requestContext(r, 60*time.Second)
 	defer cancel()
 
 	myname := "quickManagedSystem"
-	hmc := s.hmc
-
-	ip_tls := getClientIP(r)
-	if s.tls {
-		ip_tls = fmt.Sprintf("%s (%s)", ip_tls, tlsVersionToString(r.TLS.Version))
+	respJson, err := s.hmcs.CollectQuickMgms(ctx)
+	if err != nil {
+		ctxLogger(ctx).Errorf("%s, calling CollectQuickMgms err=%s", myname, err)
+		respondError(w, r, http.StatusInternalServerError, "getManagementConsoleData error")
+		return
 	}
-	log.Infof("%s, hmc: %s, connection from: %s", myname, hmc.hmcName, ip_tls)
+	s.tracker.Update(respJson.Systems, false)
+	s.silences.Mark(respJson.Systems)
+	s.acks.Mark(respJson.Systems)
+	respond(w, r, http.StatusOK, respJson)
+}
+
+func (s *Srv) systemPartitions(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := s.requestContext(r, 60*time.Second)
+	defer cancel()
 
-	mgmConsole, err := hmc.GetManagementConsoleData(ctx)
+	myname := "systemPartitions"
+	hmc, system, err := s.hmcs.GetSystem(ctx, mux.Vars(r)["uuid"])
+	if errors.Is(err, errSystemNotFound) {
+		respondError(w, r, http.StatusNotFound, "managed system not found")
+		return
+	}
 	if err != nil {
-		log.Errorf("%s, calling GetManagementConsoleData err=%s", myname, err)
-		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"result": "getManagementConsoleData error"})
+		ctxLogger(ctx).Errorf("%s, calling GetSystem err=%s", myname, err)
+		respondError(w, r, http.StatusInternalServerError, "getManagedSystem error")
 		return
 	}
-	totServers := len(mgmConsole.Links)
-
-	respJson := &RespJson{
-		HMC:     hmc.hmcName,
-		HMCmtms: mgmConsole.HMCType + "-" + mgmConsole.HMCMod + "*" + mgmConsole.HMCSerial,
-		//HMCuuid: mgmConsole.ID,
-		//Timestamp: time.Now().Unix(),
-		Elapsed: 0,
-		Systems: []*QuickMgms{},
-	}
-
-	//var system QuickMgms
-
-	for num, elem := range mgmConsole.Links {
-
-		a := strings.Split(elem.Href, "/")
-		uuid := a[len(a)-1]
-
-		system := &QuickMgms{
-			UUID: uuid,
-			HMC:  respJson.HMC,
-			//HMCmtms:    respJson.HMCmtms,
-			MTMS:          "",
-			SysName:       "",
-			State:         "",
-			LED:           false,
-			RefCode:       "",
-			MergedRefCode: "",
-			Location:      "",
-			//Timestamp:    0,
-			Elapsed: 0,
-		}
-		serverStart := time.Now()
+	partitions, err := hmc.GetPartitions(ctx, system)
+	if err != nil {
+		ctxLogger(ctx).Errorf("%s, calling GetPartitions err=%s", myname, err)
+		respondError(w, r, http.StatusInternalServerError, "getPartitions error")
+		return
+	}
+	respond(w, r, http.StatusOK, &PartitionsResponse{HMC: hmc.hmcName, Partitions: partitions})
+}
 
-		jsonData, err := hmc.GetMgmsQuick(ctx, uuid)
-		if err != nil {
-			log.Errorf("%s. GetMgmsQuick err=%s", myname, err)
-			continue
-		}
-		mapData := make(map[string]interface{})
-		err = json.Unmarshal([]byte(jsonData), &mapData)
+func (s *Srv) partitions(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := s.requestContext(r, 120*time.Second)
+	defer cancel()
+
+	myname := "partitions"
+	respJson, err := s.hmcs.CollectQuickMgms(ctx)
+	if err != nil {
+		ctxLogger(ctx).Errorf("%s, calling CollectQuickMgms err=%s", myname, err)
+		respondError(w, r, http.StatusInternalServerError, "getManagementConsoleData error")
+		return
+	}
+	resp := &PartitionsResponse{HMC: s.hmcs.Name(), Partitions: []*Partition{}}
+	for _, system := range respJson.Systems {
+		partitions, err := s.hmcs.Get(system.HMC).GetPartitions(ctx, system)
 		if err != nil {
-			log.Errorf("%s. unmarshal error: %s", myname, err)
+			ctxLogger(ctx).Errorf("%s, calling GetPartitions err=%s", myname, err)
 			continue
 		}
-		var value interface{}
-		var exists bool
-		var str string
-
-		//if value, exists = mapData["MTMS"]; exists {
-		//	system.MTMS = assertString(value)
-		//}
-		if value, exists = mapData["MTMS"]; exists {
-			mtms := assertString(value)
-			mtm, s, found := strings.Cut(mtms, "*")
-			if found {
-				system.MTMS = mtm + "-" + s
-			} else {
-				system.MTMS = mtms
-			}
-		}
-		if value, exists = mapData["SystemName"]; exists {
-			system.SysName = assertString(value)
-		}
-		if value, exists = mapData["State"]; exists {
-			system.State = assertString(value)
-		}
-		if value, exists = mapData["SystemLocation"]; exists {
-			system.Location = assertString(value)
-		}
-		if value, exists = mapData["PhysicalSystemAttentionLEDState"]; exists {
-			str = assertString(value)
-			if str == "null" {
-				str = "false"
-			}
-			if str == "false" {
-				system.LED = false
-			} else {
-				system.LED = true
-			}
-			//system.LED = str
-		}
-		if value, exists = mapData["ReferenceCode"]; exists {
-			system.RefCode = assertString(value)
-		}
-		if value, exists = mapData["MergedReferenceCode"]; exists {
-			system.MergedRefCode = assertString(value)
-		}
-		//system.Timestamp = time.Now().Unix()
-		system.Elapsed = int64(time.Since(serverStart)) / 1000000
+		resp.Partitions = append(resp.Partitions, partitions...)
+	}
+	respond(w, r, http.StatusOK, resp)
+}
 
-		log.Debugf("%s ---> %s %3d/%d: %s", myname, hmc.hmcName, num+1, totServers, system.MTMS)
+func (s *Srv) serviceableEvents(w http.ResponseWriter, r *http.Request) {
 
-		respJson.Systems = append(respJson.Systems, system)
+	ctx, cancel := s.requestContext(r, 60*time.Second)
+	defer cancel()
 
+	myname := "serviceableEvents"
+	hmc, system, err := s.hmcs.GetSystem(ctx, mux.Vars(r)["uuid"])
+	if errors.Is(err, errSystemNotFound) {
+		respondError(w, r, http.StatusNotFound, "managed system not found")
+		return
+	}
+	if err != nil {
+		ctxLogger(ctx).Errorf("%s, calling GetSystem err=%s", myname, err)
+		respondError(w, r, http.StatusInternalServerError, "getManagedSystem error")
+		return
+	}
+	events, err := hmc.SystemServiceableEvents(ctx, system.MTMS)
+	if err != nil {
+		ctxLogger(ctx).Errorf("%s, calling SystemServiceableEvents err=%s", myname, err)
+		respondError(w, r, http.StatusInternalServerError, "getServiceableEvents error")
+		return
+	}
+	resp := &ServiceableEventsResponse{
+		HMC:        hmc.hmcName,
+		SystemUUID: system.UUID,
+		SystemName: system.SysName,
+		MTMS:       system.MTMS,
+		Events:     events,
+	}
+	for _, ev := range events {
+		if ev.Open() {
+			resp.Open++
+		}
 	}
+	respond(w, r, http.StatusOK, resp)
+}
+
+func (s *Srv) systemMetrics(w http.ResponseWriter, r *http.Request) {
 
-	respJson.Elapsed = int64(time.Since(globalStart)) / 1000000
-	jsonData, _ := json.MarshalIndent(respJson, "", "  ")
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.Header().Set("X-Content-Type-Options", "nosniff")
-	w.WriteHeader(http.StatusOK)
-	w.Write(jsonData)
+	ctx, cancel := s.requestContext(r, 60*time.Second)
+	defer cancel()
 
+	myname := "systemMetrics"
+	hmc, system, err := s.hmcs.GetSystem(ctx, mux.Vars(r)["uuid"])
+	if errors.Is(err, errSystemNotFound) {
+		respondError(w, r, http.StatusNotFound, "managed system not found")
+		return
+	}
+	if err != nil {
+		ctxLogger(ctx).Errorf("%s, calling GetSystem err=%s", myname, err)
+		respondError(w, r, http.StatusInternalServerError, "getManagedSystem error")
+		return
+	}
+	metrics, err := hmc.GetSystemMetrics(ctx, system)
+	if errors.Is(err, errPCMDisabled) {
+		respondError(w, r, http.StatusConflict, errPCMDisabled.Error())
+		return
+	}
+	if err != nil {
+		ctxLogger(ctx).Errorf("%s, calling GetSystemMetrics err=%s", myname, err)
+		respondError(w, r, http.StatusInternalServerError, "getSystemMetrics error")
+		return
+	}
+	respond(w, r, http.StatusOK, &MetricsResponse{HMC: hmc.hmcName, Systems: []*SystemMetrics{metrics}})
 }
 
-func assertString(value interface{}) string {
-	if str, ok := value.(string); ok {
-		return str
-	} else {
-		return ""
+func (s *Srv) metrics(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := s.requestContext(r, 120*time.Second)
+	defer cancel()
+
+	myname := "metrics"
+	respJson, err := s.hmcs.CollectQuickMgms(ctx)
+	if err != nil {
+		ctxLogger(ctx).Errorf("%s, calling CollectQuickMgms err=%s", myname, err)
+		respondError(w, r, http.StatusInternalServerError, "getManagementConsoleData error")
+		return
+	}
+	resp := &MetricsResponse{HMC: s.hmcs.Name(), Systems: []*SystemMetrics{}}
+	for _, system := range respJson.Systems {
+		metrics, err := s.hmcs.Get(system.HMC).GetSystemMetrics(ctx, system)
+		if errors.Is(err, errPCMDisabled) {
+			ctxLogger(ctx).Debugf("%s, %s: %s", myname, system.SysName, err)
+			continue
+		}
+		if err != nil {
+			ctxLogger(ctx).Errorf("%s, calling GetSystemMetrics err=%s", myname, err)
+			continue
+		}
+		resp.Systems = append(resp.Systems, metrics)
 	}
+	respond(w, r, http.StatusOK, resp)
 }
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// syslogQueueSize notifications wait for the syslog server, more are dropped.
+const syslogQueueSize = 256
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11, "ntp": 12, "security": 13, "console": 14,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var syslogSeverities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3, "error": 3, "warning": 4, "warn": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+// cefSeverity maps the syslog severity to the CEF 0-10 scale.
+var cefSeverity = [8]int{10, 9, 8, 7, 5, 3, 2, 0}
+
+// default severity of the notification kinds, syslog_severity overrides them
+var syslogDefaultSeverity = map[string]int{
+	notifyLEDOn:        4,
+	notifyLEDOff:       5,
+	notifyState:        5,
+	notifyRefCode:      4,
+	notifyLogonFailure: 3,
+	notifyAuthFailure:  4,
+	notifyAlertFiring:  4,
+	notifyAlertResolve: 5,
+}
+
+func init() {
+	RegisterNotifier("syslog", func(config *viper.Viper, deps *NotifierDeps) (Notifier, error) {
+		if sl, err := NewSyslogNotifier(config); sl != nil || err != nil {
+			return sl, err
+		}
+		return nil, nil
+	})
+}
+
+// SyslogNotifier sends notifications as RFC 5424 syslog messages, the message text or a
+// CEF record, over UDP, TCP (octet counting framing), TLS or a local socket.
+type SyslogNotifier struct {
+	network   string // udp, tcp, tls or unix
+	address   string
+	tlsConfig *tls.Config
+	facility  int
+	severity  map[string]int
+	cef       bool
+	hostname  string
+	appName   string
+	sdID      string
+	template  *texttemplate.Template // the message text, not for CEF
+	queue     chan *Notification
+
+	mu    sync.Mutex
+	stats SyslogStats
+}
+
+// SyslogStats is the syslog part of /status.
+type SyslogStats struct {
+	Address   string `json:"address" yaml:"address" xml:"address"`
+	Connected bool   `json:"connected" yaml:"connected" xml:"connected"`
+	Sent      int64  `json:"sent" yaml:"sent" xml:"sent"`
+	Dropped   int64  `json:"dropped" yaml:"dropped" xml:"dropped"`
+	LastError string `json:"last_error,omitempty" yaml:"last_error,omitempty" xml:"last_error,omitempty"`
+}
+
+// NewSyslogNotifier returns nil without syslog_address, which is udp://host[:514],
+// tcp://host[:514], tls://host[:6514] or unix:///dev/log.
+func NewSyslogNotifier(config *viper.Viper) (*SyslogNotifier, error) {
+
+	address := config.GetString("syslog_address")
+	if address == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("syslog_address %w", err)
+	}
+	sl := &SyslogNotifier{
+		network:  strings.ToLower(u.Scheme),
+		address:  u.Host,
+		appName:  config.GetString("syslog_app_name"),
+		hostname: config.GetString("syslog_hostname"),
+		sdID:     config.GetString("syslog_sd_id"),
+		severity: map[string]int{},
+		queue:    make(chan *Notification, syslogQueueSize),
+	}
+	switch sl.network {
+	case "udp", "tcp":
+		if u.Port() == "" {
+			sl.address = net.JoinHostPort(u.Hostname(), "514")
+		}
+	case "tls":
+		if u.Port() == "" {
+			sl.address = net.JoinHostPort(u.Hostname(), "6514")
+		}
+		if sl.tlsConfig, err = newSyslogTLSConfig(config, u.Hostname()); err != nil {
+			return nil, err
+		}
+	case "unix":
+		sl.address = u.Path
+	default:
+		return nil, fmt.Errorf("syslog_address %s: scheme must be udp, tcp, tls or unix", address)
+	}
+	if sl.address == "" {
+		return nil, fmt.Errorf("syslog_address %s: address is missing", address)
+	}
+
+	facility := strings.ToLower(config.GetString("syslog_facility"))
+	if facility == "" {
+		facility = "local0"
+	}
+	if f, exists := syslogFacilities[facility]; exists {
+		sl.facility = f
+	} else if f, err := strconv.Atoi(facility); err == nil && f >= 0 && f < 24 {
+		sl.facility = f
+	} else {
+		return nil, fmt.Errorf("syslog_facility %s is unknown", facility)
+	}
+
+	for kind, def := range syslogDefaultSeverity {
+		sl.severity[kind] = def
+	}
+	for kind, name := range config.GetStringMapString("syslog_severity") {
+		if _, exists := syslogDefaultSeverity[kind]; !exists {
+			return nil, fmt.Errorf("syslog_severity: unknown notification %s", kind)
+		}
+		severity, exists := syslogSeverities[strings.ToLower(name)]
+		if !exists {
+			return nil, fmt.Errorf("syslog_severity %s: unknown severity %s", kind, name)
+		}
+		sl.severity[kind] = severity
+	}
+
+	switch strings.ToLower(config.GetString("syslog_format")) {
+	case "", "rfc5424":
+	case "cef":
+		sl.cef = true
+	default:
+		return nil, fmt.Errorf("syslog_format must be rfc5424 or cef")
+	}
+	if sl.appName == "" {
+		sl.appName = "hmc_led"
+	}
+	if sl.hostname == "" {
+		sl.hostname, _ = os.Hostname()
+	}
+	if sl.template, err = messageTemplate(config, "syslog_template"); err != nil {
+		return nil, err
+	}
+	if sl.sdID == "" {
+		sl.sdID = "hmc_led@32473"
+	}
+	sl.stats.Address = sl.network + "://" + sl.address
+	return sl, nil
+}
+
+func newSyslogTLSConfig(config *viper.Viper, host string) (*tls.Config, error) {
+
+	tlsConfig := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+	if caFile := config.GetString("syslog_ca_file"); caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("syslog_ca_file %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("syslog_ca_file %s: no PEM certificates found", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if strings.ToLower(config.GetString("syslog_tls_skip_verify")) == "yes" {
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return tlsConfig, nil
+}
+
+// Notify queues a notification.
+func (sl *SyslogNotifier) Notify(ev *Notification) {
+	select {
+	case sl.queue <- ev:
+	default:
+		sl.mu.Lock()
+		sl.stats.Dropped++
+		sl.mu.Unlock()
+	}
+}
+
+func (sl *SyslogNotifier) Stats() interface{} {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	stats := sl.stats
+	return &stats
+}
+
+// Run writes the queued notifications until ctx is done. The connection is opened on
+// demand and opened again after a failed write, the message is retried once.
+func (sl *SyslogNotifier) Run(ctx context.Context, wg *sync.WaitGroup) {
+
+	defer wg.Done()
+
+	log.Infof("Syslog notifications to %s, facility %d", sl.stats.Address, sl.facility)
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-sl.queue:
+			msg := sl.format(ev)
+			var err error
+			for attempt := 0; attempt < 2; attempt++ {
+				if conn == nil {
+					if conn, err = sl.dial(ctx); err != nil {
+						break
+					}
+				}
+				if err = sl.write(conn, msg); err == nil {
+					break
+				}
+				conn.Close()
+				conn = nil
+			}
+			sl.mu.Lock()
+			sl.stats.Connected = conn != nil
+			if err != nil {
+				sl.stats.Dropped++
+				sl.stats.LastError = err.Error()
+			} else {
+				sl.stats.Sent++
+			}
+			sl.mu.Unlock()
+			if err != nil {
+				log.Errorf("Syslog %s: %s", sl.stats.Address, err)
+			}
+		}
+	}
+}
+
+func (sl *SyslogNotifier) dial(ctx context.Context) (net.Conn, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	switch sl.network {
+	case "tls":
+		dialer := &tls.Dialer{Config: sl.tlsConfig}
+		return dialer.DialContext(ctx, "tcp", sl.address)
+	case "unix":
+		// /dev/log is a datagram socket on most systems
+		dialer := &net.Dialer{}
+		conn, err := dialer.DialContext(ctx, "unixgram", sl.address)
+		if err == nil {
+			return conn, nil
+		}
+		return dialer.DialContext(ctx, "unix", sl.address)
+	default:
+		dialer := &net.Dialer{}
+		return dialer.DialContext(ctx, sl.network, sl.address)
+	}
+}
+
+func (sl *SyslogNotifier) write(conn net.Conn, msg string) error {
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if sl.network == "tcp" || sl.network == "tls" {
+		// RFC 6587 octet counting
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+	_, err := conn.Write([]byte(msg))
+	return err
+}
+
+// format builds the RFC 5424 message:
+//
+//	<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD-ID param="value" ...] MSG
+func (sl *SyslogNotifier) format(ev *Notification) string {
+
+	severity := sl.severity[ev.Kind]
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d %s ", sl.facility*8+severity, ev.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogHeaderField(sl.hostname, 255), syslogHeaderField(sl.appName, 48), os.Getpid(), syslogHeaderField(ev.Kind, 32))
+
+	b.WriteString("[" + sl.sdID)
+	for _, p := range ev.fields() {
+		fmt.Fprintf(&b, " %s=\"%s\"", p[0], syslogParamEscaper.Replace(p[1]))
+	}
+	b.WriteString("] ")
+
+	if sl.cef {
+		b.WriteString(ev.cef(cefSeverity[severity]))
+	} else {
+		b.WriteString(ev.render(sl.template))
+	}
+	return b.String()
+}
+
+// fields are the non empty attributes of a notification, as name and value.
+func (ev *Notification) fields() [][2]string {
+	fields := [][2]string{}
+	for _, p := range [][2]string{
+		{"hmc", ev.HMC}, {"system", ev.System}, {"uuid", ev.UUID}, {"mtms", ev.MTMS},
+		{"refcode", ev.RefCode}, {"location", ev.Location}, {"old", ev.Old}, {"new", ev.New}, {"client", ev.Client}, {"user", ev.User},
+		{"rule", ev.Rule}, {"severity", ev.Severity},
+	} {
+		if p[1] != "" {
+			fields = append(fields, p)
+		}
+	}
+	return fields
+}
+
+var syslogParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// syslogHeaderField is printable ASCII without spaces, "-" when empty.
+func syslogHeaderField(s string, max int) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "-"
+	}
+	if len(s) > max {
+		s = s[:max]
+	}
+	return s
+}
+
+// cef is the notification in ArcSight Common Event Format.
+func (ev *Notification) cef(severity int) string {
+
+	header := strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	ext := strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+
+	extension := []string{"rt=" + strconv.FormatInt(ev.Time.UnixMilli(), 10), "msg=" + ext.Replace(ev.Message)}
+	for _, p := range [][2]string{{"dvchost", ev.HMC}, {"src", ev.Client}, {"suser", ev.User}} {
+		if p[1] != "" {
+			extension = append(extension, p[0]+"="+ext.Replace(p[1]))
+		}
+	}
+	// custom strings, with their labels
+	for i, p := range [][2]string{{"system", ev.System}, {"mtms", ev.MTMS}, {"uuid", ev.UUID}, {"old", ev.Old}, {"new", ev.New}, {"refcode", ev.RefCode}} {
+		if p[1] != "" {
+			extension = append(extension, fmt.Sprintf("cs%dLabel=%s cs%d=%s", i+1, p[0], i+1, ext.Replace(p[1])))
+		}
+	}
+	return fmt.Sprintf("CEF:0|vgrusdev|hmc_led|%s|%s|%s|%d|%s", header.Replace(version), header.Replace(ev.Kind),
+		header.Replace(cefName(ev.Kind)), severity, strings.Join(extension, " "))
+}
+
+func cefName(kind string) string {
+	switch kind {
+	case notifyLEDOn:
+		return "Attention LED on"
+	case notifyLEDOff:
+		return "Attention LED off"
+	case notifyState:
+		return "Managed system state change"
+	case notifyRefCode:
+		return "Reference code change"
+	case notifyLogonFailure:
+		return "HMC logon failure"
+	case notifyAuthFailure:
+		return "Authentication failure"
+	case notifyAlertFiring:
+		return "Alert firing"
+	case notifyAlertResolve:
+		return "Alert resolved"
+	default:
+		return kind
+	}
+}
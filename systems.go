@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QuickMgms is the LED status of one managed system, built from the HMC ManagedSystem quick data.
+type QuickMgms struct {
+	UUID string `json:"uuid" yaml:"uuid" xml:"uuid"`
+	HMC  string `json:"hmc" yaml:"hmc" xml:"hmc"`
+	//HMCmtms   string `json:"hmc_mtms"`
+	MTMS          string `json:"mtms" yaml:"mtms" xml:"mtms"`
+	SysName       string `json:"systemname" yaml:"systemname" xml:"systemname"`
+	State         string `json:"state" yaml:"state" xml:"state"`
+	LED           bool   `json:"led" yaml:"led" xml:"led"`
+	RefCode       string `json:"rfc" yaml:"rfc" xml:"rfc"`
+	MergedRefCode string `json:"mrfc" yaml:"mrfc" xml:"mrfc"`
+	Location      string `json:"location" yaml:"location" xml:"location"`
+	//Timestamp int64  `json:"timestamp"`
+	Elapsed    int64     `json:"elapsed" yaml:"elapsed" xml:"elapsed"`
+	LastChange time.Time `json:"last_change" yaml:"last_change" xml:"last_change"`
+	OpenEvents int       `json:"open_events" yaml:"open_events" xml:"open_events"`
+	// "unavailable" when the serviceable events could not be retrieved, OpenEvents is unknown
+	OpenEventsErr string `json:"open_events_error,omitempty" yaml:"open_events_error,omitempty" xml:"open_events_error,omitempty"`
+	// all HMCs managing the frame, when hmc_led knows several
+	ManagedBy []*ManagingHMC `json:"managed_by,omitempty" yaml:"managed_by,omitempty" xml:"managed_by>managing_hmc,omitempty"`
+	// the LED, state or reference code changes too often, changes are held
+	Flapping bool `json:"flapping" yaml:"flapping" xml:"flapping"`
+	// an active silence mutes the notifications of the system
+	Silenced   bool   `json:"silenced" yaml:"silenced" xml:"silenced"`
+	SilencedBy string `json:"silenced_by,omitempty" yaml:"silenced_by,omitempty" xml:"silenced_by,omitempty"`
+	// the lit LED is known to an operator
+	Ack *Acknowledgement `json:"ack,omitempty" yaml:"ack,omitempty" xml:"ack,omitempty"`
+}
+
+// RespJson is the /quickManagedSystem response.
+type RespJson struct {
+	XMLName xml.Name `json:"-" yaml:"-" xml:"quickManagedSystem"`
+	HMC     string   `json:"hmc" yaml:"hmc" xml:"hmc"`
+	HMCmtms string   `json:"hmc_mtms" yaml:"hmc_mtms" xml:"hmc_mtms"`
+	//HMCuuid   string      `json:"hmc_uuid"`
+	//Timestamp int64       `json:"timestamp"`
+	Elapsed int64        `json:"elapsed" yaml:"elapsed" xml:"elapsed"`
+	Systems []*QuickMgms `json:"systems" yaml:"systems" xml:"systems>system"`
+}
+
+// CollectQuickMgms retrieves the quick data of every managed system known to the HMC.
+// Systems which could not be retrieved are logged and skipped.
+func (hmc *HMC) CollectQuickMgms(ctx context.Context) (*RespJson, error) {
+
+	myname := "CollectQuickMgms"
+	logger := ctxLogger(ctx)
+	globalStart := time.Now()
+
+	mgmConsole, err := hmc.GetManagementConsoleData(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s %w", myname, err)
+	}
+	totServers := len(mgmConsole.Links)
+
+	respJson := &RespJson{
+		HMC:     hmc.hmcName,
+		HMCmtms: mgmConsole.HMCType + "-" + mgmConsole.HMCMod + "*" + mgmConsole.HMCSerial,
+		//HMCuuid: mgmConsole.ID,
+		//Timestamp: time.Now().Unix(),
+		Elapsed: 0,
+		Systems: []*QuickMgms{},
+	}
+
+	for num, elem := range mgmConsole.Links {
+
+		a := strings.Split(elem.Href, "/")
+		uuid := a[len(a)-1]
+
+		serverStart := time.Now()
+
+		jsonData, err := hmc.GetMgmsQuickCached(ctx, uuid)
+		if err != nil {
+			logger.Errorf("%s. GetMgmsQuick err=%s", myname, err)
+			continue
+		}
+		system, err := parseQuickMgms(uuid, hmc.hmcName, jsonData)
+		if err != nil {
+			logger.Errorf("%s. %s", myname, err)
+			continue
+		}
+		system.Elapsed = int64(time.Since(serverStart)) / 1000000
+
+		logger.Debugf("%s ---> %s %3d/%d: %s", myname, hmc.hmcName, num+1, totServers, system.MTMS)
+
+		respJson.Systems = append(respJson.Systems, system)
+	}
+
+	events, err := hmc.GetServiceableEvents(ctx)
+	if err != nil {
+		// the detail names HMC URLs, clients only learn that the count is missing
+		logger.Warnf("%s. Open events unknown: %s", myname, err)
+	}
+	for _, system := range respJson.Systems {
+		if err != nil {
+			system.OpenEventsErr = "unavailable"
+			continue
+		}
+		for _, ev := range events {
+			if ev.MTMS == system.MTMS && ev.Open() {
+				system.OpenEvents++
+			}
+		}
+	}
+
+	respJson.Elapsed = int64(time.Since(globalStart)) / 1000000
+	return respJson, nil
+}
+
+// errSystemNotFound is returned for a managed system UUID the HMC does not manage.
+var errSystemNotFound = errors.New("managed system not found")
+
+// GetSystem retrieves the quick data of one managed system.
+func (hmc *HMC) GetSystem(ctx context.Context, uuid string) (*QuickMgms, error) {
+
+	myname := "GetSystem"
+
+	mgmConsole, err := hmc.GetManagementConsoleData(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s %w", myname, err)
+	}
+	found := false
+	for _, elem := range mgmConsole.Links {
+		if strings.HasSuffix(elem.Href, "/"+uuid) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%s %s: %w", myname, uuid, errSystemNotFound)
+	}
+
+	start := time.Now()
+	jsonData, err := hmc.GetMgmsQuickCached(ctx, uuid)
+	if err != nil {
+		return nil, fmt.Errorf("%s %w", myname, err)
+	}
+	system, err := parseQuickMgms(uuid, hmc.hmcName, jsonData)
+	if err != nil {
+		return nil, fmt.Errorf("%s %w", myname, err)
+	}
+	system.Elapsed = int64(time.Since(start)) / 1000000
+	return system, nil
+}
+
+// parseQuickMgms converts ManagedSystem quick JSON data into QuickMgms.
+func parseQuickMgms(uuid string, hmcName string, jsonData []byte) (*QuickMgms, error) {
+
+	system := &QuickMgms{
+		UUID: uuid,
+		HMC:  hmcName,
+	}
+
+	mapData := make(map[string]interface{})
+	if err := json.Unmarshal(jsonData, &mapData); err != nil {
+		return nil, fmt.Errorf("unmarshal error: %w", err)
+	}
+	var value interface{}
+	var exists bool
+	var str string
+
+	if value, exists = mapData["MTMS"]; exists {
+		mtms := assertString(value)
+		mtm, s, found := strings.Cut(mtms, "*")
+		if found {
+			system.MTMS = mtm + "-" + s
+		} else {
+			system.MTMS = mtms
+		}
+	}
+	if value, exists = mapData["SystemName"]; exists {
+		system.SysName = assertString(value)
+	}
+	if value, exists = mapData["State"]; exists {
+		system.State = assertString(value)
+	}
+	if value, exists = mapData["SystemLocation"]; exists {
+		system.Location = assertString(value)
+	}
+	if value, exists = mapData["PhysicalSystemAttentionLEDState"]; exists {
+		str = assertString(value)
+		if str == "null" {
+			str = "false"
+		}
+		if str == "false" {
+			system.LED = false
+		} else {
+			system.LED = true
+		}
+	}
+	if value, exists = mapData["ReferenceCode"]; exists {
+		system.RefCode = assertString(value)
+	}
+	if value, exists = mapData["MergedReferenceCode"]; exists {
+		system.MergedRefCode = assertString(value)
+	}
+	return system, nil
+}
+
+func assertString(value interface{}) string {
+	if str, ok := value.(string); ok {
+		return str
+	} else {
+		return ""
+	}
+}
+
+// MarshalCSV renders one row per managed system.
+func (resp *RespJson) MarshalCSV() [][]string {
+	records := [][]string{
+		{"hmc", "hmc_mtms", "uuid", "mtms", "systemname", "state", "led", "rfc", "mrfc", "location", "elapsed", "last_change", "open_events", "managed_by", "flapping", "silenced", "ack_user", "ack_ticket"},
+	}
+	for _, s := range resp.Systems {
+		ack := &Acknowledgement{}
+		if s.Ack != nil {
+			ack = s.Ack
+		}
+		openEvents := strconv.Itoa(s.OpenEvents)
+		if s.OpenEventsErr != "" {
+			openEvents = ""
+		}
+		managedBy := []string{}
+		for _, m := range s.ManagedBy {
+			managedBy = append(managedBy, m.HMC+":"+m.State)
+		}
+		records = append(records, []string{
+			s.HMC, resp.HMCmtms, s.UUID, s.MTMS, s.SysName, s.State,
+			strconv.FormatBool(s.LED), s.RefCode, s.MergedRefCode, s.Location,
+			strconv.FormatInt(s.Elapsed, 10), s.LastChange.Format(time.RFC3339), openEvents,
+			strings.Join(managedBy, ";"), strconv.FormatBool(s.Flapping), strconv.FormatBool(s.Silenced), ack.User, ack.Ticket,
+		})
+	}
+	return records
+}
+
+// WritePrometheus renders the LED status in the Prometheus text exposition format.
+func (resp *RespJson) WritePrometheus(w io.Writer) {
+	fmt.Fprintln(w, "# HELP hmc_led_attention_led Physical system attention LED state (1 = lit).")
+	fmt.Fprintln(w, "# TYPE hmc_led_attention_led gauge")
+	for _, s := range resp.Systems {
+		fmt.Fprintf(w, "hmc_led_attention_led{%s} %d\n", systemLabels(s), boolToInt(s.LED))
+	}
+	fmt.Fprintln(w, "# HELP hmc_led_system_info Managed system state and reference code.")
+	fmt.Fprintln(w, "# TYPE hmc_led_system_info gauge")
+	for _, s := range resp.Systems {
+		fmt.Fprintf(w, "hmc_led_system_info{%s,state=%s,rfc=%s} 1\n",
+			systemLabels(s), promQuote(s.State), promQuote(s.RefCode))
+	}
+	fmt.Fprintln(w, "# HELP hmc_led_open_serviceable_events Number of open serviceable events of the managed system.")
+	fmt.Fprintln(w, "# TYPE hmc_led_open_serviceable_events gauge")
+	for _, s := range resp.Systems {
+		if s.OpenEventsErr != "" {
+			continue // unknown is not 0
+		}
+		fmt.Fprintf(w, "hmc_led_open_serviceable_events{%s} %d\n", systemLabels(s), s.OpenEvents)
+	}
+	fmt.Fprintln(w, "# HELP hmc_led_flapping The managed system is flapping (1 = flapping).")
+	fmt.Fprintln(w, "# TYPE hmc_led_flapping gauge")
+	for _, s := range resp.Systems {
+		fmt.Fprintf(w, "hmc_led_flapping{%s} %d\n", systemLabels(s), boolToInt(s.Flapping))
+	}
+	fmt.Fprintln(w, "# HELP hmc_led_silenced Notifications of the managed system are silenced (1 = silenced).")
+	fmt.Fprintln(w, "# TYPE hmc_led_silenced gauge")
+	for _, s := range resp.Systems {
+		fmt.Fprintf(w, "hmc_led_silenced{%s} %d\n", systemLabels(s), boolToInt(s.Silenced))
+	}
+	fmt.Fprintln(w, "# HELP hmc_led_acknowledged The lit attention LED of the managed system is acknowledged (1 = acknowledged).")
+	fmt.Fprintln(w, "# TYPE hmc_led_acknowledged gauge")
+	for _, s := range resp.Systems {
+		fmt.Fprintf(w, "hmc_led_acknowledged{%s} %d\n", systemLabels(s), boolToInt(s.Ack != nil))
+	}
+	fmt.Fprintln(w, "# HELP hmc_led_collect_elapsed_milliseconds Time spent collecting the HMC data.")
+	fmt.Fprintln(w, "# TYPE hmc_led_collect_elapsed_milliseconds gauge")
+	fmt.Fprintf(w, "hmc_led_collect_elapsed_milliseconds{hmc=%s} %d\n", promQuote(resp.HMC), resp.Elapsed)
+}
+
+func systemLabels(s *QuickMgms) string {
+	return fmt.Sprintf("hmc=%s,uuid=%s,mtms=%s,systemname=%s,location=%s",
+		promQuote(s.HMC), promQuote(s.UUID), promQuote(s.MTMS), promQuote(s.SysName), promQuote(s.Location))
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// SystemTracker remembers the last observed LED, state and reference code of every
+// managed system (frame) and the time any of them changed.
+type SystemTracker struct {
+	mu          sync.Mutex
+	systems     map[string]*trackedSystem
+	subscribers []func(changes []*SystemChange)
+	observers   []func(systems []*QuickMgms)
+
+	debouncePolls int
+	debounceTime  time.Duration
+	flapWindow    time.Duration
+	flapThreshold int
+}
+
+// SystemChange is a system whose LED, state or reference code changed, with the previous values.
+type SystemChange struct {
+	System      *QuickMgms // a copy, the subscriber may keep it
+	First       bool       // first observation, there are no previous values
+	PrevLED     bool
+	PrevState   string
+	PrevRefCode string
+}
+
+type trackedSystem struct {
+	led      bool
+	state    string
+	refCode  string
+	changed  time.Time
+	observed *QuickMgms // last observation
+	// debounce, the observed values differing from the recorded ones
+	hasPending   bool
+	pending      systemValues
+	pendingSince time.Time
+	pendingPolls int // fresh collections
+	// flap detection, the observed transitions within the flap window
+	last        systemValues
+	transitions []time.Time
+	flapping    bool
+}
+
+// trackerCheckInterval re-checks the held changes.
+const trackerCheckInterval = 5 * time.Second
+
+type systemValues struct {
+	led     bool
+	state   string
+	refCode string
+}
+
+// NewSystemTracker debounces changes: a new LED, state or reference code is only recorded
+// once it was observed in debounce_polls consecutive fresh collections and for debounce_time. A system
+// with flap_threshold or more observed transitions within flap_window is flapping, its changes
+// are held until the transitions dropped below half the threshold.
+func NewSystemTracker(config *viper.Viper) *SystemTracker {
+	t := &SystemTracker{
+		systems:       map[string]*trackedSystem{},
+		debouncePolls: config.GetInt("debounce_polls"),
+		debounceTime:  configDuration(config, "debounce_time", 0),
+		flapWindow:    configDuration(config, "flap_window", 0),
+		flapThreshold: config.GetInt("flap_threshold"),
+	}
+	if t.flapWindow > 0 && t.flapThreshold < 2 {
+		log.Warnf("flap_threshold %d is too low, flap detection disabled", t.flapThreshold)
+		t.flapWindow = 0
+	}
+	if t.debouncePolls > 1 || t.debounceTime > 0 {
+		log.Infof("Changes are recorded after %d polls and %s", max(t.debouncePolls, 1), t.debounceTime)
+	}
+	if t.flapWindow > 0 {
+		log.Infof("Systems with %d transitions in %s are flapping", t.flapThreshold, t.flapWindow)
+	}
+	return t
+}
+
+// Subscribe registers fn to be called with the systems which changed in an Update.
+// Subscribe before the first Update.
+func (t *SystemTracker) Subscribe(fn func(changes []*SystemChange)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.subscribers = append(t.subscribers, fn)
+}
+
+// Observe registers fn to be called with all systems of every Update, and with those whose
+// held change Run recorded, copies which fn may keep.
+// Observe before the first Update.
+func (t *SystemTracker) Observe(fn func(systems []*QuickMgms)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.observers = append(t.observers, fn)
+}
+
+// Update records the collected systems and sets their LastChange and Flapping. poll is true
+// for a fresh collection from the HMCs, only those count for debounce_polls; the cached data
+// a client request gets does not. The first observation of a system counts as a change.
+// The subscribers and observers get the recorded, debounced values.
+func (t *SystemTracker) Update(systems []*QuickMgms, poll bool) {
+
+	t.mu.Lock()
+
+	now := time.Now()
+	changes := []*SystemChange{}
+	observed := []*QuickMgms{}
+	for _, s := range systems {
+		key := frameKey(s)
+		ts, exists := t.systems[key]
+		if !exists {
+			ts = &trackedSystem{last: systemValues{led: s.LED, state: s.State, refCode: s.RefCode}}
+			t.systems[key] = ts
+		}
+		c := *s
+		ts.observed = &c
+		if change := t.track(ts, s, !exists, poll, now); change != nil {
+			changes = append(changes, change)
+		}
+		if len(t.observers) > 0 {
+			observed = append(observed, ts.recorded(s))
+		}
+	}
+	subscribers, observers := t.subscribers, t.observers
+	t.mu.Unlock()
+
+	t.publish(subscribers, changes, observers, observed)
+}
+
+// Run re-checks the held changes until ctx is done, so they are recorded once debounce_time
+// passed or the system stopped flapping without waiting for the next collection.
+func (t *SystemTracker) Run(ctx context.Context, wg *sync.WaitGroup) {
+
+	defer wg.Done()
+
+	if t.debounceTime <= 0 && t.flapWindow <= 0 {
+		return
+	}
+	ticker := time.NewTicker(trackerCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			t.recheck(now)
+		}
+	}
+}
+
+// recheck records the held changes which settled, the observers get those systems.
+func (t *SystemTracker) recheck(now time.Time) {
+
+	t.mu.Lock()
+
+	changes := []*SystemChange{}
+	observed := []*QuickMgms{}
+	for _, ts := range t.systems {
+		if !ts.hasPending && !ts.flapping {
+			continue
+		}
+		s := *ts.observed
+		flapping := ts.flapping
+		change := t.track(ts, &s, false, false, now)
+		if change != nil {
+			changes = append(changes, change)
+		}
+		if len(t.observers) > 0 && (change != nil || flapping != ts.flapping) {
+			observed = append(observed, ts.recorded(&s))
+		}
+	}
+	subscribers, observers := t.subscribers, t.observers
+	t.mu.Unlock()
+
+	t.publish(subscribers, changes, observers, observed)
+}
+
+func (t *SystemTracker) publish(subscribers []func([]*SystemChange), changes []*SystemChange, observers []func([]*QuickMgms), observed []*QuickMgms) {
+	if len(changes) > 0 {
+		for _, fn := range subscribers {
+			fn(changes)
+		}
+	}
+	if len(observed) > 0 {
+		for _, fn := range observers {
+			fn(observed)
+		}
+	}
+}
+
+// track records the observation s of ts and sets its LastChange and Flapping, it returns
+// the change to notify or nil. The caller holds mu.
+func (t *SystemTracker) track(ts *trackedSystem, s *QuickMgms, first bool, poll bool, now time.Time) *SystemChange {
+
+	values := systemValues{led: s.LED, state: s.State, refCode: s.RefCode}
+	t.detectFlapping(ts, s.SysName, values, now)
+
+	var change *SystemChange
+	switch {
+	case first:
+		change = &SystemChange{First: true}
+	case values == systemValues{ts.led, ts.state, ts.refCode}:
+		ts.hasPending = false
+	case t.settled(ts, values, poll, now):
+		change = &SystemChange{PrevLED: ts.led, PrevState: ts.state, PrevRefCode: ts.refCode}
+	}
+	if change != nil {
+		ts.changed = now
+		ts.led, ts.state, ts.refCode = s.LED, s.State, s.RefCode
+		ts.hasPending = false
+	}
+	s.LastChange = ts.changed
+	s.Flapping = ts.flapping
+	if change != nil {
+		c := *s
+		change.System = &c
+	}
+	return change
+}
+
+// recorded is a copy of s with the recorded LED, state and reference code. The caller holds mu.
+func (ts *trackedSystem) recorded(s *QuickMgms) *QuickMgms {
+	c := *s
+	c.LED, c.State, c.RefCode = ts.led, ts.state, ts.refCode
+	return &c
+}
+
+// settled is true when the observed values differing from the recorded ones passed the
+// debounce and the system is not flapping.
+func (t *SystemTracker) settled(ts *trackedSystem, values systemValues, poll bool, now time.Time) bool {
+
+	if !ts.hasPending || ts.pending != values {
+		ts.hasPending, ts.pending, ts.pendingSince, ts.pendingPolls = true, values, now, 0
+	}
+	if poll {
+		ts.pendingPolls++
+	}
+	return !ts.flapping && ts.pendingPolls >= t.debouncePolls && now.Sub(ts.pendingSince) >= t.debounceTime
+}
+
+// detectFlapping counts the observed transitions within the flap window.
+func (t *SystemTracker) detectFlapping(ts *trackedSystem, name string, values systemValues, now time.Time) {
+
+	if t.flapWindow <= 0 {
+		return
+	}
+	if values != ts.last {
+		ts.transitions = append(ts.transitions, now)
+		ts.last = values
+	}
+	for len(ts.transitions) > 0 && now.Sub(ts.transitions[0]) > t.flapWindow {
+		ts.transitions = ts.transitions[1:]
+	}
+	switch {
+	case !ts.flapping && len(ts.transitions) >= t.flapThreshold:
+		ts.flapping = true
+		log.Warnf("System %s is flapping, %d transitions in %s", name, len(ts.transitions), t.flapWindow)
+	case ts.flapping && len(ts.transitions) < (t.flapThreshold+1)/2:
+		ts.flapping = false
+		log.Infof("System %s stopped flapping", name)
+	}
+}
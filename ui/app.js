@@ -0,0 +1,181 @@
+// hmc_led dashboard. Polls /quickManagedSystem and renders one tile per managed system,
+// grouped by HMC and location. Refresh period in seconds can be set with ?refresh=N.
+"use strict";
+
+(function () {
+  const params = new URLSearchParams(window.location.search);
+  const refreshSeconds = Math.max(5, parseInt(params.get("refresh"), 10) || 30);
+  const okStates = ["operating", "standby"];
+
+  let systems = [];
+  let selected = null;
+
+  function el(tag, className, text) {
+    const e = document.createElement(tag);
+    if (className) {
+      e.className = className;
+    }
+    if (text !== undefined) {
+      e.textContent = text;
+    }
+    return e;
+  }
+
+  function tileClass(s) {
+    if (s.led) {
+      return s.ack ? "led acked" : "led";
+    }
+    return okStates.includes((s.state || "").toLowerCase()) ? "ok" : "warn";
+  }
+
+  function groupBy(list, key) {
+    const groups = new Map();
+    list.forEach(function (item) {
+      const k = key(item) || "(unknown)";
+      if (!groups.has(k)) {
+        groups.set(k, []);
+      }
+      groups.get(k).push(item);
+    });
+    return new Map([...groups.entries()].sort(function (a, b) {
+      return a[0].localeCompare(b[0]);
+    }));
+  }
+
+  function formatTime(value) {
+    if (!value || value.startsWith("0001-")) {
+      return "";
+    }
+    const d = new Date(value);
+    return isNaN(d) ? value : d.toLocaleString();
+  }
+
+  function render() {
+    const root = document.getElementById("groups");
+    root.replaceChildren();
+
+    groupBy(systems, function (s) { return s.hmc; }).forEach(function (hmcSystems, hmc) {
+      const section = el("section", "hmc");
+      section.appendChild(el("h2", null, hmc));
+
+      groupBy(hmcSystems, function (s) { return s.location; }).forEach(function (locSystems, location) {
+        const loc = el("section", "location");
+        loc.appendChild(el("h3", null, location));
+        const tiles = el("div", "tiles");
+        locSystems
+          .sort(function (a, b) { return a.systemname.localeCompare(b.systemname); })
+          .forEach(function (s) {
+            const tile = el("button", "tile " + tileClass(s));
+            tile.type = "button";
+            tile.appendChild(el("div", "name", s.systemname || s.uuid));
+            tile.appendChild(el("div", "mtms", s.mtms));
+            tile.appendChild(el("div", "state", s.state + (s.led ? " - LED " + s.rfc : "")));
+            if (s.ack) {
+              tile.appendChild(el("div", "ack", "ack " + (s.ack.ticket || s.ack.user)));
+            }
+            if (s.flapping) {
+              tile.appendChild(el("div", "flapping", "flapping"));
+            }
+            tile.addEventListener("click", function () { openDrawer(s.hmc, s.uuid); });
+            tiles.appendChild(tile);
+          });
+        loc.appendChild(tiles);
+        section.appendChild(loc);
+      });
+      root.appendChild(section);
+    });
+
+    const lit = systems.filter(function (s) { return s.led; }).length;
+    const acked = systems.filter(function (s) { return s.led && s.ack; }).length;
+    document.getElementById("summary").textContent =
+      systems.length + " systems, " + lit + " with attention LED lit" + (acked ? ", " + acked + " acknowledged" : "");
+
+    if (selected) {
+      openDrawer(selected.hmc, selected.uuid);
+    }
+  }
+
+  function openDrawer(hmc, uuid) {
+    const s = systems.find(function (x) { return x.hmc === hmc && x.uuid === uuid; });
+    if (!s) {
+      closeDrawer();
+      return;
+    }
+    selected = { hmc: hmc, uuid: uuid };
+    document.getElementById("drawer-title").textContent = s.systemname || s.uuid;
+
+    const details = [
+      ["HMC", s.hmc],
+      ["Location", s.location],
+      ["MTMS", s.mtms],
+      ["UUID", s.uuid],
+      ["State", s.state],
+      ["Attention LED", s.led ? "lit" : "off"],
+      ["Reference code", s.rfc],
+      ["Merged reference code", s.mrfc],
+      ["Open serviceable events", String(s.open_events || 0)],
+      ["Last change", formatTime(s.last_change)],
+    ];
+    if (s.flapping) {
+      details.push(["Flapping", "changes are held until it settles"]);
+    }
+    if (s.ack) {
+      details.push(["Acknowledged", s.ack.user + ", " + formatTime(s.ack.time)]);
+      details.push(["Ticket", s.ack.ticket]);
+      details.push(["Comment", s.ack.comment]);
+    }
+    if (s.managed_by && s.managed_by.length > 1) {
+      details.push(["Managed by", s.managed_by.map(function (m) {
+        return m.hmc + " (" + m.state + (m.authoritative ? ", authoritative" : "") + ")";
+      }).join(", ")]);
+    }
+    const dl = document.getElementById("drawer-details");
+    dl.replaceChildren();
+    details.forEach(function (d) {
+      dl.appendChild(el("dt", null, d[0]));
+      dl.appendChild(el("dd", null, d[1] || "-"));
+    });
+    document.getElementById("drawer").hidden = false;
+  }
+
+  function closeDrawer() {
+    selected = null;
+    document.getElementById("drawer").hidden = true;
+  }
+
+  function showError(message) {
+    const e = document.getElementById("error");
+    e.textContent = message;
+    e.hidden = !message;
+  }
+
+  function refresh() {
+    fetch("../quickManagedSystem?format=json", { credentials: "same-origin", cache: "no-store" })
+      .then(function (resp) {
+        if (!resp.ok) {
+          throw new Error("HTTP " + resp.status);
+        }
+        return resp.json();
+      })
+      .then(function (data) {
+        systems = data.systems || [];
+        showError("");
+        render();
+        document.getElementById("updated").textContent = "updated " + new Date().toLocaleTimeString();
+      })
+      .catch(function (err) {
+        showError("Could not load system status: " + err.message);
+      })
+      .finally(function () {
+        window.setTimeout(refresh, refreshSeconds * 1000);
+      });
+  }
+
+  document.getElementById("drawer-close").addEventListener("click", closeDrawer);
+  document.addEventListener("keydown", function (ev) {
+    if (ev.key === "Escape") {
+      closeDrawer();
+    }
+  });
+  refresh();
+})();
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// webhookQueueSize notifications wait for the webhook, more are dropped.
+const webhookQueueSize = 256
+
+// webhookAttempts a notification is posted before it is dropped.
+const webhookAttempts = 3
+
+func init() {
+	for _, format := range []string{"slack", "teams", "webhook"} {
+		format := format
+		RegisterNotifier(format, func(config *viper.Viper, deps *NotifierDeps) (Notifier, error) {
+			if wh, err := NewWebhookNotifier(config, format); wh != nil || err != nil {
+				return wh, err
+			}
+			return nil, nil
+		})
+	}
+}
+
+// WebhookNotifier posts notifications to an incoming webhook: slack is the {"text": ...}
+// payload Slack, Mattermost and Rocket.Chat accept, teams an Adaptive Card message for
+// Microsoft Teams workflows, webhook the notification as JSON.
+type WebhookNotifier struct {
+	format      string
+	url         string
+	contentType string
+	template    *texttemplate.Template
+	client      *http.Client
+	queue       chan *Notification
+
+	mu    sync.Mutex
+	stats WebhookStats
+}
+
+// WebhookStats is the webhook part of /status.
+type WebhookStats struct {
+	URL       string `json:"url" yaml:"url" xml:"url"`
+	Sent      int64  `json:"sent" yaml:"sent" xml:"sent"`
+	Retries   int64  `json:"retries" yaml:"retries" xml:"retries"`
+	Dropped   int64  `json:"dropped" yaml:"dropped" xml:"dropped"`
+	LastError string `json:"last_error,omitempty" yaml:"last_error,omitempty" xml:"last_error,omitempty"`
+}
+
+// NewWebhookNotifier returns nil without webhook_url. webhook_template formats the message
+// text of slack and teams, and the whole body of webhook, sent as webhook_content_type.
+func NewWebhookNotifier(config *viper.Viper, format string) (*WebhookNotifier, error) {
+
+	address := config.GetString("webhook_url")
+	if address == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("webhook_url %w", err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("webhook_url must be an http or https URL")
+	}
+	wh := &WebhookNotifier{
+		format:      format,
+		url:         address,
+		contentType: "application/json",
+		client: &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment},
+			Timeout:   configDuration(config, "webhook_timeout", 10*time.Second),
+		},
+		queue: make(chan *Notification, webhookQueueSize),
+	}
+	if wh.template, err = messageTemplate(config, "webhook_template"); err != nil {
+		return nil, err
+	}
+	if ct := config.GetString("webhook_content_type"); ct != "" {
+		wh.contentType = ct
+	}
+	// the path of Slack and Teams webhooks is the secret
+	wh.stats.URL = u.Scheme + "://" + u.Host
+	return wh, nil
+}
+
+// Notify queues a notification.
+func (wh *WebhookNotifier) Notify(ev *Notification) {
+	select {
+	case wh.queue <- ev:
+	default:
+		wh.mu.Lock()
+		wh.stats.Dropped++
+		wh.mu.Unlock()
+	}
+}
+
+func (wh *WebhookNotifier) Stats() interface{} {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	stats := wh.stats
+	return &stats
+}
+
+// Run posts the queued notifications until ctx is done. Failed posts are retried after
+// 5 seconds, or after Retry-After when the webhook throttles.
+func (wh *WebhookNotifier) Run(ctx context.Context, wg *sync.WaitGroup) {
+
+	defer wg.Done()
+
+	log.Infof("%s notifications to %s", wh.format, wh.stats.URL)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-wh.queue:
+			body, err := wh.payload(ev)
+			if err != nil {
+				log.Errorf("Webhook %s: %s", wh.stats.URL, err)
+				wh.mu.Lock()
+				wh.stats.Dropped++
+				wh.stats.LastError = err.Error()
+				wh.mu.Unlock()
+				continue
+			}
+			for attempt := 1; ; attempt++ {
+				retry, err := wh.post(ctx, body)
+				wh.mu.Lock()
+				if err == nil {
+					wh.stats.Sent++
+				} else {
+					wh.stats.LastError = err.Error()
+					if retry == 0 || attempt == webhookAttempts {
+						wh.stats.Dropped++
+					} else {
+						wh.stats.Retries++
+					}
+				}
+				wh.mu.Unlock()
+				if err == nil {
+					break
+				}
+				if retry == 0 || attempt == webhookAttempts {
+					log.Errorf("Webhook %s: %s, notification dropped", wh.stats.URL, err)
+					break
+				}
+				log.Warnf("Webhook %s: %s, retry in %s", wh.stats.URL, err, retry)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(retry):
+				}
+			}
+		}
+	}
+}
+
+// post sends body once. A failure that may pass returns the delay before the next attempt,
+// a rejected request returns zero.
+func (wh *WebhookNotifier) post(ctx context.Context, body []byte) (time.Duration, error) {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", wh.contentType)
+	req.Header.Set("User-Agent", "hmc_led/"+version)
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		// the *url.Error text has the whole URL, whose path is the secret
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = fmt.Errorf("%s %s: %w", urlErr.Op, wh.stats.URL, urlErr.Err)
+		}
+		return 5 * time.Second, err
+	}
+	defer resp.Body.Close()
+	text, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return 0, nil
+	}
+	err = fmt.Errorf("%s", resp.Status)
+	if msg := strings.TrimSpace(string(text)); msg != "" {
+		err = fmt.Errorf("%s: %s", resp.Status, msg)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		if seconds, e := strconv.Atoi(resp.Header.Get("Retry-After")); e == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second, err
+		}
+		return 5 * time.Second, err
+	}
+	return 0, err
+}
+
+// payload is the request body of ev in the webhook format.
+func (wh *WebhookNotifier) payload(ev *Notification) ([]byte, error) {
+
+	switch wh.format {
+	case "slack":
+		return json.Marshal(map[string]string{"text": ev.render(wh.template)})
+	case "teams":
+		return json.Marshal(teamsMessage(ev, ev.render(wh.template)))
+	default:
+		if wh.template != nil {
+			return []byte(ev.render(wh.template)), nil
+		}
+		return json.Marshal(ev)
+	}
+}
+
+// teamsMessage is an Adaptive Card, with the attributes of ev as facts.
+func teamsMessage(ev *Notification, text string) map[string]interface{} {
+
+	facts := []map[string]string{}
+	for _, p := range ev.fields() {
+		facts = append(facts, map[string]string{"title": p[0], "value": p[1]})
+	}
+	card := map[string]interface{}{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body": []interface{}{
+			map[string]interface{}{"type": "TextBlock", "text": cefName(ev.Kind), "weight": "Bolder", "size": "Medium", "wrap": true},
+			map[string]interface{}{"type": "TextBlock", "text": text, "wrap": true},
+			map[string]interface{}{"type": "FactSet", "facts": facts},
+		},
+	}
+	return map[string]interface{}{
+		"type": "message",
+		"attachments": []interface{}{
+			map[string]interface{}{"contentType": "application/vnd.microsoft.card.adaptive", "content": card},
+		},
+	}
+}